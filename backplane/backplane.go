@@ -0,0 +1,58 @@
+// Package backplane lets several instances of the server share meeting traffic. Hubs
+// publish meeting lifecycle and stack mutations to the backplane and every instance,
+// including the publisher, applies what it receives, so any instance can serve any
+// meeting.
+package backplane
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// Handler receives the payload of every message published to a subscribed topic. The
+// networked backplanes deliver messages on a topic one at a time in the order the
+// broker received them, so every instance sees the same sequence of mutations.
+type Handler func(payload []byte)
+
+// Subscription is an active subscription to a topic.
+type Subscription interface {
+	// Unsubscribe stops delivery of messages to the subscription's handler.
+	Unsubscribe() error
+}
+
+// Backplane is a publish/subscribe transport shared by all server instances.
+type Backplane interface {
+	// Publish sends the payload to every subscriber of the topic on every instance.
+	Publish(ctx context.Context, topic string, payload []byte) error
+
+	// Subscribe registers a handler for messages published to the topic.
+	Subscribe(topic string, handler Handler) (Subscription, error)
+
+	// Close releases any connections held by the backplane.
+	Close() error
+}
+
+// FromEnv builds the backplane selected by the BACKPLANE environment variable:
+// "memory" (the default) for a single instance, "redis" using REDIS_URL or "nats"
+// using NATS_URL.
+func FromEnv() (Backplane, error) {
+	switch kind := os.Getenv("BACKPLANE"); kind {
+	case "", "memory":
+		return NewMemory(), nil
+	case "redis":
+		url := os.Getenv("REDIS_URL")
+		if url == "" {
+			url = "redis://localhost:6379/0"
+		}
+		return NewRedis(url)
+	case "nats":
+		url := os.Getenv("NATS_URL")
+		if url == "" {
+			url = "nats://localhost:4222"
+		}
+		return NewNATS(url)
+	default:
+		return nil, fmt.Errorf("unknown BACKPLANE %q, expected memory, redis or nats", kind)
+	}
+}
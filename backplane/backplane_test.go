@@ -0,0 +1,179 @@
+package backplane
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+)
+
+// waitTimeout bounds how long a test waits for messages to arrive.
+const waitTimeout = 5 * time.Second
+
+// recorder collects the payloads delivered to a handler.
+type recorder struct {
+	mu       sync.Mutex
+	payloads []string
+	received chan struct{}
+}
+
+func newRecorder() *recorder {
+	return &recorder{received: make(chan struct{}, 1000)}
+}
+
+// handle is the Handler that records payloads.
+func (r *recorder) handle(payload []byte) {
+	r.mu.Lock()
+	r.payloads = append(r.payloads, string(payload))
+	r.mu.Unlock()
+	r.received <- struct{}{}
+}
+
+// wait waits for n payloads and returns everything received so far.
+func (r *recorder) wait(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.After(waitTimeout)
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.received:
+		case <-deadline:
+			t.Fatalf("timed out waiting for message %d of %d", i+1, n)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.payloads...)
+}
+
+// testSharedBackplane checks two connections to the same broker, standing in for two
+// instances: both see every message on a topic in the order it was published, only
+// on the topics they subscribed to, until they unsubscribe.
+func testSharedBackplane(t *testing.T, first Backplane, second Backplane) {
+	ctx := context.Background()
+	firstMeeting, secondMeeting, otherMeeting := newRecorder(), newRecorder(), newRecorder()
+	firstSubscription, err := first.Subscribe("meeting", firstMeeting.handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondSubscription, err := second.Subscribe("meeting", secondMeeting.handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.Subscribe("other", otherMeeting.handle); err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		payload := fmt.Sprintf("mutation %d", i)
+		want = append(want, payload)
+		if err := first.Publish(ctx, "meeting", []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, r := range map[string]*recorder{"publisher": firstMeeting, "other instance": secondMeeting} {
+		got := r.wait(t, len(want))
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s received %q, want %q", name, got, want)
+		}
+	}
+
+	if err := second.Publish(ctx, "other", []byte("elsewhere")); err != nil {
+		t.Fatal(err)
+	}
+	if got := otherMeeting.wait(t, 1); len(got) != 1 || got[0] != "elsewhere" {
+		t.Errorf("other topic received %q, want only its own message", got)
+	}
+
+	// Once unsubscribed the first instance stops receiving, the second carries on
+	if err := firstSubscription.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Publish(ctx, "meeting", []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	if got := secondMeeting.wait(t, 1); got[len(got)-1] != "after" {
+		t.Errorf("second instance last received %q, want %q", got[len(got)-1], "after")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := firstMeeting.wait(t, 0); len(got) != len(want) {
+		t.Errorf("unsubscribed instance received %q", got[len(want):])
+	}
+	if err := secondSubscription.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	memory := NewMemory()
+	defer memory.Close()
+	testSharedBackplane(t, memory, memory)
+}
+
+func TestRedis(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	first, err := NewRedis("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := NewRedis("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	testSharedBackplane(t, first, second)
+}
+
+func TestNATS(t *testing.T) {
+	options := natsserver.DefaultTestOptions
+	options.Port = -1
+	server := natsserver.RunServer(&options)
+	defer server.Shutdown()
+
+	first, err := NewNATS(server.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := NewNATS(server.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	testSharedBackplane(t, first, second)
+}
+
+func TestFromEnv(t *testing.T) {
+	previous, set := os.LookupEnv("BACKPLANE")
+	defer func() {
+		if set {
+			os.Setenv("BACKPLANE", previous)
+		} else {
+			os.Unsetenv("BACKPLANE")
+		}
+	}()
+
+	os.Setenv("BACKPLANE", "carrier-pigeon")
+	if _, err := FromEnv(); err == nil {
+		t.Error("FromEnv accepted an unknown backplane")
+	}
+	os.Unsetenv("BACKPLANE")
+	backplane, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backplane.Close()
+	if _, ok := backplane.(*Memory); !ok {
+		t.Errorf("FromEnv() = %T, want the memory backplane by default", backplane)
+	}
+}
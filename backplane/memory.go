@@ -0,0 +1,74 @@
+package backplane
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory is an in-process backplane for running a single instance. Publish delivers
+// to every handler synchronously in the publishing goroutine before returning.
+type Memory struct {
+	mu     sync.RWMutex
+	topics map[string]map[*memorySubscription]bool
+}
+
+// memorySubscription is a handler registered on a Memory topic.
+type memorySubscription struct {
+	memory  *Memory
+	topic   string
+	handler Handler
+}
+
+// NewMemory creates an empty in-process backplane.
+func NewMemory() *Memory {
+	return &Memory{topics: map[string]map[*memorySubscription]bool{}}
+}
+
+// Publish calls every handler subscribed to the topic with the payload.
+func (m *Memory) Publish(ctx context.Context, topic string, payload []byte) error {
+	m.mu.RLock()
+	subscriptions := make([]*memorySubscription, 0, len(m.topics[topic]))
+	for subscription := range m.topics[topic] {
+		subscriptions = append(subscriptions, subscription)
+	}
+	m.mu.RUnlock()
+
+	for _, subscription := range subscriptions {
+		subscription.handler(payload)
+	}
+	return nil
+}
+
+// Subscribe registers the handler for messages published to the topic.
+func (m *Memory) Subscribe(topic string, handler Handler) (Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	subscription := &memorySubscription{memory: m, topic: topic, handler: handler}
+	if m.topics[topic] == nil {
+		m.topics[topic] = map[*memorySubscription]bool{}
+	}
+	m.topics[topic][subscription] = true
+	return subscription, nil
+}
+
+// Close drops all subscriptions.
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.topics = map[string]map[*memorySubscription]bool{}
+	return nil
+}
+
+// Unsubscribe removes the handler from its topic.
+func (s *memorySubscription) Unsubscribe() error {
+	s.memory.mu.Lock()
+	defer s.memory.mu.Unlock()
+
+	delete(s.memory.topics[s.topic], s)
+	if len(s.memory.topics[s.topic]) == 0 {
+		delete(s.memory.topics, s.topic)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package backplane
+
+import (
+	"context"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsPrefix namespaces our subjects on a NATS server shared with other apps.
+const natsPrefix = "stack."
+
+// NATS is a backplane backed by core NATS subjects.
+type NATS struct {
+	conn *nats.Conn
+}
+
+// NewNATS connects to the NATS server at the given URL, e.g. nats://localhost:4222.
+func NewNATS(url string) (*NATS, error) {
+	conn, err := nats.Connect(url, nats.Name("stack-web-app"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	return &NATS{conn: conn}, nil
+}
+
+// Publish sends the payload to the topic's NATS subject.
+func (n *NATS) Publish(ctx context.Context, topic string, payload []byte) error {
+	return n.conn.Publish(natsPrefix+topic, payload)
+}
+
+// Subscribe subscribes to the topic's NATS subject. NATS delivers the messages of a
+// subscription to its handler one at a time.
+func (n *NATS) Subscribe(topic string, handler Handler) (Subscription, error) {
+	subscription, err := n.conn.Subscribe(natsPrefix+topic, func(message *nats.Msg) {
+		handler(message.Data)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the server has registered the subscription before we return
+	if err := n.conn.Flush(); err != nil {
+		_ = subscription.Unsubscribe()
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// Close drains outstanding messages and closes the connection to NATS.
+func (n *NATS) Close() error {
+	return n.conn.Drain()
+}
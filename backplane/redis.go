@@ -0,0 +1,70 @@
+package backplane
+
+import (
+	"context"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redisPrefix namespaces our channels on a Redis server shared with other apps.
+const redisPrefix = "stack:"
+
+// Redis is a backplane backed by Redis pub/sub.
+type Redis struct {
+	client *redis.Client
+}
+
+// redisSubscription is an active Redis pub/sub subscription.
+type redisSubscription struct {
+	pubsub *redis.PubSub
+}
+
+// NewRedis connects to the Redis server at the given URL, e.g.
+// redis://:password@localhost:6379/0.
+func NewRedis(url string) (*Redis, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return &Redis{client: client}, nil
+}
+
+// Publish sends the payload to the topic's Redis channel.
+func (r *Redis) Publish(ctx context.Context, topic string, payload []byte) error {
+	return r.client.Publish(ctx, redisPrefix+topic, payload).Err()
+}
+
+// Subscribe subscribes to the topic's Redis channel and delivers messages to the
+// handler from a dedicated goroutine.
+func (r *Redis) Subscribe(topic string, handler Handler) (Subscription, error) {
+	ctx := context.Background()
+	pubsub := r.client.Subscribe(ctx, redisPrefix+topic)
+
+	// Wait for the subscription to be confirmed so no messages published after we
+	// return are missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		_ = pubsub.Close()
+		return nil, err
+	}
+	go func() {
+		for message := range pubsub.Channel() {
+			handler([]byte(message.Payload))
+		}
+	}()
+	return &redisSubscription{pubsub: pubsub}, nil
+}
+
+// Close closes the connection to Redis.
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
+
+// Unsubscribe closes the subscription, which also stops its delivery goroutine.
+func (s *redisSubscription) Unsubscribe() error {
+	return s.pubsub.Close()
+}
@@ -0,0 +1,294 @@
+// Package chatbot lets people use the stack from a chat platform's slash commands,
+// e.g. "/stack on" or "/stack list", taking the same stack actions as the websocket
+// clients. Each platform is supported by an Adapter that reads its incoming webhook
+// requests and writes its replies.
+package chatbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"stack-web-app/metrics"
+	"stack-web-app/wshandler"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// ErrBadSignature is returned by adapters for requests that weren't signed by the
+// chat platform.
+var ErrBadSignature = errors.New("invalid request signature")
+
+// Command is a slash command typed by someone in a chat channel.
+type Command struct {
+	// TeamId, ChannelId and UserId identify the workspace, channel and person on the
+	// chat platform. UserName is the name shown for them on the stack.
+	TeamId    string
+	ChannelId string
+	UserId    string
+	UserName  string
+
+	// Text is everything typed after the slash command, e.g. "on".
+	Text string
+}
+
+// Reply is the bot's answer to a command.
+type Reply struct {
+	Text string
+
+	// Public replies are shown to everyone in the channel, the rest only to whoever
+	// typed the command.
+	Public bool
+}
+
+// Adapter speaks a chat platform's slash command protocol.
+type Adapter interface {
+	// Name identifies the platform. It prefixes the IDs chat users are put on the
+	// stack with, so that users of different platforms never clash.
+	Name() string
+
+	// Parse authenticates and decodes an incoming command request, returning
+	// ErrBadSignature if it wasn't signed by the platform.
+	Parse(r *http.Request) (Command, error)
+
+	// Write sends a reply as the response to the command request.
+	Write(w http.ResponseWriter, reply Reply) error
+}
+
+// binding is the meeting a chat channel is using.
+type binding struct {
+	meeting string
+
+	// Chat users who gave the meeting's moderator token
+	moderators map[string]bool
+}
+
+// Bot answers stack commands, remembering which meeting each chat channel is using.
+// Those bindings, and who can moderate from each channel, are only kept in memory: they
+// are lost when the instance restarts and aren't shared with other instances, so chat
+// platforms should send every command to the same instance.
+type Bot struct {
+	// Guards bindings and limiters
+	mu       sync.Mutex
+	bindings map[string]*binding
+
+	// Stack action rate limiters of chat users by the ID they are on the stack as, so
+	// they are held to the same limits as websocket clients
+	limiters map[string]*rate.Limiter
+}
+
+// help is the reply to "help" and to commands the bot doesn't know.
+const help = "Commands:\n" +
+	"• `use <meeting code> [moderator token]` picks the meeting for this channel\n" +
+	"• `on` and `off` get you on and off the stack\n" +
+	"• `list` shows the stack\n" +
+	"• `next` and `remove <user>` take the current speaker or someone else off the stack (moderators only)"
+
+// NewBot creates a bot with no channels bound to meetings.
+func NewBot() *Bot {
+	return &Bot{bindings: map[string]*binding{}, limiters: map[string]*rate.Limiter{}}
+}
+
+// Handler serves a platform's slash command requests.
+func (b *Bot) Handler(adapter Adapter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get logger from request context
+		logger := contextLogger(r.Context()).WithFields(log.Fields{
+			"module":   "chatbot",
+			"function": "Handler",
+			"platform": adapter.Name(),
+		})
+
+		command, err := adapter.Parse(r)
+		if err == ErrBadSignature {
+			logger.Debug("Rejecting chat command with an invalid signature.")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			logger.WithField("error", err.Error()).Debug("Invalid chat command request.")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		reply := b.Handle(r.Context(), adapter.Name(), command)
+		err = adapter.Write(w, reply)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Error writing chat command reply.")
+		}
+	}
+}
+
+// Handle runs a command from the named platform and returns the reply.
+func (b *Bot) Handle(ctx context.Context, platform string, command Command) Reply {
+	// Get logger from request context
+	logger := contextLogger(ctx).WithFields(log.Fields{
+		"module":    "chatbot",
+		"function":  "Handle",
+		"platform":  platform,
+		"channelId": command.ChannelId,
+		"userId":    command.UserId,
+	})
+
+	args := strings.Fields(command.Text)
+	if len(args) == 0 {
+		return Reply{Text: help}
+	}
+	channel := platform + ":" + command.TeamId + ":" + command.ChannelId
+	if args[0] == "use" {
+		return b.use(channel, command, args[1:])
+	}
+
+	b.mu.Lock()
+	bound, ok := b.bindings[channel]
+	var meeting string
+	var moderator bool
+	if ok {
+		meeting = bound.meeting
+		moderator = bound.moderators[command.UserId]
+	}
+	b.mu.Unlock()
+	if !ok {
+		return Reply{Text: "This channel isn't using a meeting yet, pick one with `use <meeting code>`."}
+	}
+
+	action := wshandler.Action{
+		SpeakerId: speakerId(platform, command.TeamId, command.UserId),
+		Name:      command.UserName,
+		Moderator: moderator,
+	}
+	var done string
+	switch args[0] {
+	case "list":
+		return list(ctx, meeting)
+	case "on":
+		action.Action = "on"
+		done = fmt.Sprintf("%s got on the stack.", command.UserName)
+	case "off":
+		action.Action = "off"
+		done = fmt.Sprintf("%s got off the stack.", command.UserName)
+	case "next":
+		action.Action = "next"
+		done = "Moving on to the next speaker."
+	case "remove":
+		if len(args) < 2 {
+			return Reply{Text: "Usage: `remove <user>`"}
+		}
+		action.Action = "remove"
+		action.TargetId = speakerId(platform, command.TeamId, mentionedUser(args[1]))
+		done = fmt.Sprintf("%s took %s off the stack.", command.UserName, args[1])
+	default:
+		return Reply{Text: help}
+	}
+
+	if !b.allow(action.SpeakerId) {
+		metrics.RateLimited.WithLabelValues("action").Inc()
+		logger.Debug("Chat user is taking actions too quickly.")
+		return Reply{Text: wshandler.ErrActionRateLimited.Error()}
+	}
+	err := wshandler.ApplyAction(ctx, meeting, action)
+	switch err {
+	case nil:
+		return Reply{Text: done, Public: true}
+	case wshandler.ErrNotModerator:
+		return Reply{Text: "Only the meeting's moderator can do that, give the moderator token with `use <meeting code> <moderator token>`."}
+	case wshandler.ErrMeetingNotFound:
+		return Reply{Text: "The meeting this channel was using has ended, pick another with `use <meeting code>`."}
+	default:
+		logger.WithField("error", err.Error()).Error("Error applying stack action from chat.")
+		return Reply{Text: "Something went wrong, please try again."}
+	}
+}
+
+// allow reports whether the chat user may take another stack action now.
+func (b *Bot) allow(speakerId string) bool {
+	b.mu.Lock()
+	limiter, ok := b.limiters[speakerId]
+	if !ok {
+		limiter = wshandler.NewActionLimiter()
+		b.limiters[speakerId] = limiter
+	}
+	b.mu.Unlock()
+	return limiter.Allow()
+}
+
+// use binds the channel to a meeting, making the user one of its moderators if they
+// gave the moderator token.
+func (b *Bot) use(channel string, command Command, args []string) Reply {
+	if len(args) == 0 {
+		return Reply{Text: "Usage: `use <meeting code> [moderator token]`"}
+	}
+	meeting := args[0]
+	if _, _, err := wshandler.MeetingStack(context.Background(), meeting); err != nil {
+		return Reply{Text: fmt.Sprintf("There's no meeting called %s.", meeting)}
+	}
+	moderator := len(args) > 1 && wshandler.IsModerator(meeting, args[1])
+	if len(args) > 1 && !moderator {
+		return Reply{Text: "That isn't the meeting's moderator token."}
+	}
+
+	b.mu.Lock()
+	bound, ok := b.bindings[channel]
+	if !ok || bound.meeting != meeting {
+		bound = &binding{meeting: meeting, moderators: map[string]bool{}}
+		b.bindings[channel] = bound
+	}
+	if moderator {
+		bound.moderators[command.UserId] = true
+	}
+	b.mu.Unlock()
+
+	if moderator {
+		return Reply{Text: fmt.Sprintf("This channel is now using meeting %s, and you can moderate it.", meeting)}
+	}
+	return Reply{Text: fmt.Sprintf("%s pointed this channel at meeting %s.", command.UserName, meeting), Public: true}
+}
+
+// list replies with the meeting's stack.
+func list(ctx context.Context, meeting string) Reply {
+	_, stack, err := wshandler.MeetingStack(ctx, meeting)
+	if err == wshandler.ErrMeetingNotFound {
+		return Reply{Text: "The meeting this channel was using has ended, pick another with `use <meeting code>`."}
+	}
+	if err != nil {
+		contextLogger(ctx).WithField("error", err.Error()).Error("Error reading stack for chat.")
+		return Reply{Text: "Something went wrong, please try again."}
+	}
+	if len(stack) == 0 {
+		return Reply{Text: "The stack is empty.", Public: true}
+	}
+	var text strings.Builder
+	for i, user := range stack {
+		name := user.Name
+		if name == "" {
+			name = "Anonymous"
+		}
+		if i == 0 {
+			fmt.Fprintf(&text, "Speaking: %s", name)
+		} else {
+			fmt.Fprintf(&text, "\n%d. %s", i, name)
+		}
+	}
+	return Reply{Text: text.String(), Public: true}
+}
+
+// speakerId is the ID a chat user is put on the stack with.
+func speakerId(platform string, teamId string, userId string) string {
+	return platform + ":" + teamId + ":" + userId
+}
+
+// mentionedUser returns the user ID in a mention like "<@U123|ann>", or the argument
+// as given if it isn't one.
+func mentionedUser(arg string) string {
+	if strings.HasPrefix(arg, "<@") && strings.HasSuffix(arg, ">") {
+		arg = strings.TrimSuffix(strings.TrimPrefix(arg, "<@"), ">")
+		if i := strings.IndexByte(arg, '|'); i >= 0 {
+			arg = arg[:i]
+		}
+	}
+	return arg
+}
@@ -0,0 +1,262 @@
+package chatbot_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"stack-web-app/client"
+	"stack-web-app/db"
+	"stack-web-app/protocol"
+	"stack-web-app/server"
+	"stack-web-app/webhook"
+	"stack-web-app/wshandler"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	slackSecret = "slack-signing-secret"
+	chatSecret  = "chat-secret"
+)
+
+// serverURL is the in-process server serving the chat integrations.
+var serverURL string
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.WarnLevel)
+	if err := db.StartInMemory(); err != nil {
+		fmt.Fprintln(os.Stderr, "starting in-memory database:", err)
+		os.Exit(1)
+	}
+	testServer := httptest.NewServer(server.NewRouter(server.Options{
+		ChatSecret:         chatSecret,
+		SlackSigningSecret: slackSecret,
+	}))
+	serverURL = testServer.URL
+	code := m.Run()
+	testServer.Close()
+	os.Exit(code)
+}
+
+// slackReply is Slack's slash command response.
+type slackReply struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+// slackRequest builds a slash command request the way Slack signs them.
+func slackRequest(t *testing.T, secret string, sent time.Time, form url.Values) *http.Request {
+	t.Helper()
+	body := form.Encode()
+	timestamp := strconv.FormatInt(sent.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":" + body))
+	request, err := http.NewRequest(http.MethodPost, serverURL+"/integrations/slack", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("X-Slack-Request-Timestamp", timestamp)
+	request.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return request
+}
+
+// slack sends a signed slash command from a user in the test channel.
+func slack(t *testing.T, userId string, text string) slackReply {
+	t.Helper()
+	response, err := http.DefaultClient.Do(slackRequest(t, slackSecret, time.Now(), url.Values{
+		"team_id":    {"T1"},
+		"channel_id": {"C1"},
+		"user_id":    {userId},
+		"user_name":  {userId + "-name"},
+		"text":       {text},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("/stack %s responded %s", text, response.Status)
+	}
+	var reply slackReply
+	if err := json.NewDecoder(response.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+// stack returns the names on the meeting's stack.
+func stack(t *testing.T, meetingId string) []string {
+	t.Helper()
+	_, users, err := wshandler.MeetingStack(context.Background(), meetingId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, user := range users {
+		names = append(names, user.Name)
+	}
+	return names
+}
+
+func TestSlackRejectsBadRequests(t *testing.T) {
+	form := url.Values{"team_id": {"T1"}, "channel_id": {"C1"}, "user_id": {"U1"}, "text": {"list"}}
+	tests := []struct {
+		name    string
+		request func() *http.Request
+	}{
+		{"wrong secret", func() *http.Request { return slackRequest(t, "not-the-secret", time.Now(), form) }},
+		{"stale", func() *http.Request { return slackRequest(t, slackSecret, time.Now().Add(-10*time.Minute), form) }},
+		{"from the future", func() *http.Request { return slackRequest(t, slackSecret, time.Now().Add(10*time.Minute), form) }},
+		{"unsigned", func() *http.Request {
+			request := slackRequest(t, slackSecret, time.Now(), form)
+			request.Header.Del("X-Slack-Signature")
+			return request
+		}},
+		{"tampered body", func() *http.Request {
+			request := slackRequest(t, slackSecret, time.Now(), form)
+			tampered := strings.Replace(form.Encode(), "list", "next", 1)
+			request.Body = ioutil.NopCloser(strings.NewReader(tampered))
+			request.ContentLength = int64(len(tampered))
+			return request
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := http.DefaultClient.Do(test.request())
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if response.StatusCode != http.StatusUnauthorized {
+				t.Errorf("responded %s, want 401", response.Status)
+			}
+		})
+	}
+}
+
+func TestGenericRejectsBadRequests(t *testing.T) {
+	body := []byte(`{"team": "T1", "channel": "C1", "user": "U1", "text": "list"}`)
+	send := func(secret string, sent time.Time) int {
+		timestamp := strconv.FormatInt(sent.Unix(), 10)
+		request, err := http.NewRequest(http.MethodPost, serverURL+"/integrations/chat", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set(webhook.HeaderTimestamp, timestamp)
+		request.Header.Set(webhook.HeaderSignature, webhook.Sign(secret, timestamp, body))
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+	if status := send(chatSecret, time.Now()); status != http.StatusOK {
+		t.Errorf("signed request got %d, want 200", status)
+	}
+	if status := send("not-the-secret", time.Now()); status != http.StatusUnauthorized {
+		t.Errorf("request with the wrong secret got %d, want 401", status)
+	}
+	if status := send(chatSecret, time.Now().Add(-10*time.Minute)); status != http.StatusUnauthorized {
+		t.Errorf("stale request got %d, want 401", status)
+	}
+}
+
+func TestSlackCommands(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	meeting, err := client.Create(ctx, serverURL, protocol.MeetingRequest{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reply := slack(t, "U1", "on"); !strings.Contains(reply.Text, "isn't using a meeting") {
+		t.Errorf("on before use replied %q", reply.Text)
+	}
+	if reply := slack(t, "U1", "use NOPE-000"); !strings.Contains(reply.Text, "no meeting") {
+		t.Errorf("use of an unknown meeting replied %q", reply.Text)
+	}
+	if reply := slack(t, "U1", "use "+meeting.MeetingCode); reply.ResponseType != "in_channel" {
+		t.Errorf("use replied %+v, want a public reply", reply)
+	}
+
+	slack(t, "U1", "on")
+	slack(t, "U2", "on")
+	slack(t, "U3", "on")
+	if got := stack(t, meeting.MeetingId); fmt.Sprint(got) != "[U1-name U2-name U3-name]" {
+		t.Fatalf("stack = %v, want U1, U2 and U3 in order", got)
+	}
+	if reply := slack(t, "U2", "list"); reply.Text != "Speaking: U1-name\n1. U2-name\n2. U3-name" {
+		t.Errorf("list replied %q", reply.Text)
+	}
+
+	// Only moderators can move the stack on
+	if reply := slack(t, "U2", "next"); !strings.Contains(reply.Text, "moderator") || reply.ResponseType != "ephemeral" {
+		t.Errorf("next from a participant replied %+v", reply)
+	}
+	if reply := slack(t, "U9", "use "+meeting.MeetingCode+" wrong-token"); !strings.Contains(reply.Text, "isn't the meeting's moderator token") {
+		t.Errorf("use with a wrong token replied %q", reply.Text)
+	}
+	if reply := slack(t, "U9", "use "+meeting.MeetingCode+" "+meeting.ModeratorToken); !strings.Contains(reply.Text, "moderate") {
+		t.Errorf("use with the moderator token replied %q", reply.Text)
+	}
+	if reply := slack(t, "U9", "next"); reply.ResponseType != "in_channel" {
+		t.Errorf("next from the moderator replied %+v", reply)
+	}
+	if got := stack(t, meeting.MeetingId); fmt.Sprint(got) != "[U2-name U3-name]" {
+		t.Errorf("stack after next = %v, want U2 and U3", got)
+	}
+
+	slack(t, "U3", "off")
+	if got := stack(t, meeting.MeetingId); fmt.Sprint(got) != "[U2-name]" {
+		t.Errorf("stack after off = %v, want U2", got)
+	}
+	slack(t, "U9", "remove <@U2|u2>")
+	if got := stack(t, meeting.MeetingId); len(got) != 0 {
+		t.Errorf("stack after remove = %v, want it empty", got)
+	}
+	if reply := slack(t, "U1", "list"); reply.Text != "The stack is empty." {
+		t.Errorf("list replied %q", reply.Text)
+	}
+}
+
+func TestChatUsersAreRateLimited(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	meeting, err := client.Create(ctx, serverURL, protocol.MeetingRequest{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slack(t, "U1", "use "+meeting.MeetingCode)
+
+	// Chat users are held to the same action rate limit as websocket clients
+	limited := 0
+	for i := 0; i < 2*wshandler.DefaultLimits.ActionBurst; i++ {
+		if reply := slack(t, "U1", "on"); reply.Text == wshandler.ErrActionRateLimited.Error() {
+			limited++
+		}
+	}
+	if limited == 0 {
+		t.Errorf("none of %d actions in a row were rate limited", 2*wshandler.DefaultLimits.ActionBurst)
+	}
+
+	// Other chat users have their own limit
+	if reply := slack(t, "U2", "on"); reply.Text == wshandler.ErrActionRateLimited.Error() {
+		t.Error("another chat user was rate limited")
+	}
+}
@@ -0,0 +1,93 @@
+package chatbot
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"stack-web-app/webhook"
+)
+
+// maxRequestAge is how old a signed command request may be, to stop captured requests
+// being replayed later.
+const maxRequestAge = 5 * time.Minute
+
+// maxRequestSize bounds the command request bodies read.
+const maxRequestSize = 64 * 1024
+
+// genericCommand is the JSON body of a generic command request.
+type genericCommand struct {
+	Team     string `json:"team"`
+	Channel  string `json:"channel"`
+	User     string `json:"user"`
+	UserName string `json:"userName"`
+	Text     string `json:"text"`
+}
+
+// genericReply is the JSON body of a generic command response.
+type genericReply struct {
+	Text   string `json:"text"`
+	Public bool   `json:"public"`
+}
+
+// Generic is an adapter for chat platforms, or glue code in front of them, that don't
+// have an adapter of their own. Commands are POSTed as JSON like
+// {"team": ..., "channel": ..., "user": ..., "userName": ..., "text": "on"} and signed
+// the same way as outgoing webhooks, and replies are {"text": ..., "public": ...}.
+type Generic struct {
+	secret string
+}
+
+// NewGeneric creates a generic adapter checking requests are signed with the secret.
+func NewGeneric(secret string) *Generic {
+	return &Generic{secret: secret}
+}
+
+// Name identifies the adapter.
+func (g *Generic) Name() string {
+	return "chat"
+}
+
+// Parse checks the request's X-Stack-Signature and decodes the command.
+func (g *Generic) Parse(r *http.Request) (Command, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		return Command{}, err
+	}
+	timestamp := r.Header.Get(webhook.HeaderTimestamp)
+	if !fresh(timestamp) || !webhook.Verify(g.secret, timestamp, body, r.Header.Get(webhook.HeaderSignature)) {
+		return Command{}, ErrBadSignature
+	}
+
+	var request genericCommand
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		return Command{}, err
+	}
+	return Command{
+		TeamId:    request.Team,
+		ChannelId: request.Channel,
+		UserId:    request.User,
+		UserName:  request.UserName,
+		Text:      request.Text,
+	}, nil
+}
+
+// Write sends the reply as JSON.
+func (g *Generic) Write(w http.ResponseWriter, reply Reply) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(genericReply{Text: reply.Text, Public: reply.Public})
+}
+
+// fresh reports whether a request timestamp in Unix seconds is recent enough to accept.
+func fresh(timestamp string) bool {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(seconds, 0))
+	return age < maxRequestAge && age > -maxRequestAge
+}
@@ -0,0 +1,14 @@
+package chatbot
+
+import (
+	"context"
+
+	"stack-web-app/logging"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// contextLogger returns the logger carried by ctx, tagged with this package's name.
+func contextLogger(ctx context.Context) *log.Entry {
+	return logging.FromContext(ctx).WithField("package", "chatbot")
+}
@@ -0,0 +1,80 @@
+package chatbot
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// slackReply is the JSON body Slack expects in response to a slash command.
+type slackReply struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+// Slack is an adapter for Slack slash commands. Point the command's request URL at
+// the adapter's route and give it the Slack app's signing secret.
+type Slack struct {
+	signingSecret string
+}
+
+// NewSlack creates a Slack adapter checking requests are signed with the app's
+// signing secret.
+func NewSlack(signingSecret string) *Slack {
+	return &Slack{signingSecret: signingSecret}
+}
+
+// Name identifies the adapter.
+func (s *Slack) Name() string {
+	return "slack"
+}
+
+// Parse checks Slack's request signature and decodes the form encoded slash command.
+// See https://api.slack.com/authentication/verifying-requests-from-slack.
+func (s *Slack) Parse(r *http.Request) (Command, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		return Command{}, err
+	}
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+	if !fresh(timestamp) || !s.verify(timestamp, body, r.Header.Get("X-Slack-Signature")) {
+		return Command{}, ErrBadSignature
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return Command{}, err
+	}
+	return Command{
+		TeamId:    form.Get("team_id"),
+		ChannelId: form.Get("channel_id"),
+		UserId:    form.Get("user_id"),
+		UserName:  form.Get("user_name"),
+		Text:      form.Get("text"),
+	}, nil
+}
+
+// verify checks a "v0=<hex HMAC-SHA256 of v0:timestamp:body>" signature.
+func (s *Slack) verify(timestamp string, body []byte, signature string) bool {
+	mac := hmac.New(sha256.New, []byte(s.signingSecret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// Write sends the reply in Slack's slash command response format, in the channel for
+// public replies and only to the user who typed the command otherwise.
+func (s *Slack) Write(w http.ResponseWriter, reply Reply) error {
+	responseType := "ephemeral"
+	if reply.Public {
+		responseType = "in_channel"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(slackReply{ResponseType: responseType, Text: reply.Text})
+}
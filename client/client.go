@@ -0,0 +1,573 @@
+// Package client is a Go client for the stack server, for bots, tools and integration
+// tests. Join a meeting to get a Meeting, which keeps a live copy of the stack,
+// takes stack actions and reconnects by itself when the connection drops:
+//
+//	meeting, err := client.Join(ctx, "http://localhost:8080", "standup", client.Options{Name: "Ann"})
+//	if err != nil {
+//		return err
+//	}
+//	defer meeting.Close()
+//	meeting.Subscribe(func(stack client.Stack) {
+//		fmt.Println(stack.Current())
+//	})
+//	err = meeting.GetOnStack()
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"stack-web-app/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// ErrMeetingNotFound is returned when the server has no meeting with the given ID,
+	// code or slug.
+	ErrMeetingNotFound = errors.New("meeting not found")
+
+	// ErrClosed is returned for actions taken after the meeting was closed.
+	ErrClosed = errors.New("meeting closed")
+
+	// ErrConnectionLost is reported to OnError when the connection drops, before
+	// reconnecting.
+	ErrConnectionLost = errors.New("connection lost")
+)
+
+// ServerError is an error message sent by the server, e.g. when a participant who
+// isn't the moderator tries a moderator action.
+type ServerError string
+
+// Error returns the server's message.
+func (e ServerError) Error() string { return string(e) }
+
+// ServerWarning is a warning sent by the server, e.g. when some updates were skipped
+// because the client wasn't reading them quickly enough.
+type ServerWarning string
+
+// Error returns the server's message.
+func (w ServerWarning) Error() string { return string(w) }
+
+// Stack is the meeting's stack, the first of whom is speaking.
+type Stack []protocol.User
+
+// Current returns the participant speaking, if anyone is on the stack.
+func (s Stack) Current() (user protocol.User, ok bool) {
+	if len(s) == 0 {
+		return protocol.User{}, false
+	}
+	return s[0], true
+}
+
+// Position returns the 1-based position of the participant on the stack, or 0 if they
+// aren't on it.
+func (s Stack) Position(speakerId string) int {
+	for i, user := range s {
+		if user.SpeakerId == speakerId {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Options configure how a Meeting is joined.
+type Options struct {
+	// Name is shown for the participant on the stack.
+	Name string
+
+	// ModeratorToken, returned when the meeting was created, allows Next and Remove.
+	ModeratorToken string
+
+	// HTTPClient is used for API requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	// Dialer is used to open websockets, websocket.DefaultDialer if nil.
+	Dialer *websocket.Dialer
+
+	// MinBackoff and MaxBackoff bound the wait between reconnection attempts, which
+	// doubles after every failed attempt. They default to 250ms and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnError is called with errors and warnings sent by the server and when the
+	// connection drops, before reconnecting. It must not block.
+	OnError func(err error)
+}
+
+// Create creates a meeting on the server.
+func Create(ctx context.Context, server string, request protocol.MeetingRequest, httpClient *http.Client) (protocol.Meeting, error) {
+	var meeting protocol.Meeting
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return meeting, err
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(server, "/")+"/api/meetings", bytes.NewReader(body))
+	if err != nil {
+		return meeting, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	err = doJSON(httpClient, httpRequest, &meeting)
+	return meeting, err
+}
+
+// GetMeeting looks a meeting up by ID, code or slug.
+func GetMeeting(ctx context.Context, server string, meetingRef string, httpClient *http.Client) (protocol.Meeting, error) {
+	var meeting protocol.Meeting
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(server, "/")+"/api/meetings/"+url.PathEscape(meetingRef), nil)
+	if err != nil {
+		return meeting, err
+	}
+	err = doJSON(httpClient, httpRequest, &meeting)
+	return meeting, err
+}
+
+// doJSON sends an API request and decodes the JSON response, turning error responses
+// into errors.
+func doJSON(httpClient *http.Client, request *http.Request, v interface{}) error {
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return ErrMeetingNotFound
+	}
+	if response.StatusCode != http.StatusOK {
+		var failure protocol.Error
+		if json.NewDecoder(response.Body).Decode(&failure) == nil && failure.Error != "" {
+			return ServerError(failure.Error)
+		}
+		return fmt.Errorf("server responded with %s", response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// Meeting is a live connection to a meeting.
+type Meeting struct {
+	info    protocol.Meeting
+	wsURL   string
+	options Options
+	closing chan struct{}
+	done    chan struct{}
+
+	// Guards everything below. Writes to conn are made holding it.
+	mu          sync.Mutex
+	conn        *websocket.Conn
+	stack       Stack
+	rev         uint64
+	resyncing   bool
+	clientId    string
+	resumeToken string
+	wantOn      bool
+	subscribers map[int]func(Stack)
+	nextId      int
+	closed      bool
+	err         error
+}
+
+// Join connects to the meeting with the given ID, code or slug and returns once the
+// current stack has been received.
+func Join(ctx context.Context, server string, meetingRef string, options Options) (*Meeting, error) {
+	if options.HTTPClient == nil {
+		options.HTTPClient = http.DefaultClient
+	}
+	if options.Dialer == nil {
+		options.Dialer = websocket.DefaultDialer
+	}
+	if options.MinBackoff <= 0 {
+		options.MinBackoff = 250 * time.Millisecond
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = 30 * time.Second
+	}
+
+	info, err := GetMeeting(ctx, server, meetingRef, options.HTTPClient)
+	if err != nil {
+		return nil, err
+	}
+	wsURL, err := url.Parse(strings.TrimSuffix(server, "/") + "/ws")
+	if err != nil {
+		return nil, err
+	}
+	switch wsURL.Scheme {
+	case "http":
+		wsURL.Scheme = "ws"
+	case "https":
+		wsURL.Scheme = "wss"
+	}
+	query := url.Values{"meeting_id": {info.MeetingId}}
+	if options.ModeratorToken != "" {
+		query.Set("moderator", options.ModeratorToken)
+	}
+	wsURL.RawQuery = query.Encode()
+
+	m := &Meeting{
+		info:        info,
+		wsURL:       wsURL.String(),
+		options:     options,
+		closing:     make(chan struct{}),
+		done:        make(chan struct{}),
+		subscribers: map[int]func(Stack){},
+	}
+	conn, err := m.dial(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	err = m.start(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go m.run()
+	return m, nil
+}
+
+// Info returns the meeting's ID, code and slug.
+func (m *Meeting) Info() protocol.Meeting {
+	return m.info
+}
+
+// ClientId returns the ID the server knows this participant by, which changes when
+// reconnecting unless the participant's place could be resumed.
+func (m *Meeting) ClientId() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.clientId
+}
+
+// Stack returns the latest copy of the stack.
+func (m *Meeting) Stack() Stack {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stack
+}
+
+// Subscribe calls the function with the current stack before returning and then every
+// time the stack changes, until the returned function is called. Changes are passed on
+// from the goroutine reading the connection, so the function must not block.
+func (m *Meeting) Subscribe(f func(Stack)) (unsubscribe func()) {
+	m.mu.Lock()
+	id := m.nextId
+	m.nextId++
+	m.subscribers[id] = f
+	stack := m.stack
+	m.mu.Unlock()
+
+	f(stack)
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.subscribers, id)
+	}
+}
+
+// GetOnStack puts the participant on the stack. They are put back on it after
+// reconnecting until GetOffStack is called.
+func (m *Meeting) GetOnStack() error {
+	return m.send(protocol.ClientMessage{Action: protocol.ActionOn, Name: m.options.Name}, true, true)
+}
+
+// GetOffStack takes the participant off the stack.
+func (m *Meeting) GetOffStack() error {
+	return m.send(protocol.ClientMessage{Action: protocol.ActionOff}, true, false)
+}
+
+// Next takes the current speaker off the stack. It needs the moderator token.
+func (m *Meeting) Next() error {
+	return m.send(protocol.ClientMessage{Action: protocol.ActionNext}, false, false)
+}
+
+// Remove takes the participant with the given ID off the stack. It needs the moderator
+// token.
+func (m *Meeting) Remove(speakerId string) error {
+	return m.send(protocol.ClientMessage{Action: protocol.ActionRemove, SpeakerId: speakerId}, false, false)
+}
+
+// Done is closed when the meeting has been closed or can't be reconnected to.
+func (m *Meeting) Done() <-chan struct{} {
+	return m.done
+}
+
+// Err returns why the connection ended once Done is closed: nil after Close, or the
+// error that stopped it reconnecting.
+func (m *Meeting) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Close leaves the meeting, which takes the participant off the stack.
+func (m *Meeting) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.closing)
+	conn := m.conn
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	m.mu.Unlock()
+
+	err := conn.Close()
+	<-m.done
+	return err
+}
+
+// send writes an action to the server, optionally recording whether the participant
+// wants to be on the stack.
+func (m *Meeting) send(message protocol.ClientMessage, setWant bool, want bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	if setWant {
+		m.wantOn = want
+	}
+	return m.conn.WriteJSON(message)
+}
+
+// dial opens a websocket to the meeting, resuming a place on the stack if given a
+// token.
+func (m *Meeting) dial(ctx context.Context, resumeToken string) (*websocket.Conn, error) {
+	target := m.wsURL
+	if resumeToken != "" {
+		target += "&resume=" + url.QueryEscape(resumeToken)
+	}
+	dialer := *m.options.Dialer
+	dialer.Subprotocols = []string{protocol.ProtocolV2}
+	conn, response, err := dialer.DialContext(ctx, target, nil)
+	if err != nil && response != nil {
+		if response.StatusCode == http.StatusNotFound {
+			return nil, ErrMeetingNotFound
+		}
+		var failure protocol.Error
+		if json.NewDecoder(response.Body).Decode(&failure) == nil && failure.Error != "" {
+			return nil, ServerError(failure.Error)
+		}
+	}
+	return conn, err
+}
+
+// start reads messages from a new connection until the stack snapshot arrives and
+// makes it the meeting's connection.
+func (m *Meeting) start(ctx context.Context, conn *websocket.Conn) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	m.mu.Lock()
+	m.conn = conn
+	m.rev, m.resyncing = 0, false
+	m.mu.Unlock()
+	for {
+		messages, err := read(conn)
+		if err != nil {
+			return err
+		}
+		snapshot := false
+		for _, message := range messages {
+			m.handle(message)
+			snapshot = snapshot || message.Type == protocol.MessageSnapshot
+		}
+		if snapshot {
+			return nil
+		}
+	}
+}
+
+// run applies messages from the server, reconnecting when the connection drops, until
+// the meeting is closed or reconnecting fails for good.
+func (m *Meeting) run() {
+	defer close(m.done)
+	for {
+		m.mu.Lock()
+		conn := m.conn
+		m.mu.Unlock()
+
+		messages, err := read(conn)
+		if err == nil {
+			for _, message := range messages {
+				m.handle(message)
+			}
+			continue
+		}
+
+		m.mu.Lock()
+		closed := m.closed
+		m.mu.Unlock()
+		if closed {
+			return
+		}
+		m.report(fmt.Errorf("%w, reconnecting: %v", ErrConnectionLost, err))
+		if err = m.reconnect(); err != nil {
+			m.mu.Lock()
+			m.err = err
+			if !m.closed {
+				m.closed = true
+				close(m.closing)
+			}
+			m.mu.Unlock()
+			return
+		}
+	}
+}
+
+// reconnect dials the meeting again with exponential backoff, resuming the
+// participant's place if the server allows it or otherwise putting them back on the
+// stack if they were on it. It gives up if the meeting is gone or Close is called.
+func (m *Meeting) reconnect() error {
+	backoff := m.options.MinBackoff
+	for {
+		// Wait with up to 20% jitter so that clients dropped together don't all
+		// reconnect at once
+		wait := backoff - time.Duration(rand.Int63n(int64(backoff)/5+1))
+		select {
+		case <-time.After(wait):
+		case <-m.closing:
+			return nil
+		}
+		m.mu.Lock()
+		resumeToken := m.resumeToken
+		m.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		conn, err := m.dial(ctx, resumeToken)
+		if err == nil {
+			err = m.start(ctx, conn)
+			if err != nil {
+				conn.Close()
+			}
+		}
+		cancel()
+		if err == ErrMeetingNotFound {
+			return err
+		}
+		if err != nil {
+			m.report(fmt.Errorf("reconnecting failed: %w", err))
+			backoff *= 2
+			if backoff > m.options.MaxBackoff {
+				backoff = m.options.MaxBackoff
+			}
+			continue
+		}
+
+		m.mu.Lock()
+		if m.closed {
+			// Closed while we were connecting
+			m.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		rejoin := m.wantOn && m.stack.Position(m.clientId) == 0
+		m.mu.Unlock()
+		if rejoin {
+			return m.send(protocol.ClientMessage{Action: protocol.ActionOn, Name: m.options.Name}, false, false)
+		}
+		return nil
+	}
+}
+
+// incoming is any message the server sends a stack.v2 client.
+type incoming struct {
+	Type        string             `json:"type"`
+	Rev         uint64             `json:"rev"`
+	Stack       []protocol.User    `json:"stack"`
+	Ops         []protocol.PatchOp `json:"ops"`
+	ClientId    string             `json:"clientId"`
+	ResumeToken string             `json:"resumeToken"`
+	Error       string             `json:"error"`
+	Warning     string             `json:"warning"`
+}
+
+// read reads a frame from the connection, which holds one or more messages separated
+// by newlines.
+func read(conn *websocket.Conn) ([]incoming, error) {
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	var messages []incoming
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var message incoming
+		if err := json.Unmarshal(line, &message); err != nil {
+			return nil, fmt.Errorf("decoding message from server: %w", err)
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// handle applies a message from the server and tells subscribers about stack changes.
+func (m *Meeting) handle(message incoming) {
+	switch {
+	case message.Error != "":
+		m.report(ServerError(message.Error))
+		return
+	case message.Warning != "":
+		m.report(ServerWarning(message.Warning))
+		return
+	}
+
+	m.mu.Lock()
+	switch message.Type {
+	case protocol.MessageWelcome:
+		m.clientId, m.resumeToken = message.ClientId, message.ResumeToken
+		m.mu.Unlock()
+		return
+	case protocol.MessageSnapshot:
+		m.stack, m.rev, m.resyncing = message.Stack, message.Rev, false
+	case protocol.MessagePatch:
+		if m.resyncing || message.Rev != m.rev+1 {
+			// We missed a change, start again from a fresh snapshot. Patches are
+			// dropped until it arrives so that we only ask for it once.
+			if !m.resyncing {
+				m.resyncing = true
+				m.conn.WriteJSON(protocol.ClientMessage{Action: protocol.ActionResync})
+			}
+			m.mu.Unlock()
+			return
+		}
+		m.stack, m.rev = protocol.ApplyPatch(m.stack, message.Ops), message.Rev
+	default:
+		m.mu.Unlock()
+		return
+	}
+	stack := m.stack
+	subscribers := make([]func(Stack), 0, len(m.subscribers))
+	for _, f := range m.subscribers {
+		subscribers = append(subscribers, f)
+	}
+	m.mu.Unlock()
+
+	for _, f := range subscribers {
+		f(stack)
+	}
+}
+
+// report passes an error to the OnError option, if set.
+func (m *Meeting) report(err error) {
+	if m.options.OnError != nil {
+		m.options.OnError(err)
+	}
+}
@@ -0,0 +1,491 @@
+package client_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"stack-web-app/client"
+	"stack-web-app/db"
+	"stack-web-app/events"
+	"stack-web-app/protocol"
+	"stack-web-app/server"
+	"stack-web-app/wshandler"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// waitTimeout is how long a test waits for a client to reach an expected state.
+const waitTimeout = 10 * time.Second
+
+// serverURL is the base URL of the server every test talks to.
+var serverURL string
+
+// TestMain serves the full router from an in-process server backed by an in-memory
+// database.
+func TestMain(m *testing.M) {
+	log.SetLevel(log.WarnLevel)
+	if err := db.StartInMemory(); err != nil {
+		fmt.Fprintln(os.Stderr, "starting in-memory database:", err)
+		os.Exit(1)
+	}
+
+	// Simulated clients all come from one address and act much faster than people
+	wshandler.DefaultLimits = wshandler.Limits{
+		ActionsPerSecond:  100000,
+		ActionBurst:       100000,
+		MeetingsPerMinute: 60000,
+		MeetingBurst:      1000,
+	}
+
+	// Broadcast every change straight away so that clients can be made to fall behind
+	wshandler.CoalesceWindow = 0
+
+	testServer := httptest.NewUnstartedServer(server.NewRouter(server.Options{}))
+	testServer.Listener = smallSendBuffers{testServer.Listener}
+	testServer.Start()
+	serverURL = testServer.URL
+	code := m.Run()
+	testServer.Close()
+	os.Exit(code)
+}
+
+// smallSendBuffers gives the server's connections small send buffers, so that the
+// server notices quickly when a client stops reading.
+type smallSendBuffers struct {
+	net.Listener
+}
+
+// Accept accepts a connection and shrinks its send buffer.
+func (l smallSendBuffers) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.SetWriteBuffer(4096)
+	}
+	return conn, err
+}
+
+// tap sits between a client and its connection to the server. It can stop reading
+// from the server, drop the next patch and count the snapshots the client was sent.
+// Frames are read whole once the handshake is done, which relies on the server not
+// compressing or fragmenting its small messages.
+type tap struct {
+	net.Conn
+	reader    *bufio.Reader
+	handshake bool
+
+	mu        sync.Mutex
+	resumed   chan struct{}
+	dropPatch bool
+	snapshots int
+
+	// Bytes of frames let through that the client hasn't read yet
+	pending []byte
+}
+
+// pause stops passing on what the server sends until resume is called, so that the
+// client falls behind.
+func (c *tap) pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resumed = make(chan struct{})
+}
+
+// resume lets the client read what the server sent while paused, if it was.
+func (c *tap) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resumed != nil {
+		close(c.resumed)
+		c.resumed = nil
+	}
+}
+
+// skipPatch drops the next patch the server sends, so the client misses a revision.
+func (c *tap) skipPatch() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropPatch = true
+}
+
+// snapshotCount returns the number of snapshots the client was sent.
+func (c *tap) snapshotCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.snapshots
+}
+
+// Read passes on whole frames from the server, unless they are being held back or
+// dropped.
+func (c *tap) Read(p []byte) (int, error) {
+	// Pass the handshake response through as it is
+	for !c.handshake && len(c.pending) == 0 {
+		line, err := c.reader.ReadBytes('\n')
+		if err != nil {
+			return 0, err
+		}
+		c.handshake = string(line) == "\r\n"
+		c.pending = line
+	}
+
+	for len(c.pending) == 0 {
+		frame, payload, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		c.mu.Lock()
+		switch {
+		case c.dropPatch && bytes.Contains(payload, []byte(`"type":"patch"`)):
+			c.dropPatch = false
+			frame = nil
+		default:
+			c.snapshots += bytes.Count(payload, []byte(`"type":"snapshot"`))
+		}
+		c.mu.Unlock()
+		c.pending = frame
+	}
+
+	// Hold back what was read, including a frame already being waited for when the
+	// tap was paused
+	c.mu.Lock()
+	resumed := c.resumed
+	c.mu.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readFrame reads an unmasked websocket frame, returning it whole and its payload.
+func (c *tap) readFrame() (frame []byte, payload []byte, err error) {
+	header := make([]byte, 2, 10)
+	if _, err = io.ReadFull(c.reader, header); err != nil {
+		return nil, nil, err
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		header = header[:4]
+		if _, err = io.ReadFull(c.reader, header[2:]); err != nil {
+			return nil, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(header[2:]))
+	case 127:
+		header = header[:10]
+		if _, err = io.ReadFull(c.reader, header[2:]); err != nil {
+			return nil, nil, err
+		}
+		length = binary.BigEndian.Uint64(header[2:])
+	}
+	frame = make([]byte, len(header)+int(length))
+	copy(frame, header)
+	if _, err = io.ReadFull(c.reader, frame[len(header):]); err != nil {
+		return nil, nil, err
+	}
+	return frame, frame[len(header):], nil
+}
+
+// tapDialer dials connections through taps, keeping hold of the latest.
+type tapDialer struct {
+	mu     sync.Mutex
+	latest *tap
+}
+
+// dialer returns a websocket dialer connecting through the tap dialer. The client's
+// receive buffer is kept small so that it falls behind quickly when paused.
+func (d *tapDialer) dialer() *websocket.Dialer {
+	return &websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				_ = tcp.SetReadBuffer(4096)
+			}
+			t := &tap{Conn: conn, reader: bufio.NewReader(conn)}
+			d.mu.Lock()
+			d.latest = t
+			d.mu.Unlock()
+			return t, nil
+		},
+		HandshakeTimeout: waitTimeout,
+	}
+}
+
+// conn returns the latest connection dialed.
+func (d *tapDialer) conn() *tap {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.latest
+}
+
+// join connects a participant with short reconnection backoffs, closing it when the
+// test ends. Errors are logged, and connection losses sent to lost if it isn't nil.
+func join(t *testing.T, meetingRef string, name string, dialer *tapDialer, lost chan<- error) *client.Meeting {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	options := client.Options{
+		Name:       name,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 100 * time.Millisecond,
+		OnError: func(err error) {
+			t.Logf("%s: %v", name, err)
+			if lost != nil && errors.Is(err, client.ErrConnectionLost) {
+				select {
+				case lost <- err:
+				default:
+				}
+			}
+		},
+	}
+	if dialer != nil {
+		options.Dialer = dialer.dialer()
+	}
+	participant, err := client.Join(ctx, serverURL, meetingRef, options)
+	if err != nil {
+		t.Fatalf("joining %s: %v", name, err)
+	}
+	t.Cleanup(func() { participant.Close() })
+	return participant
+}
+
+// createMeeting creates a meeting, failing the test if that doesn't work.
+func createMeeting(t *testing.T) protocol.Meeting {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	meeting, err := client.Create(ctx, serverURL, protocol.MeetingRequest{}, nil)
+	if err != nil {
+		t.Fatalf("creating meeting: %v", err)
+	}
+	return meeting
+}
+
+// waitForStack waits until the participant's copy of the stack satisfies the
+// condition, failing the test with the last stack seen if it never does.
+func waitForStack(t *testing.T, participant *client.Meeting, description string, condition func(client.Stack) bool) client.Stack {
+	t.Helper()
+	changed := make(chan struct{}, 1)
+	unsubscribe := participant.Subscribe(func(client.Stack) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	timeout := time.NewTimer(waitTimeout)
+	defer timeout.Stop()
+	for {
+		stack := participant.Stack()
+		if condition(stack) {
+			return stack
+		}
+		select {
+		case <-changed:
+		case <-participant.Done():
+			t.Fatalf("participant disconnected waiting for %s: %v", description, participant.Err())
+		case <-timeout.C:
+			t.Fatalf("timed out waiting for %s, last saw %v", description, names(stack))
+		}
+	}
+}
+
+// names returns the names of the participants on the stack, in order.
+func names(stack client.Stack) []string {
+	names := make([]string, len(stack))
+	for i, user := range stack {
+		names[i] = user.Name
+	}
+	return names
+}
+
+// isStack reports whether the stack holds exactly the named participants in order.
+func isStack(want ...string) func(client.Stack) bool {
+	return func(stack client.Stack) bool {
+		return fmt.Sprint(names(stack)) == fmt.Sprint(want)
+	}
+}
+
+func TestReconnectsAndGetsBackOnTheStack(t *testing.T) {
+	meeting := createMeeting(t)
+	dialer := &tapDialer{}
+	lost := make(chan error, 1)
+	ann := join(t, meeting.MeetingId, "Ann", dialer, lost)
+	bob := join(t, meeting.MeetingId, "Bob", nil, nil)
+
+	if err := ann.GetOnStack(); err != nil {
+		t.Fatal(err)
+	}
+	waitForStack(t, bob, "Ann to get on the stack", isStack("Ann"))
+	before := ann.ClientId()
+
+	// Drop the connection from under the client
+	if err := dialer.conn().Conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-lost:
+	case <-time.After(waitTimeout):
+		t.Fatal("client didn't notice the connection was lost")
+	}
+
+	// The server took Ann off the stack when the connection dropped, so the client
+	// puts Ann back on under a new ID
+	waitForStack(t, bob, "Ann to get back on the stack", func(stack client.Stack) bool {
+		return isStack("Ann")(stack) && stack[0].SpeakerId != before
+	})
+	stack := waitForStack(t, ann, "Ann's copy of the stack to catch up", isStack("Ann"))
+	if stack[0].SpeakerId != ann.ClientId() {
+		t.Errorf("Ann is on the stack as %s but the client ID is %s", stack[0].SpeakerId, ann.ClientId())
+	}
+	select {
+	case <-ann.Done():
+		t.Fatalf("client gave up after reconnecting: %v", ann.Err())
+	default:
+	}
+}
+
+func TestResumesPlaceAfterFallingBehind(t *testing.T) {
+	meeting := createMeeting(t)
+	dialer := &tapDialer{}
+	lost := make(chan error, 1)
+	ann := join(t, meeting.MeetingId, "Ann", dialer, lost)
+	bob := join(t, meeting.MeetingId, "Bob", nil, nil)
+	cat := join(t, meeting.MeetingId, "Cat", nil, nil)
+
+	if err := ann.GetOnStack(); err != nil {
+		t.Fatal(err)
+	}
+	waitForStack(t, bob, "Ann to get on the stack", isStack("Ann"))
+	if err := bob.GetOnStack(); err != nil {
+		t.Fatal(err)
+	}
+	waitForStack(t, bob, "Bob to get on the stack", isStack("Ann", "Bob"))
+	annId := ann.ClientId()
+
+	var left int32
+	unsubscribe := events.Subscribe(func(event events.Event) {
+		if event.Type == events.ParticipantLeft && event.MeetingId == meeting.MeetingId && event.Data["speakerId"] == annId {
+			atomic.StoreInt32(&left, 1)
+		}
+	})
+	defer unsubscribe()
+
+	// Stop reading while Cat keeps changing the stack, until the server disconnects Ann
+	// for being too slow. Bob seeing each change before the next makes sure every one
+	// of them is broadcast rather than merged with the next.
+	paused := dialer.conn()
+	paused.pause()
+	defer paused.resume()
+	deadline := time.Now().Add(waitTimeout)
+	for on := true; atomic.LoadInt32(&left) == 0; on = !on {
+		if time.Now().After(deadline) {
+			t.Fatal("server didn't disconnect the client that stopped reading")
+		}
+		var err error
+		want := isStack("Ann", "Bob")
+		if on {
+			err = cat.GetOnStack()
+			want = isStack("Ann", "Bob", "Cat")
+		} else {
+			err = cat.GetOffStack()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForStack(t, bob, "Cat's change", want)
+	}
+	paused.resume()
+	if err := cat.GetOffStack(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-lost:
+	case <-time.After(waitTimeout):
+		t.Fatal("client didn't notice it was disconnected")
+	}
+	stack := waitForStack(t, ann, "Ann to catch up after resuming", isStack("Ann", "Bob"))
+	if ann.ClientId() != annId || stack[0].SpeakerId != annId {
+		t.Errorf("Ann resumed as %s and is on the stack as %s, want the old ID %s", ann.ClientId(), stack[0].SpeakerId, annId)
+	}
+	stack = waitForStack(t, bob, "Cat to get off the stack", isStack("Ann", "Bob"))
+	if stack[0].SpeakerId != annId {
+		t.Errorf("Ann lost the first place: the first speaker is %s, want %s", stack[0].SpeakerId, annId)
+	}
+}
+
+func TestResyncsAfterSkippedRevision(t *testing.T) {
+	meeting := createMeeting(t)
+	dialer := &tapDialer{}
+	ann := join(t, meeting.MeetingId, "Ann", dialer, nil)
+	bob := join(t, meeting.MeetingId, "Bob", nil, nil)
+	cat := join(t, meeting.MeetingId, "Cat", nil, nil)
+	snapshots := dialer.conn().snapshotCount()
+
+	// Ann never sees Bob get on the stack, so Cat getting on skips a revision
+	dialer.conn().skipPatch()
+	if err := bob.GetOnStack(); err != nil {
+		t.Fatal(err)
+	}
+	waitForStack(t, cat, "Bob to get on the stack", isStack("Bob"))
+	if err := cat.GetOnStack(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForStack(t, ann, "Ann to resync", isStack("Bob", "Cat"))
+	if got := dialer.conn().snapshotCount(); got != snapshots+1 {
+		t.Errorf("Ann was sent %d snapshots after missing a revision, want 1", got-snapshots)
+	}
+}
+
+func TestResyncsOnceForSeveralPatchesAfterAGap(t *testing.T) {
+	meeting := createMeeting(t)
+	dialer := &tapDialer{}
+	ann := join(t, meeting.MeetingId, "Ann", dialer, nil)
+	bob := join(t, meeting.MeetingId, "Bob", nil, nil)
+	cat := join(t, meeting.MeetingId, "Cat", nil, nil)
+	dan := join(t, meeting.MeetingId, "Dan", nil, nil)
+	snapshots := dialer.conn().snapshotCount()
+
+	// Ann misses Bob getting on the stack and only reads the patches after it once the
+	// others are on too, so each of them arrives before a snapshot could
+	paused := dialer.conn()
+	paused.skipPatch()
+	paused.pause()
+	defer paused.resume()
+	for i, participant := range []*client.Meeting{bob, cat, dan} {
+		if err := participant.GetOnStack(); err != nil {
+			t.Fatal(err)
+		}
+		waitForStack(t, bob, "the stack to grow", func(stack client.Stack) bool { return len(stack) == i+1 })
+	}
+	paused.resume()
+	waitForStack(t, ann, "Ann to resync", isStack("Bob", "Cat", "Dan"))
+
+	// Any further snapshots were asked for before this change and arrive ahead of it
+	if err := bob.GetOffStack(); err != nil {
+		t.Fatal(err)
+	}
+	waitForStack(t, ann, "Bob to get off the stack", isStack("Cat", "Dan"))
+	if got := paused.snapshotCount(); got != snapshots+1 {
+		t.Errorf("Ann was sent %d snapshots after missing a revision, want 1", got-snapshots)
+	}
+}
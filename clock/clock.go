@@ -0,0 +1,71 @@
+// Package clock lets code that reads the time or waits on timers be driven by a fake
+// clock, so that pruning, heartbeats and other time based behaviour can be tested
+// without sleeping.
+package clock
+
+import "time"
+
+// Clock tells the time and makes timers and tickers.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+
+	// AfterFunc calls f in its own goroutine once d has passed. The returned timer's
+	// channel is nil.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer fires once, like time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker fires every period until stopped, like time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+	Reset(d time.Duration)
+}
+
+// Real is the clock of the time package.
+var Real Clock = realClock{}
+
+// realClock passes everything through to the time package.
+type realClock struct{}
+
+// Now returns the current time.
+func (realClock) Now() time.Time { return time.Now() }
+
+// Since returns the time passed since t.
+func (realClock) Since(t time.Time) time.Duration { return time.Since(t) }
+
+// NewTimer returns a time.Timer.
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+// NewTicker returns a time.Ticker.
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+// AfterFunc calls time.AfterFunc.
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+// realTimer wraps a time.Timer.
+type realTimer struct {
+	*time.Timer
+}
+
+// C returns the timer's channel.
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+// realTicker wraps a time.Ticker.
+type realTicker struct {
+	*time.Ticker
+}
+
+// C returns the ticker's channel.
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
@@ -0,0 +1,186 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake is a clock that only moves when told to. Timers and tickers fire, in order of
+// when they are due, as Advance moves the time past them.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeTimer
+
+	// changed is closed and replaced whenever a timer is added, for BlockUntil
+	changed chan struct{}
+}
+
+// NewFake returns a fake clock set to the given time.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now, changed: make(chan struct{})}
+}
+
+// Now returns the fake time.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Since returns the fake time passed since t.
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+// NewTimer returns a timer that fires once Advance has moved d past now.
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: f, c: make(chan time.Time, 1)}
+	f.add(t, d)
+	return t
+}
+
+// NewTicker returns a ticker that fires every d of fake time.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	t := &fakeTimer{clock: f, c: make(chan time.Time, 1), period: d}
+	f.add(t, d)
+	return fakeTicker{t}
+}
+
+// AfterFunc calls f in its own goroutine once Advance has moved d past now.
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	t := &fakeTimer{clock: f, fn: fn}
+	f.add(t, d)
+	return t
+}
+
+// Advance moves the time forward by d, firing every timer and ticker due on the way in
+// order. Tickers fire once per period passed, dropping ticks nobody has read just like
+// time.Ticker.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	end := f.now.Add(d)
+	for len(f.waiters) > 0 && !f.waiters[0].when.After(end) {
+		t := f.waiters[0]
+		f.waiters = f.waiters[1:]
+		f.now = t.when
+		if t.period > 0 {
+			t.when = t.when.Add(t.period)
+			f.insert(t)
+		}
+		t.fire(f.now)
+	}
+	f.now = end
+	f.mu.Unlock()
+}
+
+// BlockUntil waits until at least n timers and tickers are waiting to fire, so that a
+// test can be sure the goroutine it is testing has set up its timers before calling
+// Advance.
+func (f *Fake) BlockUntil(n int) {
+	for {
+		f.mu.Lock()
+		waiting, changed := len(f.waiters), f.changed
+		f.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		<-changed
+	}
+}
+
+// add schedules the timer to fire d from now.
+func (f *Fake) add(t *fakeTimer, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t.when = f.now.Add(d)
+	f.insert(t)
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// insert puts the timer into the waiters in order of when it fires, after any timer
+// due at the same time. The caller must hold f.mu.
+func (f *Fake) insert(t *fakeTimer) {
+	i := sort.Search(len(f.waiters), func(i int) bool { return f.waiters[i].when.After(t.when) })
+	f.waiters = append(f.waiters, nil)
+	copy(f.waiters[i+1:], f.waiters[i:])
+	f.waiters[i] = t
+}
+
+// remove takes the timer out of the waiters, returning whether it was waiting. The
+// caller must hold f.mu.
+func (f *Fake) remove(t *fakeTimer) bool {
+	for i, waiter := range f.waiters {
+		if waiter == t {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fakeTimer is a timer, ticker or AfterFunc of a Fake clock.
+type fakeTimer struct {
+	clock  *Fake
+	when   time.Time
+	period time.Duration
+	c      chan time.Time
+	fn     func()
+}
+
+// fire sends the time on the channel without blocking, or calls the function.
+func (t *fakeTimer) fire(now time.Time) {
+	if t.fn != nil {
+		go t.fn()
+		return
+	}
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+// C returns the channel the time is sent on when the timer fires.
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop stops the timer, returning whether it was still waiting to fire.
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.remove(t)
+}
+
+// Reset reschedules the timer to fire d from now, returning whether it was still
+// waiting to fire. Tickers fire every d from then on.
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	waiting := t.clock.remove(t)
+	if t.period > 0 {
+		t.period = d
+	}
+	t.clock.mu.Unlock()
+	t.clock.add(t, d)
+	return waiting
+}
+
+// fakeTicker is a ticker of a Fake clock.
+type fakeTicker struct {
+	*fakeTimer
+}
+
+// Stop stops the ticker.
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
+
+// Reset stops the ticker and makes it fire every d from now.
+func (t fakeTicker) Reset(d time.Duration) {
+	t.fakeTimer.Reset(d)
+}
@@ -0,0 +1,123 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var start = time.Date(2021, 6, 1, 9, 0, 0, 0, time.UTC)
+
+// received returns the time waiting on the channel, if any.
+func received(c <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-c:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestFakeNow(t *testing.T) {
+	fake := NewFake(start)
+	fake.Advance(90 * time.Second)
+	if got := fake.Now(); !got.Equal(start.Add(90 * time.Second)) {
+		t.Errorf("Now() = %v, want %v", got, start.Add(90*time.Second))
+	}
+	if got := fake.Since(start); got != 90*time.Second {
+		t.Errorf("Since(start) = %v, want 90s", got)
+	}
+}
+
+func TestFakeTimersFireInOrder(t *testing.T) {
+	fake := NewFake(start)
+	late := fake.NewTimer(3 * time.Second)
+	early := fake.NewTimer(time.Second)
+
+	fake.Advance(2 * time.Second)
+	if got, ok := received(early.C()); !ok || !got.Equal(start.Add(time.Second)) {
+		t.Errorf("early timer fired at %v (%v), want %v", got, ok, start.Add(time.Second))
+	}
+	if _, ok := received(late.C()); ok {
+		t.Error("late timer fired early")
+	}
+
+	fake.Advance(time.Second)
+	if got, ok := received(late.C()); !ok || !got.Equal(start.Add(3*time.Second)) {
+		t.Errorf("late timer fired at %v (%v), want %v", got, ok, start.Add(3*time.Second))
+	}
+}
+
+func TestFakeTickerDropsUnreadTicks(t *testing.T) {
+	fake := NewFake(start)
+	ticker := fake.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// Like time.Ticker, only the first of the ticks nobody read is kept
+	fake.Advance(3 * time.Second)
+	if got, ok := received(ticker.C()); !ok || !got.Equal(start.Add(time.Second)) {
+		t.Errorf("first tick at %v (%v), want %v", got, ok, start.Add(time.Second))
+	}
+	if _, ok := received(ticker.C()); ok {
+		t.Error("unread ticks were queued")
+	}
+
+	fake.Advance(time.Second)
+	if got, ok := received(ticker.C()); !ok || !got.Equal(start.Add(4*time.Second)) {
+		t.Errorf("next tick at %v (%v), want %v", got, ok, start.Add(4*time.Second))
+	}
+
+	ticker.Reset(time.Minute)
+	fake.Advance(59 * time.Second)
+	if _, ok := received(ticker.C()); ok {
+		t.Error("reset ticker fired early")
+	}
+	fake.Advance(time.Second)
+	if _, ok := received(ticker.C()); !ok {
+		t.Error("reset ticker didn't fire")
+	}
+}
+
+func TestFakeTimerStopAndReset(t *testing.T) {
+	fake := NewFake(start)
+	timer := fake.NewTimer(time.Second)
+	if !timer.Stop() {
+		t.Error("Stop() = false for a waiting timer")
+	}
+	fake.Advance(2 * time.Second)
+	if _, ok := received(timer.C()); ok {
+		t.Error("stopped timer fired")
+	}
+
+	if timer.Reset(time.Second) {
+		t.Error("Reset() = true for a stopped timer")
+	}
+	fake.Advance(time.Second)
+	if got, ok := received(timer.C()); !ok || !got.Equal(start.Add(3*time.Second)) {
+		t.Errorf("reset timer fired at %v (%v), want %v", got, ok, start.Add(3*time.Second))
+	}
+	if timer.Stop() {
+		t.Error("Stop() = true for a timer that already fired")
+	}
+}
+
+func TestFakeAfterFunc(t *testing.T) {
+	fake := NewFake(start)
+	done := make(chan struct{})
+
+	// BlockUntil lets the test wait for another goroutine to set its timer
+	go fake.AfterFunc(time.Minute, func() { close(done) })
+	fake.BlockUntil(1)
+
+	fake.Advance(time.Minute - time.Nanosecond)
+	select {
+	case <-done:
+		t.Fatal("function called early")
+	default:
+	}
+	fake.Advance(time.Nanosecond)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("function wasn't called")
+	}
+}
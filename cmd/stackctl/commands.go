@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"stack-web-app/client"
+)
+
+// readCommands takes actions typed on standard input, one per line, until "quit".
+func readCommands(meeting *client.Meeting, r io.Reader, v view) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var err error
+		switch fields[0] {
+		case "on":
+			err = meeting.GetOnStack()
+		case "off":
+			err = meeting.GetOffStack()
+		case "next":
+			err = meeting.Next()
+		case "remove":
+			stack := meeting.Stack()
+			position := 0
+			if len(fields) == 2 {
+				position, _ = strconv.Atoi(fields[1])
+			}
+			if position < 1 || position > len(stack) {
+				v.notice("Usage: remove <position>")
+				continue
+			}
+			err = meeting.Remove(stack[position-1].SpeakerId)
+		case "quit", "exit":
+			meeting.Close()
+			return
+		default:
+			v.notice(fmt.Sprintf("Unknown command %q.", fields[0]))
+		}
+		if err != nil {
+			v.notice("Error: " + err.Error())
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Command stackctl is a command-line client for the stack server. It can create
+// meetings, join them to get on and off the stack, watch the stack live in the
+// terminal and moderate, which makes it handy for scripting and testing without the
+// browser.
+//
+// Usage:
+//
+//	stackctl [-server URL] create [-slug SLUG] [-webhook URL]...
+//	stackctl [-server URL] join -meeting REF [-name NAME] [-moderator TOKEN] [-on] [-plain]
+//	stackctl [-server URL] watch -meeting REF [-plain]
+//
+// While joined, type "on", "off", "next", "remove <position>" or "quit". The server
+// defaults to $STACK_SERVER or http://localhost:8080.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"stack-web-app/client"
+	"stack-web-app/protocol"
+)
+
+// stringList collects a flag given more than once.
+type stringList []string
+
+// String returns the values joined with commas.
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+// Set adds a value.
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func main() {
+	server := os.Getenv("STACK_SERVER")
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+	flag.StringVar(&server, "server", server, "base URL of the stack server")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: stackctl [-server URL] create|join|watch [flags]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch command, args := flag.Arg(0), flag.Args()[1:]; command {
+	case "create":
+		err = create(server, args)
+	case "join":
+		err = join(server, args, false)
+	case "watch":
+		err = join(server, args, true)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "stackctl:", err)
+		os.Exit(1)
+	}
+}
+
+// create creates a meeting and prints its details.
+func create(server string, args []string) error {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	var request protocol.MeetingRequest
+	var webhooks stringList
+	flags.StringVar(&request.Slug, "slug", "", "custom slug to join the meeting with")
+	flags.Var(&webhooks, "webhook", "URL to deliver the meeting's events to, may be repeated")
+	flags.Parse(args)
+	request.Webhooks = webhooks
+
+	meeting, err := client.Create(context.Background(), server, request, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Meeting ID:      %s\n", meeting.MeetingId)
+	fmt.Printf("Meeting code:    %s\n", meeting.MeetingCode)
+	if meeting.Slug != "" {
+		fmt.Printf("Slug:            %s\n", meeting.Slug)
+	}
+	fmt.Printf("Moderator token: %s\n", meeting.ModeratorToken)
+	if meeting.WebhookSecret != "" {
+		fmt.Printf("Webhook secret:  %s\n", meeting.WebhookSecret)
+	}
+	return nil
+}
+
+// join connects to a meeting and shows its stack until interrupted, taking commands
+// from standard input unless only watching.
+func join(server string, args []string, watchOnly bool) error {
+	flags := flag.NewFlagSet("join", flag.ExitOnError)
+	meetingRef := flags.String("meeting", "", "meeting ID, code or slug")
+	plain := flags.Bool("plain", false, "print every change to the stack as a line of JSON instead of redrawing the screen")
+	name := new(string)
+	moderator := new(string)
+	on := new(bool)
+	if !watchOnly {
+		name = flags.String("name", os.Getenv("USER"), "name shown on the stack")
+		moderator = flags.String("moderator", "", "moderator token, to moderate the meeting")
+		on = flags.Bool("on", false, "get on the stack straight away")
+	}
+	flags.Parse(args)
+	if *meetingRef == "" {
+		return errors.New("-meeting is required")
+	}
+
+	var view view = &screen{name: *name, moderator: *moderator != "", watchOnly: watchOnly}
+	if *plain {
+		view = &lines{}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	meeting, err := client.Join(ctx, server, *meetingRef, client.Options{
+		Name:           *name,
+		ModeratorToken: *moderator,
+		OnError: func(err error) {
+			view.notice(err.Error())
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer meeting.Close()
+	meeting.Subscribe(func(stack client.Stack) {
+		view.show(stack, meeting.ClientId())
+	})
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		meeting.Close()
+	}()
+
+	if *on {
+		if err = meeting.GetOnStack(); err != nil {
+			return err
+		}
+	}
+	if !watchOnly {
+		go readCommands(meeting, os.Stdin, view)
+	}
+	<-meeting.Done()
+	return meeting.Err()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"stack-web-app/client"
+)
+
+// view shows the stack and anything the user should know about.
+type view interface {
+	show(stack client.Stack, clientId string)
+	notice(text string)
+}
+
+// screen redraws the terminal with the stack after every change.
+type screen struct {
+	name      string
+	moderator bool
+	watchOnly bool
+
+	// Guards the fields below and drawing
+	mu       sync.Mutex
+	stack    client.Stack
+	clientId string
+	message  string
+}
+
+// show redraws the screen with the new stack.
+func (s *screen) show(stack client.Stack, clientId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stack, s.clientId = stack, clientId
+	s.draw()
+}
+
+// notice redraws the screen with the message below the stack.
+func (s *screen) notice(text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.message = text
+	s.draw()
+}
+
+// draw clears the terminal and draws the stack, the last notice and the prompt.
+func (s *screen) draw() {
+	var out strings.Builder
+	out.WriteString("\033[H\033[2J")
+	if s.watchOnly {
+		out.WriteString("Watching the stack, press Ctrl-C to stop.\n\n")
+	} else {
+		role := ""
+		if s.moderator {
+			role = ", moderating"
+		}
+		fmt.Fprintf(&out, "Joined as %s%s.\n\n", s.name, role)
+	}
+
+	if len(s.stack) == 0 {
+		out.WriteString("  The stack is empty.\n")
+	}
+	for i, user := range s.stack {
+		name := user.Name
+		if name == "" {
+			name = "Anonymous"
+		}
+		if user.SpeakerId == s.clientId {
+			name += " (you)"
+		}
+		if i == 0 {
+			fmt.Fprintf(&out, "  Speaking: \033[1m%s\033[0m\n", name)
+		} else {
+			fmt.Fprintf(&out, "  %2d. %s\n", i+1, name)
+		}
+	}
+
+	if s.message != "" {
+		fmt.Fprintf(&out, "\n%s\n", s.message)
+	}
+	if !s.watchOnly {
+		out.WriteString("\nCommands: on, off")
+		if s.moderator {
+			out.WriteString(", next, remove <position>")
+		}
+		out.WriteString(", quit\n> ")
+	}
+	fmt.Print(out.String())
+}
+
+// lines prints every stack as a line of JSON, for scripts.
+type lines struct {
+	mu sync.Mutex
+}
+
+// show prints the stack.
+func (l *lines) show(stack client.Stack, _ string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if stack == nil {
+		stack = client.Stack{}
+	}
+	encoded, _ := json.Marshal(stack)
+	fmt.Println(string(encoded))
+}
+
+// notice prints the message to standard error.
+func (l *lines) notice(text string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintln(os.Stderr, text)
+}
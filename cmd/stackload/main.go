@@ -0,0 +1,385 @@
+// Command stackload puts a stack server under load to help size instances. It creates
+// meetings, joins simulated participants to them who get on and off the stack at
+// random, and reports how long actions take to be broadcast, how many connections
+// dropped and how the server's resource usage grew.
+//
+// Usage:
+//
+//	stackload [-server URL] [-scenario NAME] [-meetings N] [-clients N] [-rate R]
+//	          [-next-rate R] [-duration D] [-ramp D] [-json]
+//
+// A scenario sets the meetings, clients and rates, and any of those flags given as
+// well overrides it:
+//
+//	smoke     10 meetings of 5 participants, for checking a server works
+//	standup   200 meetings of 10 participants, each acting every 10s on average
+//	allhands  one meeting of 2000 participants, each acting every 5m on average
+//
+// Participants are spread evenly over the meetings. The first participant of each
+// meeting is its moderator, who moves the stack on with "next" at the next rate and
+// measures how long other participants' actions take to be broadcast to them.
+//
+// The server's rate limits apply to the load too, so raise MEETING_CREATE_RATE_LIMIT
+// and MEETING_CREATE_BURST when creating many meetings, and the open file limit
+// (ulimit -n) on both ends for many clients. The server defaults to $STACK_SERVER or
+// http://localhost:8080.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"stack-web-app/client"
+	"stack-web-app/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// scenario is the shape of the load to put on the server.
+type scenario struct {
+	// Meetings to create and participants to spread over them
+	Meetings int `json:"meetings"`
+	Clients  int `json:"clients"`
+
+	// Rate is how many stack actions each participant takes per second on average,
+	// and NextRate how many times per second each meeting's moderator calls next
+	Rate     float64 `json:"rate"`
+	NextRate float64 `json:"nextRate"`
+}
+
+// scenarios are the named loads selected with -scenario.
+var scenarios = map[string]scenario{
+	"smoke":    {Meetings: 10, Clients: 50, Rate: 0.5, NextRate: 0.2},
+	"standup":  {Meetings: 200, Clients: 2000, Rate: 0.1, NextRate: 0.05},
+	"allhands": {Meetings: 1, Clients: 2000, Rate: 1.0 / 300, NextRate: 1.0 / 30},
+}
+
+// actionTimeout is how long an action may go without being broadcast before it is
+// counted as lost.
+const actionTimeout = 10 * time.Second
+
+func main() {
+	server := os.Getenv("STACK_SERVER")
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+	var load scenario
+	flag.StringVar(&server, "server", server, "base URL of the stack server")
+	scenarioName := flag.String("scenario", "standup", "named load to run: smoke, standup or allhands")
+	flag.IntVar(&load.Meetings, "meetings", 0, "number of meetings to create, overriding the scenario")
+	flag.IntVar(&load.Clients, "clients", 0, "number of participants to join, overriding the scenario")
+	flag.Float64Var(&load.Rate, "rate", 0, "stack actions per second per participant, overriding the scenario")
+	flag.Float64Var(&load.NextRate, "next-rate", 0, "next actions per second per meeting, overriding the scenario")
+	duration := flag.Duration("duration", time.Minute, "how long to keep acting once everyone has joined")
+	ramp := flag.Duration("ramp", 10*time.Second, "how long to spread joining the participants over")
+	interval := flag.Duration("interval", 10*time.Second, "how often to print progress, zero for never")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	flag.Parse()
+
+	preset, ok := scenarios[*scenarioName]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "stackload: unknown scenario %q\n", *scenarioName)
+		os.Exit(2)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "meetings":
+			preset.Meetings = load.Meetings
+		case "clients":
+			preset.Clients = load.Clients
+		case "rate":
+			preset.Rate = load.Rate
+		case "next-rate":
+			preset.NextRate = load.NextRate
+		}
+	})
+	load = preset
+	if load.Meetings < 1 || load.Clients < load.Meetings || load.Rate < 0 || load.NextRate < 0 {
+		fmt.Fprintln(os.Stderr, "stackload: need at least one meeting, at least one participant per meeting and rates of zero or more")
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		fmt.Fprintln(os.Stderr, "Interrupted, stopping early.")
+		cancel()
+	}()
+
+	r := newRunner(server, load)
+	report, err := r.run(ctx, *ramp, *duration, *interval)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "stackload:", err)
+		os.Exit(1)
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+		return
+	}
+	report.print()
+}
+
+// counters are the running totals of what happened to participants.
+type counters struct {
+	Joined     int64 `json:"joined"`
+	JoinFailed int64 `json:"joinFailed"`
+	Dropped    int64 `json:"dropped"`
+	GaveUp     int64 `json:"gaveUp"`
+	Actions    int64 `json:"actions"`
+	SendFailed int64 `json:"sendFailed"`
+	TimedOut   int64 `json:"timedOut"`
+	Rejected   int64 `json:"rejected"`
+}
+
+// runner runs a load against a server.
+type runner struct {
+	server     string
+	load       scenario
+	httpClient *http.Client
+	dialer     *websocket.Dialer
+
+	counters  counters
+	connected int64
+	ack       latencies
+	broadcast latencies
+}
+
+// newRunner returns a runner with HTTP and websocket clients able to keep many
+// connections to the server.
+func newRunner(server string, load scenario) *runner {
+	return &runner{
+		server: server,
+		load:   load,
+		httpClient: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{MaxIdleConnsPerHost: 100},
+		},
+		dialer: &websocket.Dialer{HandshakeTimeout: 10 * time.Second},
+	}
+}
+
+// run creates the meetings, joins participants to them over the ramp, lets them act
+// for the duration and then reports on it.
+func (r *runner) run(ctx context.Context, ramp time.Duration, duration time.Duration, interval time.Duration) (*report, error) {
+	before, beforeErr := scrape(ctx, r.httpClient, r.server)
+	if beforeErr != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read the server's resource usage: %v\n", beforeErr)
+	}
+	meetings, err := r.createMeetings(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "Created %d meetings, joining %d participants over %s.\n", len(meetings), r.load.Clients, ramp)
+
+	// Participants act until the load ends and then stay connected until the server's
+	// resource usage under load has been read
+	loadCtx, cancel := context.WithTimeout(ctx, ramp+duration)
+	defer cancel()
+	release := make(chan struct{})
+	var acting, leaving sync.WaitGroup
+	trackers := make([]*tracker, len(meetings))
+	for i := range trackers {
+		trackers[i] = newTracker()
+	}
+
+	start := time.Now()
+	if interval > 0 {
+		go r.progress(loadCtx, start, interval)
+	}
+	spacing := ramp / time.Duration(r.load.Clients)
+	for i := 0; i < r.load.Clients && loadCtx.Err() == nil; i++ {
+		p := &participant{
+			runner:    r,
+			info:      meetings[i%len(meetings)],
+			tracker:   trackers[i%len(meetings)],
+			name:      fmt.Sprintf("load-%d", i),
+			moderator: i < len(meetings),
+		}
+		acting.Add(1)
+		leaving.Add(1)
+		go func() {
+			defer leaving.Done()
+			p.run(loadCtx, &acting, release)
+		}()
+		select {
+		case <-time.After(spacing):
+		case <-loadCtx.Done():
+		}
+	}
+	acting.Wait()
+	elapsed := time.Since(start)
+
+	after, afterErr := scrape(context.Background(), r.httpClient, r.server)
+	close(release)
+	leaving.Wait()
+
+	result := &report{
+		Scenario:  r.load,
+		Elapsed:   elapsed.Round(time.Millisecond).String(),
+		Counters:  r.counters,
+		Ack:       r.ack.summary(),
+		Broadcast: r.broadcast.summary(),
+	}
+	if beforeErr == nil && afterErr == nil {
+		result.Server = after.usage(before, elapsed)
+	}
+	return result, nil
+}
+
+// createMeetings creates the scenario's meetings a few at a time.
+func (r *runner) createMeetings(ctx context.Context) ([]protocol.Meeting, error) {
+	meetings := make([]protocol.Meeting, r.load.Meetings)
+	errs := make(chan error, r.load.Meetings)
+	slots := make(chan struct{}, 8)
+	var wg sync.WaitGroup
+	for i := range meetings {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			meeting, err := client.Create(ctx, r.server, protocol.MeetingRequest{}, r.httpClient)
+			if err != nil {
+				errs <- err
+				return
+			}
+			meetings[i] = meeting
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		var serverError client.ServerError
+		if errors.As(err, &serverError) {
+			return nil, fmt.Errorf("creating meetings: %w (is MEETING_CREATE_RATE_LIMIT high enough?)", err)
+		}
+		return nil, fmt.Errorf("creating meetings: %w", err)
+	}
+	return meetings, nil
+}
+
+// progress prints how the load is going every interval until it ends.
+func (r *runner) progress(ctx context.Context, start time.Time, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fmt.Fprintf(os.Stderr, "[%s] %d connected, %d actions, %d dropped connections\n",
+				time.Since(start).Round(time.Second),
+				atomic.LoadInt64(&r.connected),
+				atomic.LoadInt64(&r.counters.Actions),
+				atomic.LoadInt64(&r.counters.Dropped),
+			)
+		}
+	}
+}
+
+// report is the outcome of a load run.
+type report struct {
+	Scenario  scenario `json:"scenario"`
+	Elapsed   string   `json:"elapsed"`
+	Counters  counters `json:"counters"`
+	Ack       summary  `json:"ackLatency"`
+	Broadcast summary  `json:"broadcastLatency"`
+	Server    *usage   `json:"server,omitempty"`
+}
+
+// print writes the report for people to read.
+func (r *report) print() {
+	c := r.Counters
+	fmt.Printf("Load:          %d participants in %d meetings, %.3g actions/s each, %.3g next/s per meeting, for %s\n",
+		r.Scenario.Clients, r.Scenario.Meetings, r.Scenario.Rate, r.Scenario.NextRate, r.Elapsed)
+	fmt.Printf("Participants:  %d joined, %d failed to join, %d dropped connections, %d gave up reconnecting\n",
+		c.Joined, c.JoinFailed, c.Dropped, c.GaveUp)
+	fmt.Printf("Actions:       %d sent, %d failed to send, %d rejected, %d not broadcast within %s\n",
+		c.Actions, c.SendFailed, c.Rejected, c.TimedOut, actionTimeout)
+	fmt.Printf("Ack latency:   %s\n", r.Ack)
+	fmt.Printf("Broadcast:     %s\n", r.Broadcast)
+	if r.Server == nil {
+		fmt.Println("Server:        resource usage unavailable")
+		return
+	}
+	s := r.Server
+	fmt.Printf("Server:        %d meetings, %d clients, %d goroutines under load\n", s.Hubs, s.Clients, s.Goroutines)
+	fmt.Printf("               %s resident memory (%+.1f MiB), %.2f CPU cores on average\n",
+		mebibytes(s.MemoryBytes), s.MemoryGrowthBytes/(1<<20), s.CPUCores)
+	fmt.Printf("               %.0f messages broadcast per second, %.0f slow clients dropped, %.0f actions rate limited\n",
+		s.BroadcastsPerSecond, s.DroppedSlowClients, s.RateLimited)
+}
+
+// mebibytes formats a byte count in MiB, or "unknown" if the server didn't report it.
+func mebibytes(bytes float64) string {
+	if bytes == 0 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%.1f MiB", bytes/(1<<20))
+}
+
+// latencies collects the latencies of actions.
+type latencies struct {
+	mu      sync.Mutex
+	samples []time.Duration
+}
+
+// add records a latency.
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.samples = append(l.samples, d)
+}
+
+// summary is the distribution of a set of latencies.
+type summary struct {
+	Count int           `json:"count"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// String formats the summary on one line.
+func (s summary) String() string {
+	if s.Count == 0 {
+		return "no samples"
+	}
+	return fmt.Sprintf("p50 %s, p90 %s, p99 %s, max %s (%d samples)",
+		s.P50.Round(time.Microsecond*100), s.P90.Round(time.Microsecond*100),
+		s.P99.Round(time.Microsecond*100), s.Max.Round(time.Microsecond*100), s.Count)
+}
+
+// summary sorts the latencies and picks out the percentiles.
+func (l *latencies) summary() summary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.samples) == 0 {
+		return summary{}
+	}
+	sort.Slice(l.samples, func(i, j int) bool { return l.samples[i] < l.samples[j] })
+	percentile := func(p float64) time.Duration {
+		return l.samples[int(p*float64(len(l.samples)-1))]
+	}
+	return summary{
+		Count: len(l.samples),
+		P50:   percentile(0.5),
+		P90:   percentile(0.9),
+		P99:   percentile(0.99),
+		Max:   l.samples[len(l.samples)-1],
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"stack-web-app/client"
+	"stack-web-app/protocol"
+)
+
+// participant is a simulated person in a meeting who gets on and off the stack at
+// random, or the meeting's moderator who moves the stack on.
+type participant struct {
+	runner    *runner
+	info      protocol.Meeting
+	tracker   *tracker
+	name      string
+	moderator bool
+
+	meeting *client.Meeting
+
+	// Guards the action waiting to be broadcast back
+	mu      sync.Mutex
+	pending bool
+	wantOn  bool
+	sentAt  time.Time
+}
+
+// run joins the meeting and acts until the context ends, then marks itself done
+// acting and stays connected until released.
+func (p *participant) run(ctx context.Context, acting *sync.WaitGroup, release <-chan struct{}) {
+	r := p.runner
+	options := client.Options{
+		Name:       p.name,
+		HTTPClient: r.httpClient,
+		Dialer:     r.dialer,
+		OnError:    p.report,
+	}
+	if p.moderator {
+		options.ModeratorToken = p.info.ModeratorToken
+	}
+	joinCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	meeting, err := client.Join(joinCtx, r.server, p.info.MeetingId, options)
+	cancel()
+	if err != nil {
+		// Show why the first few participants couldn't join, which is usually a limit
+		// on the server or this machine
+		if ctx.Err() == nil && atomic.AddInt64(&r.counters.JoinFailed, 1) <= 5 {
+			fmt.Fprintf(os.Stderr, "Participant %s failed to join: %v\n", p.name, err)
+		}
+		acting.Done()
+		return
+	}
+	p.meeting = meeting
+	atomic.AddInt64(&r.counters.Joined, 1)
+	atomic.AddInt64(&r.connected, 1)
+	defer atomic.AddInt64(&r.connected, -1)
+
+	if p.moderator {
+		meeting.Subscribe(func(stack client.Stack) {
+			p.tracker.observe(stack, &r.broadcast)
+		})
+		p.act(ctx, r.load.NextRate, p.next)
+	} else {
+		meeting.Subscribe(p.update)
+		p.act(ctx, r.load.Rate, p.toggle)
+	}
+	acting.Done()
+
+	select {
+	case <-release:
+	case <-meeting.Done():
+	}
+	meeting.Close()
+}
+
+// act calls the action at random intervals averaging the rate, until the context
+// ends or the meeting can't be reconnected to.
+func (p *participant) act(ctx context.Context, rate float64, action func()) {
+	if rate == 0 {
+		select {
+		case <-ctx.Done():
+		case <-p.meeting.Done():
+		}
+		return
+	}
+	for {
+		wait := time.Duration(rand.ExpFloat64() / rate * float64(time.Second))
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.meeting.Done():
+			if p.meeting.Err() != nil {
+				atomic.AddInt64(&p.runner.counters.GaveUp, 1)
+			}
+			return
+		case <-time.After(wait):
+			action()
+		}
+	}
+}
+
+// toggle gets on the stack if the participant is off it and off if they are on it,
+// unless the last action hasn't been broadcast back yet.
+func (p *participant) toggle() {
+	r := p.runner
+	clientId := p.meeting.ClientId()
+	p.mu.Lock()
+	if p.pending {
+		if time.Since(p.sentAt) < actionTimeout {
+			p.mu.Unlock()
+			return
+		}
+		atomic.AddInt64(&r.counters.TimedOut, 1)
+	}
+	on := p.meeting.Stack().Position(clientId) == 0
+	p.pending, p.wantOn, p.sentAt = true, on, time.Now()
+	p.mu.Unlock()
+
+	p.tracker.sent(clientId, on, p.sentAt)
+	var err error
+	if on {
+		err = p.meeting.GetOnStack()
+	} else {
+		err = p.meeting.GetOffStack()
+	}
+	atomic.AddInt64(&r.counters.Actions, 1)
+	if err != nil {
+		atomic.AddInt64(&r.counters.SendFailed, 1)
+		p.mu.Lock()
+		p.pending = false
+		p.mu.Unlock()
+	}
+}
+
+// next moves the stack on if anyone is speaking.
+func (p *participant) next() {
+	if len(p.meeting.Stack()) == 0 {
+		return
+	}
+	atomic.AddInt64(&p.runner.counters.Actions, 1)
+	if err := p.meeting.Next(); err != nil {
+		atomic.AddInt64(&p.runner.counters.SendFailed, 1)
+	}
+}
+
+// update records how long the participant's own action took to come back once the
+// stack shows it.
+func (p *participant) update(stack client.Stack) {
+	clientId := p.meeting.ClientId()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending && (stack.Position(clientId) > 0) == p.wantOn {
+		p.runner.ack.add(time.Since(p.sentAt))
+		p.pending = false
+	}
+}
+
+// report counts dropped connections and actions the server refused.
+func (p *participant) report(err error) {
+	var serverError client.ServerError
+	switch {
+	case errors.Is(err, client.ErrConnectionLost):
+		atomic.AddInt64(&p.runner.counters.Dropped, 1)
+	case errors.As(err, &serverError):
+		atomic.AddInt64(&p.runner.counters.Rejected, 1)
+	}
+}
+
+// pendingAction is an action the moderator is waiting to see broadcast.
+type pendingAction struct {
+	on     bool
+	sentAt time.Time
+}
+
+// tracker follows the actions taken in a meeting so its moderator can measure how
+// long they take to be broadcast to other participants.
+type tracker struct {
+	mu      sync.Mutex
+	pending map[string]pendingAction
+}
+
+// newTracker returns a tracker with no actions pending.
+func newTracker() *tracker {
+	return &tracker{pending: map[string]pendingAction{}}
+}
+
+// sent records that the participant asked to get on or off the stack.
+func (t *tracker) sent(speakerId string, on bool, sentAt time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[speakerId] = pendingAction{on: on, sentAt: sentAt}
+}
+
+// observe records the latency of every pending action the stack now shows, and forgets
+// actions that were never broadcast.
+func (t *tracker) observe(stack client.Stack, broadcast *latencies) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) == 0 {
+		return
+	}
+	onStack := make(map[string]bool, len(stack))
+	for _, user := range stack {
+		onStack[user.SpeakerId] = true
+	}
+	now := time.Now()
+	for speakerId, action := range t.pending {
+		if onStack[speakerId] == action.on {
+			broadcast.add(now.Sub(action.sentAt))
+			delete(t.pending, speakerId)
+		} else if now.Sub(action.sentAt) > actionTimeout {
+			delete(t.pending, speakerId)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// usage is the server's resource usage under load.
+type usage struct {
+	Hubs                int     `json:"hubs"`
+	Clients             int     `json:"clients"`
+	Goroutines          int     `json:"goroutines"`
+	MemoryBytes         float64 `json:"memoryBytes"`
+	MemoryGrowthBytes   float64 `json:"memoryGrowthBytes"`
+	CPUCores            float64 `json:"cpuCores"`
+	BroadcastsPerSecond float64 `json:"broadcastsPerSecond"`
+	DroppedSlowClients  float64 `json:"droppedSlowClients"`
+	RateLimited         float64 `json:"rateLimited"`
+}
+
+// sample is what the server reported about itself at one point in time.
+type sample struct {
+	status struct {
+		Hubs       int `json:"hubs"`
+		Clients    int `json:"clients"`
+		Goroutines int `json:"goroutines"`
+	}
+	metrics map[string]float64
+}
+
+// scrape reads /debug/status and /metrics from the server.
+func scrape(ctx context.Context, httpClient *http.Client, server string) (*sample, error) {
+	s := &sample{metrics: map[string]float64{}}
+	server = strings.TrimSuffix(server, "/")
+
+	response, err := get(ctx, httpClient, server+"/debug/status")
+	if err != nil {
+		return nil, err
+	}
+	err = json.NewDecoder(response.Body).Decode(&s.status)
+	response.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("decoding /debug/status: %w", err)
+	}
+
+	response, err = get(ctx, httpClient, server+"/metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	// Add up every series of each metric in the Prometheus text format, ignoring labels
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		value, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if err != nil {
+			continue
+		}
+		name := fields[0]
+		if i := strings.IndexByte(name, '{'); i >= 0 {
+			name = name[:i]
+		}
+		s.metrics[name] += value
+	}
+	return s, scanner.Err()
+}
+
+// get sends a GET request, failing on any status but 200 OK.
+func get(ctx context.Context, httpClient *http.Client, url string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("GET %s: server responded with %s", url, response.Status)
+	}
+	return response, nil
+}
+
+// usage compares the sample taken under load with one taken before the load started.
+func (s *sample) usage(before *sample, elapsed time.Duration) *usage {
+	delta := func(name string) float64 {
+		return s.metrics[name] - before.metrics[name]
+	}
+	return &usage{
+		Hubs:                s.status.Hubs,
+		Clients:             s.status.Clients,
+		Goroutines:          s.status.Goroutines,
+		MemoryBytes:         s.metrics["process_resident_memory_bytes"],
+		MemoryGrowthBytes:   delta("process_resident_memory_bytes"),
+		CPUCores:            delta("process_cpu_seconds_total") / elapsed.Seconds(),
+		BroadcastsPerSecond: delta("stack_messages_broadcast_total") / elapsed.Seconds(),
+		DroppedSlowClients:  delta("stack_dropped_clients_total"),
+		RateLimited:         delta("stack_rate_limited_total"),
+	}
+}
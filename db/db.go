@@ -1,61 +1,141 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"os"
+	"time"
 
+	"stack-web-app/metrics"
+	"stack-web-app/protocol"
+	"stack-web-app/tracing"
+
+	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // User object that describes the database table columns and is used to push the info
-// back to the websocket client for speaker stack rendering
-type User struct {
-	SpeakerPostition int16  `json:"speakerPosition"`
-	SpeakerId        string `json:"speakerId"`
-	Name             string `json:"name"`
-}
+// back to the websocket client for speaker stack rendering. It is defined in the
+// protocol package so that clients can decode it without depending on the database.
+type User = protocol.User
+
+var (
+	// dataSource is the sqlite database every operation opens.
+	dataSource = "./sqlite-database.db"
+
+	// keepAlive holds a connection to the in-memory database open so that it isn't
+	// thrown away when the last operation closes its connection.
+	keepAlive *sql.DB
+)
 
 // Start is used to start the database, that is remove any potentially existing db files
 // and create the new database file. We don't care about old database contents and don't
 // want it there at all so we delete before creating just to be sure.
 func Start() {
-	// Add to context logger
-	ContextLogger = ContextLogger.WithFields(log.Fields{
+	// Get package logger
+	logger := contextLogger(context.Background()).WithFields(log.Fields{
 		"function": "Start",
 		"module":   "db",
 	})
 
 	// Delete and recreate existing sqlite file just in case
 	os.Remove("sqlite-database.db")
-	ContextLogger.Info("Creating sqlite-database.db...")
+	logger.Info("Creating sqlite-database.db...")
 	file, err := os.Create("sqlite-database.db")
 	if err != nil {
-		log.Fatal(err.Error())
+		logger.Fatal(err.Error())
 	}
 	file.Close()
-	log.Info("sqlite-database.db created")
+	logger.Info("sqlite-database.db created")
+
+	// Create the table every meeting's event log is appended to
+	err = createEventsTable(context.Background())
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+}
+
+// StartInMemory is used instead of Start to keep the database in memory, so that tests
+// can run servers without touching the file system. Every call starts a new, empty
+// database.
+func StartInMemory() error {
+	if keepAlive != nil {
+		keepAlive.Close()
+	}
+	dataSource = fmt.Sprintf("file:stack-%s?mode=memory&cache=shared&_busy_timeout=5000", uuid.New().String())
+	database, err := sql.Open("sqlite3", dataSource)
+	if err != nil {
+		return err
+	}
+	err = database.Ping()
+	if err != nil {
+		database.Close()
+		return err
+	}
+	keepAlive = database
+	return createEventsTable(context.Background())
+}
+
+// Ping checks that the database file can be opened and queried. It is used by the
+// readiness probe.
+func Ping(ctx context.Context) (err error) {
+	// Record how long the operation takes
+	defer metrics.ObserveDBOperation("Ping", time.Now())
+	ctx, span := tracing.Tracer().Start(ctx, "db.Ping", trace.WithAttributes(
+		attribute.String("db.system", "sqlite"),
+	))
+	defer span.End()
+
+	// Get sqlite db connection
+	sqliteDatabase, _ := sql.Open("sqlite3", dataSource)
+	defer sqliteDatabase.Close()
+
+	// Run a trivial query to make sure the database actually answers
+	var one int
+	err = sqliteDatabase.QueryRowContext(ctx, "SELECT 1;").Scan(&one)
+	if err != nil {
+		tracing.RecordError(span, err)
+		contextLogger(ctx).WithFields(log.Fields{
+			"function": "Ping",
+			"error":    err.Error(),
+		}).Warning("Database ping failed")
+		return err
+	}
+	return nil
 }
 
 // CreateTable is used to create a new meeting table in the database.
-func CreateTable(newTableId string) (err error) {
-	// Add to context logger
-	ContextLogger = ContextLogger.WithFields(log.Fields{
+func CreateTable(ctx context.Context, newTableId string) (err error) {
+	// Get logger from request context
+	logger := contextLogger(ctx).WithFields(log.Fields{
 		"function": "CreateTable",
 		"module":   "db",
 		"tableId":  newTableId,
 	})
 
+	// Record how long the operation takes
+	defer metrics.ObserveDBOperation("CreateTable", time.Now())
+	ctx, span := tracing.Tracer().Start(ctx, "db.CreateTable", trace.WithAttributes(
+		attribute.String("db.system", "sqlite"),
+		attribute.String("meeting.id", newTableId),
+	))
+	defer span.End()
+
 	// Get sqlite db connection
-	sqliteDatabase, _ := sql.Open("sqlite3", "./sqlite-database.db")
+	sqliteDatabase, _ := sql.Open("sqlite3", dataSource)
 	defer sqliteDatabase.Close()
 
 	// Prepare table creation SQL
 	createMeetingTableSQL := "CREATE TABLE IF NOT EXISTS '" + newTableId + "' (speakerPosition INTEGER NOT NULL PRIMARY KEY, speakerId TEXT UNIQUE, name TEXT);"
-	log.WithField("sqlQuery", createMeetingTableSQL).Debug("Preparing SQL query")
-	statement, err := sqliteDatabase.Prepare(createMeetingTableSQL)
+	logger.WithField("sqlQuery", createMeetingTableSQL).Debug("Preparing SQL query")
+	statement, err := sqliteDatabase.PrepareContext(ctx, createMeetingTableSQL)
 	if err != nil {
-		log.WithFields(log.Fields{
+		tracing.RecordError(span, err)
+		logger.WithFields(log.Fields{
 			"sqlQuery": createMeetingTableSQL,
 			"error":    err.Error(),
 		}).Error("Error preparing statement to create meeting table")
@@ -64,9 +144,10 @@ func CreateTable(newTableId string) (err error) {
 	defer statement.Close()
 
 	// Execute new table creation
-	_, err = statement.Exec()
+	_, err = statement.ExecContext(ctx)
 	if err != nil {
-		log.WithFields(log.Fields{
+		tracing.RecordError(span, err)
+		logger.WithFields(log.Fields{
 			"sqlQuery": createMeetingTableSQL,
 			"error":    err.Error(),
 		}).Error("Error executing statement to create meeting table")
@@ -82,24 +163,33 @@ func CreateTable(newTableId string) (err error) {
 // goroutine. We will not be using vacuum here but may look into doing this later
 // in a similar timed fashion and just look for the OS system free space to be
 // say 1.25x the current SQL file size or something for safety.
-func DeleteTable(tableId string) (err error) {
-	// Add to context logger
-	ContextLogger = ContextLogger.WithFields(log.Fields{
+func DeleteTable(ctx context.Context, tableId string) (err error) {
+	// Get logger from request context
+	logger := contextLogger(ctx).WithFields(log.Fields{
 		"function": "DeleteTable",
 		"module":   "db",
 		"tableId":  tableId,
 	})
 
+	// Record how long the operation takes
+	defer metrics.ObserveDBOperation("DeleteTable", time.Now())
+	ctx, span := tracing.Tracer().Start(ctx, "db.DeleteTable", trace.WithAttributes(
+		attribute.String("db.system", "sqlite"),
+		attribute.String("meeting.id", tableId),
+	))
+	defer span.End()
+
 	// Get sqlite db connection
-	sqliteDatabase, _ := sql.Open("sqlite3", "./sqlite-database.db")
+	sqliteDatabase, _ := sql.Open("sqlite3", dataSource)
 	defer sqliteDatabase.Close()
 
 	// Prepare table creation SQL
 	deleteMeetingTableSQL := "DROP TABLE IF EXISTS '" + tableId + "';"
-	log.WithField("sqlQuery", deleteMeetingTableSQL).Debug("Preparing SQL query")
-	statement, err := sqliteDatabase.Prepare(deleteMeetingTableSQL)
+	logger.WithField("sqlQuery", deleteMeetingTableSQL).Debug("Preparing SQL query")
+	statement, err := sqliteDatabase.PrepareContext(ctx, deleteMeetingTableSQL)
 	if err != nil {
-		log.WithFields(log.Fields{
+		tracing.RecordError(span, err)
+		logger.WithFields(log.Fields{
 			"sqlQuery": deleteMeetingTableSQL,
 			"error":    err.Error(),
 		}).Error("Error preparing statement to delete meeting table")
@@ -108,9 +198,10 @@ func DeleteTable(tableId string) (err error) {
 	defer statement.Close()
 
 	// Execute new table creation
-	_, err = statement.Exec()
+	_, err = statement.ExecContext(ctx)
 	if err != nil {
-		log.WithFields(log.Fields{
+		tracing.RecordError(span, err)
+		logger.WithFields(log.Fields{
 			"sqlQuery": deleteMeetingTableSQL,
 			"error":    err.Error(),
 		}).Error("Error executing statement to delete meeting table")
@@ -122,9 +213,9 @@ func DeleteTable(tableId string) (err error) {
 }
 
 // GetOnStack is the function called when a user wants to put themselves at the end of the speaker queue.
-func GetOnStack(tableId string, speakerId string, name string) (err error) {
-	// Add to context logger
-	ContextLogger = ContextLogger.WithFields(log.Fields{
+func GetOnStack(ctx context.Context, tableId string, speakerId string, name string) (err error) {
+	// Get logger from request context
+	logger := contextLogger(ctx).WithFields(log.Fields{
 		"function":  "GetOnStack",
 		"module":    "db",
 		"tableId":   tableId,
@@ -132,16 +223,25 @@ func GetOnStack(tableId string, speakerId string, name string) (err error) {
 		"name":      name,
 	})
 
+	// Record how long the operation takes
+	defer metrics.ObserveDBOperation("GetOnStack", time.Now())
+	ctx, span := tracing.Tracer().Start(ctx, "db.GetOnStack", trace.WithAttributes(
+		attribute.String("db.system", "sqlite"),
+		attribute.String("meeting.id", tableId),
+	))
+	defer span.End()
+
 	// Get sqlite db connection
-	sqliteDatabase, _ := sql.Open("sqlite3", "./sqlite-database.db")
+	sqliteDatabase, _ := sql.Open("sqlite3", dataSource)
 	defer sqliteDatabase.Close()
 
 	// Prepare table update SQL
 	addUserToStackTableSQL := "INSERT INTO '" + tableId + "' (speakerId, name) VALUES (?,?);"
-	log.WithField("sqlQuery", addUserToStackTableSQL).Debug("Preparing SQL query")
-	statement, err := sqliteDatabase.Prepare(addUserToStackTableSQL)
+	logger.WithField("sqlQuery", addUserToStackTableSQL).Debug("Preparing SQL query")
+	statement, err := sqliteDatabase.PrepareContext(ctx, addUserToStackTableSQL)
 	if err != nil {
-		log.WithFields(log.Fields{
+		tracing.RecordError(span, err)
+		logger.WithFields(log.Fields{
 			"sqlQuery": addUserToStackTableSQL,
 			"error":    err.Error(),
 		}).Error("Error preparing statement to get on stack.")
@@ -150,9 +250,10 @@ func GetOnStack(tableId string, speakerId string, name string) (err error) {
 	defer statement.Close()
 
 	// Execute new table update
-	_, err = statement.Exec(speakerId, name)
+	_, err = statement.ExecContext(ctx, speakerId, name)
 	if err != nil {
-		log.WithFields(log.Fields{
+		tracing.RecordError(span, err)
+		logger.WithFields(log.Fields{
 			"sqlQuery": addUserToStackTableSQL,
 			"error":    err.Error(),
 		}).Error("Error executing statement to get on stack.")
@@ -165,25 +266,34 @@ func GetOnStack(tableId string, speakerId string, name string) (err error) {
 
 // GetOffStack is called when a user wants to remove themselves from the speaker queue,
 // moving everyone behind them up a position.
-func GetOffStack(tableId string, speakerId string) (err error) {
-	// Add to context logger
-	ContextLogger = ContextLogger.WithFields(log.Fields{
+func GetOffStack(ctx context.Context, tableId string, speakerId string) (err error) {
+	// Get logger from request context
+	logger := contextLogger(ctx).WithFields(log.Fields{
 		"function":  "GetOffStack",
 		"module":    "db",
 		"tableId":   tableId,
 		"speakerId": speakerId,
 	})
 
+	// Record how long the operation takes
+	defer metrics.ObserveDBOperation("GetOffStack", time.Now())
+	ctx, span := tracing.Tracer().Start(ctx, "db.GetOffStack", trace.WithAttributes(
+		attribute.String("db.system", "sqlite"),
+		attribute.String("meeting.id", tableId),
+	))
+	defer span.End()
+
 	// Get sqlite db connection
-	sqliteDatabase, _ := sql.Open("sqlite3", "./sqlite-database.db")
+	sqliteDatabase, _ := sql.Open("sqlite3", dataSource)
 	defer sqliteDatabase.Close()
 
 	// Prepare table update SQL
 	removeUserFromStackTableSQL := "DELETE FROM '" + tableId + "' WHERE speakerId=?;"
-	log.WithField("sqlQuery", removeUserFromStackTableSQL).Debug("Preparing SQL query")
-	statement, err := sqliteDatabase.Prepare(removeUserFromStackTableSQL)
+	logger.WithField("sqlQuery", removeUserFromStackTableSQL).Debug("Preparing SQL query")
+	statement, err := sqliteDatabase.PrepareContext(ctx, removeUserFromStackTableSQL)
 	if err != nil {
-		log.WithFields(log.Fields{
+		tracing.RecordError(span, err)
+		logger.WithFields(log.Fields{
 			"sqlQuery": removeUserFromStackTableSQL,
 			"error":    err.Error(),
 		}).Error("Error preparing statement to get off stack")
@@ -192,9 +302,10 @@ func GetOffStack(tableId string, speakerId string) (err error) {
 	defer statement.Close()
 
 	// Execute new table update
-	_, err = statement.Exec(speakerId)
+	_, err = statement.ExecContext(ctx, speakerId)
 	if err != nil {
-		log.WithFields(log.Fields{
+		tracing.RecordError(span, err)
+		logger.WithFields(log.Fields{
 			"sqlQuery": removeUserFromStackTableSQL,
 			"error":    err.Error(),
 		}).Error("Error executing statement to get off stack")
@@ -207,24 +318,33 @@ func GetOffStack(tableId string, speakerId string) (err error) {
 // ShowCurrent Stack is used to return the current contents of the speaker stack
 // and is used on new connections and after a user has either gotten on or taken
 // themselves off of the speaker stack.
-func ShowCurrentStack(tableId string) (stackUsers []User, err error) {
-	// Add to context logger
-	ContextLogger = ContextLogger.WithFields(log.Fields{
+func ShowCurrentStack(ctx context.Context, tableId string) (stackUsers []User, err error) {
+	// Get logger from request context
+	logger := contextLogger(ctx).WithFields(log.Fields{
 		"function": "ShowCurrentStack",
 		"module":   "db",
 		"tableId":  tableId,
 	})
 
+	// Record how long the operation takes
+	defer metrics.ObserveDBOperation("ShowCurrentStack", time.Now())
+	ctx, span := tracing.Tracer().Start(ctx, "db.ShowCurrentStack", trace.WithAttributes(
+		attribute.String("db.system", "sqlite"),
+		attribute.String("meeting.id", tableId),
+	))
+	defer span.End()
+
 	// Get sqlite db connection
-	sqliteDatabase, _ := sql.Open("sqlite3", "./sqlite-database.db")
+	sqliteDatabase, _ := sql.Open("sqlite3", dataSource)
 	defer sqliteDatabase.Close()
 
 	// Prepare SELECT query
 	showCurrentStackTableSQL := "SELECT speakerPosition, speakerId, name FROM '" + tableId + "';"
-	log.WithField("sqlQuery", showCurrentStackTableSQL).Debug("Preparing SQL query")
-	rows, err := sqliteDatabase.Query(showCurrentStackTableSQL)
+	logger.WithField("sqlQuery", showCurrentStackTableSQL).Debug("Preparing SQL query")
+	rows, err := sqliteDatabase.QueryContext(ctx, showCurrentStackTableSQL)
 	if err != nil {
-		log.WithFields(log.Fields{
+		tracing.RecordError(span, err)
+		logger.WithFields(log.Fields{
 			"sqlQuery": showCurrentStackTableSQL,
 			"error":    err.Error(),
 		}).Error("Error querying meeting table")
@@ -237,7 +357,7 @@ func ShowCurrentStack(tableId string) (stackUsers []User, err error) {
 		var stackUser User
 		err := rows.Scan(&stackUser.SpeakerPostition, &stackUser.SpeakerId, &stackUser.Name)
 		if err != nil {
-			log.WithFields(log.Fields{
+			logger.WithFields(log.Fields{
 				"sqlQuery": showCurrentStackTableSQL,
 				"error":    err.Error(),
 			}).Error("Error scanning query results for meeting table")
@@ -248,3 +368,51 @@ func ShowCurrentStack(tableId string) (stackUsers []User, err error) {
 	// Return current stack
 	return stackUsers, nil
 }
+
+// RestoreStack inserts users into a meeting table keeping their speaker positions. It
+// is used when another instance hands us the current state of a meeting we haven't
+// seen before.
+func RestoreStack(ctx context.Context, tableId string, stackUsers []User) (err error) {
+	// Get logger from request context
+	logger := contextLogger(ctx).WithFields(log.Fields{
+		"function": "RestoreStack",
+		"module":   "db",
+		"tableId":  tableId,
+	})
+
+	// Record how long the operation takes
+	defer metrics.ObserveDBOperation("RestoreStack", time.Now())
+	ctx, span := tracing.Tracer().Start(ctx, "db.RestoreStack", trace.WithAttributes(
+		attribute.String("db.system", "sqlite"),
+		attribute.String("meeting.id", tableId),
+		attribute.Int("users", len(stackUsers)),
+	))
+	defer span.End()
+
+	// Get sqlite db connection
+	sqliteDatabase, _ := sql.Open("sqlite3", dataSource)
+	defer sqliteDatabase.Close()
+
+	// Insert every user in a single transaction so the stack is never half restored
+	transaction, err := sqliteDatabase.BeginTx(ctx, nil)
+	if err != nil {
+		tracing.RecordError(span, err)
+		logger.WithField("error", err.Error()).Error("Error starting transaction to restore stack")
+		return err
+	}
+	restoreStackTableSQL := "INSERT OR REPLACE INTO '" + tableId + "' (speakerPosition, speakerId, name) VALUES (?,?,?);"
+	logger.WithField("sqlQuery", restoreStackTableSQL).Debug("Preparing SQL query")
+	for _, stackUser := range stackUsers {
+		_, err = transaction.ExecContext(ctx, restoreStackTableSQL, stackUser.SpeakerPostition, stackUser.SpeakerId, stackUser.Name)
+		if err != nil {
+			tracing.RecordError(span, err)
+			logger.WithFields(log.Fields{
+				"sqlQuery": restoreStackTableSQL,
+				"error":    err.Error(),
+			}).Error("Error executing statement to restore stack")
+			_ = transaction.Rollback()
+			return err
+		}
+	}
+	return transaction.Commit()
+}
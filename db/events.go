@@ -0,0 +1,130 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"stack-web-app/metrics"
+	"stack-web-app/tracing"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Event is an entry in the append-only log of things that happened in a meeting. The
+// log outlives the meeting's stack table so facilitators can review participation
+// after the meeting has ended.
+type Event struct {
+	Id        int64     `json:"id"`
+	MeetingId string    `json:"meetingId"`
+	Type      string    `json:"type"`
+	SpeakerId string    `json:"speakerId,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	ActorId   string    `json:"actorId,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// createEventsTable creates the table holding every meeting's event log.
+func createEventsTable(ctx context.Context) (err error) {
+	// Get sqlite db connection
+	sqliteDatabase, _ := sql.Open("sqlite3", dataSource)
+	defer sqliteDatabase.Close()
+
+	_, err = sqliteDatabase.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS meeting_events (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, meetingId TEXT NOT NULL, type TEXT NOT NULL, speakerId TEXT, name TEXT, actorId TEXT, detail TEXT, time TIMESTAMP NOT NULL);")
+	if err != nil {
+		return err
+	}
+	_, err = sqliteDatabase.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS meeting_events_meeting ON meeting_events (meetingId, id);")
+	return err
+}
+
+// RecordEvent appends an event to its meeting's event log.
+func RecordEvent(ctx context.Context, event Event) (err error) {
+	// Get logger from request context
+	logger := contextLogger(ctx).WithFields(log.Fields{
+		"function":  "RecordEvent",
+		"module":    "db",
+		"meetingId": event.MeetingId,
+		"type":      event.Type,
+	})
+
+	// Record how long the operation takes
+	defer metrics.ObserveDBOperation("RecordEvent", time.Now())
+	ctx, span := tracing.Tracer().Start(ctx, "db.RecordEvent", trace.WithAttributes(
+		attribute.String("db.system", "sqlite"),
+		attribute.String("meeting.id", event.MeetingId),
+		attribute.String("event.type", event.Type),
+	))
+	defer span.End()
+
+	// Get sqlite db connection
+	sqliteDatabase, _ := sql.Open("sqlite3", dataSource)
+	defer sqliteDatabase.Close()
+
+	// Append the event
+	recordEventSQL := "INSERT INTO meeting_events (meetingId, type, speakerId, name, actorId, detail, time) VALUES (?,?,?,?,?,?,?);"
+	logger.WithField("sqlQuery", recordEventSQL).Debug("Preparing SQL query")
+	_, err = sqliteDatabase.ExecContext(ctx, recordEventSQL,
+		event.MeetingId, event.Type, event.SpeakerId, event.Name, event.ActorId, event.Detail, event.Time.UTC())
+	if err != nil {
+		tracing.RecordError(span, err)
+		logger.WithFields(log.Fields{
+			"sqlQuery": recordEventSQL,
+			"error":    err.Error(),
+		}).Error("Error recording meeting event")
+		return err
+	}
+	return nil
+}
+
+// ListEvents returns a meeting's event log, oldest first.
+func ListEvents(ctx context.Context, meetingId string) (meetingEvents []Event, err error) {
+	// Get logger from request context
+	logger := contextLogger(ctx).WithFields(log.Fields{
+		"function":  "ListEvents",
+		"module":    "db",
+		"meetingId": meetingId,
+	})
+
+	// Record how long the operation takes
+	defer metrics.ObserveDBOperation("ListEvents", time.Now())
+	ctx, span := tracing.Tracer().Start(ctx, "db.ListEvents", trace.WithAttributes(
+		attribute.String("db.system", "sqlite"),
+		attribute.String("meeting.id", meetingId),
+	))
+	defer span.End()
+
+	// Get sqlite db connection
+	sqliteDatabase, _ := sql.Open("sqlite3", dataSource)
+	defer sqliteDatabase.Close()
+
+	// Read the log in the order it was written
+	listEventsSQL := "SELECT id, meetingId, type, speakerId, name, actorId, detail, time FROM meeting_events WHERE meetingId=? ORDER BY id;"
+	logger.WithField("sqlQuery", listEventsSQL).Debug("Preparing SQL query")
+	rows, err := sqliteDatabase.QueryContext(ctx, listEventsSQL, meetingId)
+	if err != nil {
+		tracing.RecordError(span, err)
+		logger.WithFields(log.Fields{
+			"sqlQuery": listEventsSQL,
+			"error":    err.Error(),
+		}).Error("Error querying meeting events")
+		return nil, err
+	}
+	defer rows.Close()
+
+	meetingEvents = []Event{}
+	for rows.Next() {
+		var event Event
+		err = rows.Scan(&event.Id, &event.MeetingId, &event.Type, &event.SpeakerId, &event.Name, &event.ActorId, &event.Detail, &event.Time)
+		if err != nil {
+			tracing.RecordError(span, err)
+			logger.WithField("error", err.Error()).Error("Error reading meeting event")
+			return nil, err
+		}
+		meetingEvents = append(meetingEvents, event)
+	}
+	return meetingEvents, rows.Err()
+}
@@ -1,10 +1,14 @@
 package db
 
 import (
+	"context"
+
+	"stack-web-app/logging"
+
 	log "github.com/sirupsen/logrus"
 )
 
-// ContextLogger declares top level context logger to use in package
-var ContextLogger = log.WithFields(log.Fields{
-	"package": "db",
-})
+// contextLogger returns the logger carried by ctx, tagged with this package's name.
+func contextLogger(ctx context.Context) *log.Entry {
+	return logging.FromContext(ctx).WithField("package", "db")
+}
@@ -0,0 +1,100 @@
+// Package events is a small in-process event bus used to tell interested parts of the
+// server about things that happen to meetings, such as a meeting being pruned.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Type names the kind of meeting event that happened.
+type Type string
+
+// Event types. Events about a participant store their client ID in the "speakerId"
+// data field and, once known, their name in the "name" data field.
+const (
+	// MeetingCreated is emitted when a meeting is created or adopted from another
+	// instance.
+	MeetingCreated Type = "meeting.created"
+
+	// MeetingPruned is emitted when the pruner removes a meeting. The reason for the
+	// removal is stored in the "reason" data field.
+	MeetingPruned Type = "meeting.pruned"
+
+	// ParticipantJoined and ParticipantLeft are emitted when a client connects to or
+	// disconnects from a meeting.
+	ParticipantJoined Type = "participant.joined"
+	ParticipantLeft   Type = "participant.left"
+
+	// StackOn and StackOff are emitted when a participant gets on or takes themselves
+	// off the stack.
+	StackOn  Type = "stack.on"
+	StackOff Type = "stack.off"
+
+	// StackRemoved is emitted when a moderator takes a participant off the stack. The
+	// moderator's client ID is stored in the "actorId" data field.
+	StackRemoved Type = "stack.removed"
+
+	// SpeakingStarted and SpeakingEnded are emitted when a participant reaches and
+	// leaves the top of the stack.
+	SpeakingStarted Type = "speaking.started"
+	SpeakingEnded   Type = "speaking.ended"
+)
+
+// Event describes something that happened to a meeting.
+type Event struct {
+	Type      Type                   `json:"type"`
+	MeetingId string                 `json:"meetingId"`
+	Time      time.Time              `json:"time"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+
+	// Remote is true for events replicated from the instance they happened on, which
+	// is responsible for anything that should only happen once, like webhooks.
+	Remote bool `json:"-"`
+}
+
+// Handler is called for every published event. Handlers are run synchronously in the
+// publishing goroutine, so anything slow should be handed off to another goroutine.
+type Handler func(Event)
+
+var (
+	handlersLock sync.RWMutex
+	handlers     = map[int]Handler{}
+	nextHandler  int
+)
+
+// Subscribe registers a handler for all future events and returns a function that
+// removes it again.
+func Subscribe(handler Handler) (unsubscribe func()) {
+	handlersLock.Lock()
+	defer handlersLock.Unlock()
+
+	id := nextHandler
+	nextHandler++
+	handlers[id] = handler
+	return func() {
+		handlersLock.Lock()
+		defer handlersLock.Unlock()
+		delete(handlers, id)
+	}
+}
+
+// Publish sends the event to every subscribed handler. The event time is filled in if
+// it has not been set by the caller, though callers with a clock of their own, like
+// meeting hubs, should set it so that reports follow that clock.
+func Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	handlersLock.RLock()
+	current := make([]Handler, 0, len(handlers))
+	for _, handler := range handlers {
+		current = append(current, handler)
+	}
+	handlersLock.RUnlock()
+
+	for _, handler := range current {
+		handler(event)
+	}
+}
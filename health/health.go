@@ -0,0 +1,113 @@
+// Package health serves the liveness, readiness and status endpoints used by
+// orchestrators to decide whether to route traffic to an instance.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"stack-web-app/db"
+	"stack-web-app/logging"
+	"stack-web-app/wshandler"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// readyTimeout bounds how long the readiness probe waits on the database.
+const readyTimeout = 2 * time.Second
+
+var (
+	// draining is set once the server has started shutting down.
+	draining int32
+
+	// startedAt is when the process started, reported as uptime in the status.
+	startedAt = time.Now()
+)
+
+// SetDraining marks the server as shutting down so the readiness probe fails and
+// load balancers stop sending new connections.
+func SetDraining() {
+	atomic.StoreInt32(&draining, 1)
+}
+
+// Draining reports whether the server is shutting down.
+func Draining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// probeResult is the JSON body returned by the liveness and readiness probes.
+type probeResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Status is the JSON summary returned by the /debug/status endpoint.
+type Status struct {
+	Hubs          int        `json:"hubs"`
+	Clients       int        `json:"clients"`
+	Goroutines    int        `json:"goroutines"`
+	PrunerLastRun *time.Time `json:"prunerLastRun"`
+	Uptime        string     `json:"uptime"`
+	Draining      bool       `json:"draining"`
+}
+
+// writeJSON writes the body as JSON with the given status code.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		logging.FromContext(r.Context()).WithFields(log.Fields{
+			"package": "health",
+			"error":   err.Error(),
+		}).Error("Error writing health response.")
+	}
+}
+
+// Healthz is the liveness probe. It only checks that the process can serve HTTP.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, probeResult{Status: "ok"})
+}
+
+// Readyz is the readiness probe. It fails while the server is draining or when the
+// database can't be queried. The probe is unauthenticated, so database errors are
+// only logged and callers get a generic message.
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	if Draining() {
+		writeJSON(w, r, http.StatusServiceUnavailable, probeResult{Status: "draining"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	if err := db.Ping(ctx); err != nil {
+		logging.FromContext(r.Context()).WithFields(log.Fields{
+			"package": "health",
+			"error":   err.Error(),
+		}).Warning("Readiness probe couldn't reach the database.")
+		writeJSON(w, r, http.StatusServiceUnavailable, probeResult{Status: "unavailable", Error: "database unavailable"})
+		return
+	}
+	writeJSON(w, r, http.StatusOK, probeResult{Status: "ok"})
+}
+
+// DebugStatus returns a JSON summary of the server's current load.
+func DebugStatus(w http.ResponseWriter, r *http.Request) {
+	hubs, clients := wshandler.Stats()
+	status := Status{
+		Hubs:       hubs,
+		Clients:    clients,
+		Goroutines: runtime.NumGoroutine(),
+		Uptime:     time.Since(startedAt).Round(time.Second).String(),
+		Draining:   Draining(),
+	}
+	if lastRun := wshandler.PrunerLastRun(); !lastRun.IsZero() {
+		status.PrunerLastRun = &lastRun
+	}
+	writeJSON(w, r, http.StatusOK, status)
+}
@@ -0,0 +1,21 @@
+package logging
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// AdminAuthorized reports whether the request carries the ADMIN_TOKEN environment
+// variable as a bearer token, comparing them in constant time so the token can't be
+// guessed a byte at a time. Nothing is authorized if no token is configured.
+func AdminAuthorized(r *http.Request) bool {
+	token := os.Getenv("ADMIN_TOKEN")
+	authorization := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(authorization, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAdminAuthorized(t *testing.T) {
+	previous, set := os.LookupEnv("ADMIN_TOKEN")
+	defer func() {
+		if set {
+			os.Setenv("ADMIN_TOKEN", previous)
+		} else {
+			os.Unsetenv("ADMIN_TOKEN")
+		}
+	}()
+
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		want          bool
+	}{
+		{"right token", "s3cret", "Bearer s3cret", true},
+		{"wrong token", "s3cret", "Bearer s3cres", false},
+		{"prefix of the token", "s3cret", "Bearer s3c", false},
+		{"token without the scheme", "s3cret", "s3cret", false},
+		{"no header", "s3cret", "", false},
+		{"no token configured", "", "Bearer ", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv("ADMIN_TOKEN", test.token)
+			r := httptest.NewRequest("GET", "/admin/loglevel", nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			if got := AdminAuthorized(r); got != test.want {
+				t.Errorf("AdminAuthorized() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
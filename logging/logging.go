@@ -0,0 +1,115 @@
+// Package logging carries request scoped logrus loggers through context.Context so
+// that log fields for one request or client never leak into another's logs.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader is the header used to read and return the request ID.
+const RequestIDHeader = "X-Request-Id"
+
+// contextKey is the private type for values stored in a context by this package.
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+)
+
+// WithLogger returns a copy of ctx carrying the given logger.
+func WithLogger(ctx context.Context, logger *log.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// FromContext returns the logger carried by ctx, or a logger using the standard
+// logrus configuration if there isn't one. Packages should derive their loggers from
+// it rather than sharing one, so fields added for one client or meeting never end up
+// on another's log lines.
+func FromContext(ctx context.Context) *log.Entry {
+	if ctx != nil {
+		if logger, ok := ctx.Value(loggerKey).(*log.Entry); ok {
+			return logger
+		}
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// RequestID returns the ID of the HTTP request that ctx belongs to, if any.
+func RequestID(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIDKey).(string)
+	return requestId
+}
+
+// Middleware assigns every request an ID, reusing one supplied by a proxy in the
+// X-Request-Id header, and attaches a logger with that ID and the trace ID to the
+// request context.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(RequestIDHeader)
+		if requestId == "" || len(requestId) > 128 {
+			requestId = uuid.New().String()
+		}
+		w.Header().Set(RequestIDHeader, requestId)
+
+		fields := log.Fields{
+			"requestId": requestId,
+			"method":    r.Method,
+			"path":      r.URL.Path,
+		}
+		if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.HasTraceID() {
+			fields["traceId"] = spanContext.TraceID().String()
+		}
+		ctx := context.WithValue(r.Context(), requestIDKey, requestId)
+		ctx = WithLogger(ctx, log.WithFields(fields))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// levelBody is the JSON body read and returned by LevelHandler.
+type levelBody struct {
+	Level string `json:"level"`
+}
+
+// LevelHandler reports the current log level on GET and changes it on PUT, e.g.
+// {"level": "debug"}. Requests must carry the ADMIN_TOKEN environment variable as a
+// bearer token, and the handler refuses everything if no token is configured.
+func LevelHandler(w http.ResponseWriter, r *http.Request) {
+	logger := FromContext(r.Context()).WithFields(log.Fields{
+		"package":  "logging",
+		"function": "LevelHandler",
+	})
+
+	if !AdminAuthorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var body levelBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		level, err := log.ParseLevel(strings.TrimSpace(body.Level))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.SetLevel(level)
+		logger.WithField("level", level.String()).Info("Log level changed.")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(levelBody{Level: log.GetLevel().String()})
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Error writing log level response.")
+	}
+}
@@ -5,16 +5,27 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"stack-web-app/backplane"
 	"stack-web-app/db"
+	"stack-web-app/events"
+	"stack-web-app/health"
+	"stack-web-app/server"
+	"stack-web-app/static"
+	"stack-web-app/tlsserver"
+	"stack-web-app/tracing"
+	"stack-web-app/webhook"
 	"stack-web-app/wshandler"
 
 	"github.com/gorilla/handlers"
-	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -31,30 +42,160 @@ func main() {
 		log.SetLevel(log.InfoLevel)
 	}
 
+	// Set up trace export, a no-op unless an OTLP endpoint is configured
+	shutdownTracing, err := tracing.Start(context.Background())
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("Error setting up tracing")
+	}
+	defer func() {
+		_ = shutdownTracing(context.Background())
+	}()
+
 	// Set up gorilla mux router handling
 	flag.Parse()
 	db.Start()
-	go wshandler.PruneEmptyMeetings()
-	router := mux.NewRouter()
-	router.HandleFunc("/", wshandler.GetWS).Methods("GET")
-	router.HandleFunc("/", wshandler.PostWS).Methods("POST")
+	err = wshandler.ConfigurePruner()
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("Invalid meeting pruning configuration")
+	}
+	err = wshandler.ConfigureLimits()
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("Invalid rate limit configuration")
+	}
+	err = wshandler.ConfigureBroadcast()
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("Invalid broadcast configuration")
+	}
+	err = wshandler.ConfigureCompression()
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("Invalid websocket compression configuration")
+	}
+	err = wshandler.ConfigureSlowConsumers()
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("Invalid slow consumer configuration")
+	}
+	bus, err := backplane.FromEnv()
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("Error connecting to backplane")
+	}
+	defer bus.Close()
+	stopAuditLog := wshandler.StartAuditLog()
+	defer stopAuditLog()
+	webhookConfig, err := webhook.ConfigFromEnv()
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("Invalid webhook configuration")
+	}
+	dispatcher := webhook.NewDispatcher(webhookConfig)
+	defer dispatcher.Stop()
+	stopWebhooks := events.Subscribe(dispatcher.Handle)
+	defer stopWebhooks()
+	wshandler.UseWebhooks(dispatcher)
+	err = wshandler.StartReplication(bus)
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("Error starting meeting replication")
+	}
+	pruneCtx, stopPruner := context.WithCancel(context.Background())
+	defer stopPruner()
+	go wshandler.PruneMeetings(pruneCtx)
+	frontend, serveFrontend, err := static.Handler()
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("Error setting up frontend")
+	}
+	options := server.Options{
+		Webhooks:           dispatcher,
+		ChatSecret:         os.Getenv("CHATBOT_SECRET"),
+		SlackSigningSecret: os.Getenv("SLACK_SIGNING_SECRET"),
+	}
+	if serveFrontend {
+		options.Frontend = frontend
+	}
+	router := server.NewRouter(options)
 
 	// Set up request logging
 	loggedRouter := handlers.LoggingHandler(os.Stdout, router)
 
 	// Setting some required pieces for DigitalOcean app platform support
 	port := os.Getenv("PORT")
+
+	// Optional native TLS for deployments without a proxy terminating it for us
+	tlsConfig, err := tlsserver.FromEnv(port)
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("Invalid TLS configuration")
+	}
 	if port == "" {
 		port = "80"
+		if tlsConfig != nil {
+			port = "443"
+		}
+	}
+
+	// How long to keep serving after a shutdown signal so load balancers can see the
+	// failing readiness probe and stop routing new connections here
+	drainDelay := 5 * time.Second
+	if value, ok := os.LookupEnv("DRAIN_DELAY"); ok {
+		drainDelay, err = time.ParseDuration(value)
+		if err != nil {
+			log.WithField("error", err.Error()).Fatal("Invalid DRAIN_DELAY")
+		}
 	}
+
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%s", port),
+		Handler: loggedRouter,
+	}
+	var redirectServer *http.Server
+	if tlsConfig != nil {
+		httpServer.TLSConfig = tlsConfig.TLSConfig
+		if tlsConfig.RedirectAddr != "" {
+			redirectServer = &http.Server{
+				Addr:    tlsConfig.RedirectAddr,
+				Handler: handlers.LoggingHandler(os.Stdout, tlsConfig.RedirectHandler),
+			}
+			go func() {
+				log.WithField("addr", redirectServer.Addr).Info("Redirecting HTTP to HTTPS")
+				err := redirectServer.ListenAndServe()
+				if err != nil && err != http.ErrServerClosed {
+					log.WithField("error", err.Error()).Fatal("Fatal error with HTTP redirect server")
+				}
+			}()
+		}
+	}
+	go func() {
+		// Wait for a shutdown signal, then drain before stopping the HTTP server
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.WithFields(log.Fields{
+			"signal":     sig.String(),
+			"drainDelay": drainDelay.String(),
+		}).Info("Shutdown signal received, draining.")
+		health.SetDraining()
+		time.Sleep(drainDelay)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if redirectServer != nil {
+			_ = redirectServer.Shutdown(ctx)
+		}
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.WithField("error", err.Error()).Warning("Error shutting down HTTP server")
+		}
+	}()
+
 	log.WithFields(log.Fields{
 		"port": port,
 	}).Info(fmt.Sprintf("==> Server listening on port %s 🚀", port))
 
-	err := http.ListenAndServe(fmt.Sprintf(":%s", port), loggedRouter)
-	if err != nil {
+	if tlsConfig != nil {
+		// Certificates come from the TLS config so no files are passed here
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.WithFields(log.Fields{
 			"error": err.Error(),
 		}).Fatal("Fatal error with HTTP server")
 	}
+	log.Info("Server stopped")
 }
@@ -0,0 +1,141 @@
+// Package metrics declares the Prometheus collectors exported by the server on
+// /metrics so we can see how much load meetings are putting on an instance.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "stack"
+
+var (
+	// ActiveMeetings is the number of meeting hubs currently in the HubPool.
+	ActiveMeetings = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_meetings",
+		Help:      "Number of meeting hubs currently active.",
+	})
+
+	// ConnectedClients is the number of websocket clients connected to meetings on this
+	// instance. It isn't labelled by meeting, since anyone who knows a meeting's ID can
+	// join it and /metrics isn't authenticated.
+	ConnectedClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connected_clients",
+		Help:      "Number of websocket clients connected to meetings.",
+	})
+
+	// ClientsPerMeeting samples the number of clients connected to each meeting on this
+	// instance every time the pruner runs.
+	ClientsPerMeeting = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "meeting_clients",
+		Help:      "Number of websocket clients connected to a meeting, sampled by the pruner.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 11),
+	})
+
+	// MessagesBroadcast counts messages fanned out by meeting hubs.
+	MessagesBroadcast = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_broadcast_total",
+		Help:      "Number of messages broadcast by meeting hubs.",
+	})
+
+	// ChangesCoalesced counts stack changes that were merged into the broadcast of an
+	// earlier change instead of being broadcast on their own.
+	ChangesCoalesced = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "changes_coalesced_total",
+		Help:      "Number of stack changes merged into another change's broadcast.",
+	})
+
+	// CompressedFrames counts websocket frames sent with permessage-deflate.
+	CompressedFrames = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_compressed_frames_total",
+		Help:      "Number of websocket frames sent compressed.",
+	})
+
+	// CompressionBytesSaved estimates the bytes saved by compressing websocket frames.
+	CompressionBytesSaved = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_compression_saved_bytes_total",
+		Help:      "Estimated number of bytes saved by compressing websocket frames.",
+	})
+
+	// DroppedClients counts slow clients disconnected because their send buffer kept
+	// filling up.
+	DroppedClients = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dropped_clients_total",
+		Help:      "Number of slow clients dropped because their send buffer was full.",
+	})
+
+	// DBOperationDuration tracks how long each database operation takes.
+	DBOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_operation_duration_seconds",
+		Help:      "Latency of database operations.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"operation"})
+
+	// PrunerRuns counts how many times the meeting pruner has run.
+	PrunerRuns = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pruner_runs_total",
+		Help:      "Number of times the meeting pruner has run.",
+	})
+
+	// MeetingsPruned counts meetings removed by the pruner by reason.
+	MeetingsPruned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "meetings_pruned_total",
+		Help:      "Number of meetings removed by the pruner.",
+	}, []string{"reason"})
+
+	// RateLimited counts requests rejected by a rate limit or cap, by limit.
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Number of requests rejected by rate limits and caps.",
+	}, []string{"limit"})
+
+	// SlowConsumerWarnings counts times a client's send buffer filled up and it was
+	// sent the latest stack instead of its stale messages.
+	SlowConsumerWarnings = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "slow_consumer_warnings_total",
+		Help:      "Number of times a slow client's stale messages were skipped.",
+	})
+
+	// WebhookDeliveries counts webhook deliveries by result: delivered, failed after
+	// every attempt or dropped because the delivery queue was full.
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Number of webhook deliveries by result.",
+	}, []string{"result"})
+
+	// UpgradeFailures counts websocket upgrades that failed.
+	UpgradeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_upgrade_failures_total",
+		Help:      "Number of failed websocket upgrade attempts.",
+	})
+)
+
+// ObserveDBOperation records the time since start against the named database
+// operation. It is meant to be deferred at the top of each db function.
+func ObserveDBOperation(operation string, start time.Time) {
+	DBOperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// Handler returns the HTTP handler that serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,190 @@
+// Package protocol holds the messages exchanged between the stack server and its
+// clients over the HTTP API and websockets, so that Go clients can share them with the
+// server instead of redefining them.
+package protocol
+
+// Websocket subprotocols. Clients that negotiate one of them receive revisioned
+// snapshot and patch messages in its encoding instead of the bare JSON array of the
+// stack after every change.
+const (
+	ProtocolV2        = "stack.v2"
+	ProtocolV2MsgPack = "stack.v2.msgpack"
+	ProtocolV2CBOR    = "stack.v2.cbor"
+)
+
+// Actions clients send to the server.
+const (
+	// ActionOn and ActionOff get the client on and off the stack.
+	ActionOn  = "on"
+	ActionOff = "off"
+
+	// ActionNext takes the current speaker off the stack so the next one can speak.
+	// Only the meeting's moderator may send it.
+	ActionNext = "next"
+
+	// ActionRemove takes the participant with the message's SpeakerId off the stack.
+	// Only the meeting's moderator may send it.
+	ActionRemove = "remove"
+
+	// ActionResync is sent by stack.v2 clients that missed a revision to ask for a
+	// fresh snapshot.
+	ActionResync = "resync"
+)
+
+// Message types sent to stack.v2 clients.
+const (
+	MessageSnapshot = "snapshot"
+	MessagePatch    = "patch"
+	MessageWelcome  = "welcome"
+)
+
+// Patch operations, applied by clients in order to their copy of the stack.
+const (
+	// OpInsert inserts User at the 1-based Position.
+	OpInsert = "insert"
+
+	// OpRemove removes the speaker with SpeakerId.
+	OpRemove = "remove"
+
+	// OpMove moves the speaker with SpeakerId to the 1-based Position.
+	OpMove = "move"
+
+	// OpCurrent sets the current speaker, the first on the stack, to SpeakerId. It is
+	// empty when the stack is empty.
+	OpCurrent = "current"
+)
+
+// User is a participant on the stack, the first of whom is speaking.
+type User struct {
+	SpeakerPostition int16  `json:"speakerPosition"`
+	SpeakerId        string `json:"speakerId"`
+	Name             string `json:"name"`
+}
+
+// ClientMessage is an action sent by a client over the websocket. TableId is ignored
+// by the server in favour of the meeting the client joined.
+type ClientMessage struct {
+	TableId   string
+	Action    string
+	Name      string
+	SpeakerId string
+}
+
+// PatchOp is a single change to the stack.
+type PatchOp struct {
+	Op        string `json:"op"`
+	Position  int    `json:"position,omitempty"`
+	SpeakerId string `json:"speakerId,omitempty"`
+	User      *User  `json:"user,omitempty"`
+}
+
+// StackMessage is the envelope sent to stack.v2 clients. Snapshots carry the whole
+// stack, which is left out when empty, and patches carry the operations that turn the
+// stack at the previous revision into the stack at Rev. Revisions are counted by each
+// instance, so clients reconnecting to a different instance start again from the
+// snapshot they are sent on joining.
+type StackMessage struct {
+	Type  string    `json:"type"`
+	Rev   uint64    `json:"rev"`
+	Stack []User    `json:"stack,omitempty"`
+	Ops   []PatchOp `json:"ops,omitempty"`
+}
+
+// Welcome is sent to stack.v2 clients when they join, with the token they can pass
+// back in the "resume" query parameter to keep their place after being disconnected
+// for being too slow.
+type Welcome struct {
+	Type        string `json:"type"`
+	ClientId    string `json:"clientId"`
+	ResumeToken string `json:"resumeToken"`
+}
+
+// Warning is sent to clients about problems that don't stop them using the meeting.
+type Warning struct {
+	Warning string `json:"warning"`
+}
+
+// Error is sent to clients when something they asked for failed, over the websocket
+// or as the body of an HTTP error response.
+type Error struct {
+	Error string `json:"error"`
+}
+
+// Meeting describes a meeting in HTTP API responses.
+type Meeting struct {
+	MeetingId   string `json:"meetingId"`
+	MeetingCode string `json:"meetingCode"`
+	Slug        string `json:"slug,omitempty"`
+
+	// Only returned to whoever created the meeting, who can pass it to GetWS to join as
+	// the moderator
+	ModeratorToken string `json:"moderatorToken,omitempty"`
+
+	// Only returned to whoever created the meeting with webhooks, so that their
+	// receivers can check deliveries are signed with it
+	WebhookSecret string `json:"webhookSecret,omitempty"`
+}
+
+// MeetingRequest is the optional JSON body accepted when creating a new meeting. The
+// pruning overrides are Go duration strings like "30m".
+type MeetingRequest struct {
+	Slug        string `json:"slug,omitempty"`
+	GracePeriod string `json:"gracePeriod,omitempty"`
+	IdleTimeout string `json:"idleTimeout,omitempty"`
+	MaxLifetime string `json:"maxLifetime,omitempty"`
+
+	// Webhooks are URLs the meeting's events are delivered to
+	Webhooks []string `json:"webhooks,omitempty"`
+}
+
+// ApplyPatch applies a patch message's operations to a copy of the stack, returning
+// the new stack.
+func ApplyPatch(stack []User, ops []PatchOp) []User {
+	result := append([]User(nil), stack...)
+	indexOf := func(speakerId string) int {
+		for i, user := range result {
+			if user.SpeakerId == speakerId {
+				return i
+			}
+		}
+		return -1
+	}
+	clamp := func(position int) int {
+		if position < 1 {
+			return 0
+		}
+		if position-1 > len(result) {
+			return len(result)
+		}
+		return position - 1
+	}
+
+	for _, op := range ops {
+		switch op.Op {
+		case OpInsert:
+			if op.User == nil {
+				continue
+			}
+			i := clamp(op.Position)
+			result = append(result, User{})
+			copy(result[i+1:], result[i:])
+			result[i] = *op.User
+		case OpRemove:
+			if i := indexOf(op.SpeakerId); i >= 0 {
+				result = append(result[:i], result[i+1:]...)
+			}
+		case OpMove:
+			i := indexOf(op.SpeakerId)
+			if i < 0 {
+				continue
+			}
+			user := result[i]
+			result = append(result[:i], result[i+1:]...)
+			j := clamp(op.Position)
+			result = append(result, User{})
+			copy(result[j+1:], result[j:])
+			result[j] = user
+		}
+	}
+	return result
+}
@@ -0,0 +1,195 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"stack-web-app/db"
+	"stack-web-app/events"
+)
+
+// Turn is one participant's turn at the top of the stack.
+type Turn struct {
+	SpeakerId string    `json:"speakerId"`
+	Name      string    `json:"name"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+
+	// Ongoing is true for the turn still in progress when the export was made, whose
+	// End is the time of the export.
+	Ongoing bool `json:"ongoing,omitempty"`
+}
+
+// Export is everything recorded about a meeting.
+type Export struct {
+	MeetingId string     `json:"meetingId"`
+	Events    []db.Event `json:"events"`
+	Timeline  []Turn     `json:"timeline"`
+}
+
+// Timeline lists the turns taken at the top of the stack in order. now ends a turn
+// still in progress if the meeting hasn't ended.
+func Timeline(meetingEvents []db.Event, now time.Time) []Turn {
+	turns := []Turn{}
+	current := -1
+	for _, event := range meetingEvents {
+		switch events.Type(event.Type) {
+		case events.SpeakingStarted:
+			turns = append(turns, Turn{SpeakerId: event.SpeakerId, Name: event.Name, Start: event.Time})
+			current = len(turns) - 1
+		case events.SpeakingEnded:
+			if current >= 0 && turns[current].SpeakerId == event.SpeakerId {
+				turns[current].End = event.Time
+				current = -1
+			}
+		case events.MeetingPruned:
+			now = event.Time
+		}
+	}
+	if current >= 0 {
+		turns[current].End = now
+		turns[current].Ongoing = true
+	}
+	return turns
+}
+
+// NewExport gathers the meeting's events and speaker timeline.
+func NewExport(meetingId string, meetingEvents []db.Event, now time.Time) Export {
+	return Export{
+		MeetingId: meetingId,
+		Events:    meetingEvents,
+		Timeline:  Timeline(meetingEvents, now),
+	}
+}
+
+// WriteJSON writes the export as a JSON document.
+func WriteJSON(w io.Writer, export Export) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(export)
+}
+
+// WriteCSV writes the meeting's events as CSV, one row per event with a header row.
+// Fields participants chose are escaped so that spreadsheets don't run them as
+// formulas.
+func WriteCSV(w io.Writer, export Export) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"id", "time", "type", "speakerId", "name", "actorId", "detail"})
+	if err != nil {
+		return err
+	}
+	for _, event := range export.Events {
+		err = writer.Write([]string{
+			strconv.FormatInt(event.Id, 10),
+			event.Time.UTC().Format(time.RFC3339),
+			event.Type,
+			csvText(event.SpeakerId),
+			csvText(event.Name),
+			csvText(event.ActorId),
+			csvText(event.Detail),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// csvText escapes a field that spreadsheets would take for a formula by prefixing it
+// with an apostrophe, which they show as text.
+func csvText(field string) string {
+	if field != "" && strings.ContainsRune("=+-@\t\r", rune(field[0])) {
+		return "'" + field
+	}
+	return field
+}
+
+// WriteMarkdown writes a minutes skeleton for note takers to fill in: the attendees
+// who got on the stack and a section for every turn in the order people spoke.
+func WriteMarkdown(w io.Writer, export Export) error {
+	var start, end time.Time
+	if len(export.Events) > 0 {
+		start = export.Events[0].Time
+		end = export.Events[len(export.Events)-1].Time
+	}
+	for _, turn := range export.Timeline {
+		if turn.End.After(end) {
+			end = turn.End
+		}
+	}
+
+	if _, err := fmt.Fprintf(w, "# Meeting minutes\n\n- Meeting: `%s`\n- Date: %s\n- Time: %s to %s UTC\n\n",
+		export.MeetingId, start.UTC().Format("2006-01-02"), start.UTC().Format("15:04"), end.UTC().Format("15:04")); err != nil {
+		return err
+	}
+
+	// Everyone who got on the stack, in the order they first did
+	if _, err := io.WriteString(w, "## Attendees\n\n"); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, event := range export.Events {
+		if events.Type(event.Type) != events.StackOn || seen[event.SpeakerId] {
+			continue
+		}
+		seen[event.SpeakerId] = true
+		if _, err := fmt.Fprintf(w, "- %s\n", displayName(event.Name, event.SpeakerId)); err != nil {
+			return err
+		}
+	}
+	if len(seen) == 0 {
+		if _, err := io.WriteString(w, "- _Nobody got on the stack._\n"); err != nil {
+			return err
+		}
+	}
+
+	if _, err := io.WriteString(w, "\n## Discussion\n"); err != nil {
+		return err
+	}
+	for _, turn := range export.Timeline {
+		_, err := fmt.Fprintf(w, "\n### %s %s (%s)\n\n- \n",
+			turn.Start.UTC().Format("15:04:05"),
+			displayName(turn.Name, turn.SpeakerId),
+			turn.End.Sub(turn.Start).Round(time.Second))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(w, "\n## Actions\n\n- \n")
+	return err
+}
+
+// displayName is the participant's name, or their ID if they never gave one, escaped
+// so that it can't add Markdown of its own.
+func displayName(name string, speakerId string) string {
+	if name != "" {
+		return markdownText(name)
+	}
+	return "`" + strings.ReplaceAll(singleLine(speakerId), "`", "") + "`"
+}
+
+// markdownReplacer backslash escapes the characters that have a meaning in Markdown.
+var markdownReplacer = func() *strings.Replacer {
+	var pairs []string
+	for _, c := range "\\`*_{}[]()<>#+-.!|~" {
+		pairs = append(pairs, string(c), "\\"+string(c))
+	}
+	return strings.NewReplacer(pairs...)
+}()
+
+// markdownText escapes text to be shown as it is in a Markdown line.
+func markdownText(text string) string {
+	return markdownReplacer.Replace(singleLine(text))
+}
+
+// singleLine replaces line breaks with spaces so that text can't start a new block.
+func singleLine(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
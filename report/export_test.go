@@ -0,0 +1,166 @@
+package report
+
+import (
+	"bytes"
+	"encoding/csv"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"stack-web-app/db"
+	"stack-web-app/events"
+)
+
+var start = time.Date(2021, 6, 1, 9, 0, 0, 0, time.UTC)
+
+// event is a meeting event the given number of seconds after start.
+func event(seconds int, eventType events.Type, speakerId string, name string) db.Event {
+	return db.Event{
+		Type:      string(eventType),
+		SpeakerId: speakerId,
+		Name:      name,
+		Time:      start.Add(time.Duration(seconds) * time.Second),
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	tests := []struct {
+		name   string
+		events []db.Event
+		now    time.Time
+		want   []Turn
+	}{
+		{"no events", nil, at(60), []Turn{}},
+		{"nobody spoke", []db.Event{event(0, events.MeetingCreated, "", "")}, at(60), []Turn{}},
+		{
+			"turns in order",
+			[]db.Event{
+				event(0, events.SpeakingStarted, "a", "Ada"),
+				event(30, events.SpeakingEnded, "a", "Ada"),
+				event(30, events.SpeakingStarted, "b", "Bo"),
+				event(45, events.SpeakingEnded, "b", "Bo"),
+			},
+			at(60),
+			[]Turn{
+				{SpeakerId: "a", Name: "Ada", Start: at(0), End: at(30)},
+				{SpeakerId: "b", Name: "Bo", Start: at(30), End: at(45)},
+			},
+		},
+		{
+			"ongoing turn ends now",
+			[]db.Event{event(10, events.SpeakingStarted, "a", "Ada")},
+			at(60),
+			[]Turn{{SpeakerId: "a", Name: "Ada", Start: at(10), End: at(60), Ongoing: true}},
+		},
+		{
+			"ongoing turn ends when the meeting was pruned",
+			[]db.Event{event(10, events.SpeakingStarted, "a", "Ada"), event(20, events.MeetingPruned, "", "")},
+			at(60),
+			[]Turn{{SpeakerId: "a", Name: "Ada", Start: at(10), End: at(20), Ongoing: true}},
+		},
+		{
+			"end for someone else is ignored",
+			[]db.Event{event(0, events.SpeakingStarted, "a", "Ada"), event(5, events.SpeakingEnded, "b", "Bo")},
+			at(60),
+			[]Turn{{SpeakerId: "a", Name: "Ada", Start: at(0), End: at(60), Ongoing: true}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Timeline(test.events, test.now); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Timeline() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	meetingEvents := []db.Event{
+		event(0, events.StackOn, "a", "Ada"),
+		event(1, events.StackOn, "b", "=HYPERLINK(\"http://example.com\")"),
+		event(2, events.StackRemoved, "b", "+1"),
+		{Type: string(events.StackRemoved), SpeakerId: "@b", ActorId: "-a", Detail: "\tx", Time: start},
+		event(3, events.StackOn, "c", "\rC"),
+	}
+	meetingEvents[2].Id = 3
+	var buffer bytes.Buffer
+	if err := WriteCSV(&buffer, NewExport("meeting", meetingEvents, start)); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buffer).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"id", "time", "type", "speakerId", "name", "actorId", "detail"},
+		{"0", "2021-06-01T09:00:00Z", "stack.on", "a", "Ada", "", ""},
+		{"0", "2021-06-01T09:00:01Z", "stack.on", "b", "'=HYPERLINK(\"http://example.com\")", "", ""},
+		{"3", "2021-06-01T09:00:02Z", "stack.removed", "b", "'+1", "", ""},
+		{"0", "2021-06-01T09:00:00Z", "stack.removed", "'@b", "", "'-a", "'\tx"},
+		{"0", "2021-06-01T09:00:03Z", "stack.on", "c", "'\rC", "", ""},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("CSV rows = %q, want %q", rows, want)
+	}
+}
+
+func TestWriteMarkdown(t *testing.T) {
+	meetingEvents := []db.Event{
+		event(0, events.MeetingCreated, "", ""),
+		event(5, events.StackOn, "a", "Ada"),
+		event(6, events.StackOn, "b", "# Bo\n- [click](http://example.com)"),
+		event(7, events.StackOn, "c`c", ""),
+		event(7, events.SpeakingStarted, "a", "Ada"),
+		event(67, events.SpeakingEnded, "a", "Ada"),
+		event(67, events.SpeakingStarted, "b", "# Bo\n- [click](http://example.com)"),
+		event(97, events.SpeakingEnded, "b", "# Bo\n- [click](http://example.com)"),
+		event(100, events.StackOn, "a", "Ada"),
+	}
+	var buffer bytes.Buffer
+	if err := WriteMarkdown(&buffer, NewExport("meeting", meetingEvents, start.Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"# Meeting minutes",
+		"",
+		"- Meeting: `meeting`",
+		"- Date: 2021-06-01",
+		"- Time: 09:00 to 09:01 UTC",
+		"",
+		"## Attendees",
+		"",
+		"- Ada",
+		"- \\# Bo \\- \\[click\\]\\(http://example\\.com\\)",
+		"- `cc`",
+		"",
+		"## Discussion",
+		"",
+		"### 09:00:07 Ada (1m0s)",
+		"",
+		"- ",
+		"",
+		"### 09:01:07 \\# Bo \\- \\[click\\]\\(http://example\\.com\\) (30s)",
+		"",
+		"- ",
+		"",
+		"## Actions",
+		"",
+		"- ",
+		"",
+	}, "\n")
+	if got := buffer.String(); got != want {
+		t.Errorf("WriteMarkdown() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteMarkdownWithoutSpeakers(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := WriteMarkdown(&buffer, NewExport("meeting", nil, start)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buffer.String(), "- _Nobody got on the stack._") {
+		t.Errorf("WriteMarkdown() = %q, want a note that nobody got on the stack", buffer.String())
+	}
+}
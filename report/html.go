@@ -0,0 +1,75 @@
+package report
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"time"
+)
+
+// page renders a report as a standalone HTML page.
+var page = template.Must(template.New("report").Funcs(template.FuncMap{
+	"duration": formatSeconds,
+	"time":     func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05 MST") },
+	"percent":  func(f float64) string { return fmt.Sprintf("%.0f%%", f*100) },
+	"share":    func(part, total float64) float64 { return part / total },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Participation report</title>
+  <style>
+    body { font-family: sans-serif; margin: 2rem; color: #222; }
+    table { border-collapse: collapse; margin-top: 1rem; }
+    th, td { border: 1px solid #ccc; padding: 0.4rem 0.8rem; text-align: right; }
+    th:first-child, td:first-child { text-align: left; }
+  </style>
+</head>
+<body>
+  <h1>Participation report</h1>
+  <p>Meeting <code>{{.MeetingId}}</code>, {{time .Start}} to {{time .End}}{{if not .Ended}} (still running){{end}}.</p>
+  <p>Total speaking time {{duration .Fairness.TotalSpeakingSeconds}}, Gini coefficient {{printf "%.2f" .Fairness.Gini}}
+    (0 when speaking time was shared evenly, approaching 1 when one person did all the talking).</p>
+  {{if .Participants}}
+  <table>
+    <thead>
+      <tr>
+        <th>Participant</th>
+        <th>Times on stack</th>
+        <th>Turns</th>
+        <th>Total speaking</th>
+        <th>Share</th>
+        <th>Average speaking</th>
+        <th>Average wait</th>
+      </tr>
+    </thead>
+    <tbody>
+      {{range .Participants}}
+      <tr>
+        <td>{{if .Name}}{{.Name}}{{else}}<code>{{.SpeakerId}}</code>{{end}}</td>
+        <td>{{.TimesOnStack}}</td>
+        <td>{{.Turns}}</td>
+        <td>{{duration .TotalSpeakingSeconds}}</td>
+        <td>{{if $.Fairness.TotalSpeakingSeconds}}{{percent (share .TotalSpeakingSeconds $.Fairness.TotalSpeakingSeconds)}}{{else}}-{{end}}</td>
+        <td>{{duration .AverageSpeakingSeconds}}</td>
+        <td>{{duration .AverageWaitSeconds}}</td>
+      </tr>
+      {{end}}
+    </tbody>
+  </table>
+  {{else}}
+  <p>Nobody got on the stack.</p>
+  {{end}}
+</body>
+</html>
+`))
+
+// WriteHTML renders the report as an HTML page.
+func WriteHTML(w io.Writer, report Report) error {
+	return page.Execute(w, report)
+}
+
+// formatSeconds formats a number of seconds like "1m05s".
+func formatSeconds(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+}
@@ -0,0 +1,151 @@
+// Package report turns a meeting's event log into a participation report: how often
+// each participant got on the stack, how long they spoke and waited, and how evenly
+// speaking time was shared.
+package report
+
+import (
+	"sort"
+	"time"
+
+	"stack-web-app/db"
+	"stack-web-app/events"
+)
+
+// Report summarises participation in a meeting. Durations are in seconds.
+type Report struct {
+	MeetingId string    `json:"meetingId"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+
+	// Ended is false while the meeting is still running, in which case End is the
+	// time the report was built and anyone still speaking is counted up to then.
+	Ended bool `json:"ended"`
+
+	Participants []Participant `json:"participants"`
+	Fairness     Fairness      `json:"fairness"`
+}
+
+// Participant is the participation of one person in the meeting, identified by the
+// client ID they joined with.
+type Participant struct {
+	SpeakerId    string `json:"speakerId"`
+	Name         string `json:"name"`
+	TimesOnStack int    `json:"timesOnStack"`
+	Turns        int    `json:"turns"`
+
+	TotalSpeakingSeconds   float64 `json:"totalSpeakingSeconds"`
+	AverageSpeakingSeconds float64 `json:"averageSpeakingSeconds"`
+
+	// AverageWaitSeconds is the average time from getting on the stack to reaching
+	// the top of it, over the turns the participant actually got.
+	AverageWaitSeconds float64 `json:"averageWaitSeconds"`
+}
+
+// Fairness describes how evenly speaking time was shared between everyone who got on
+// the stack.
+type Fairness struct {
+	TotalSpeakingSeconds float64 `json:"totalSpeakingSeconds"`
+
+	// Gini is the Gini coefficient of speaking time, 0 when everyone spoke for as
+	// long as each other and approaching 1 when one person did all the talking.
+	Gini float64 `json:"gini"`
+}
+
+// participant accumulates a participant's events while the report is built.
+type participant struct {
+	Participant
+	firstSeen     time.Time
+	onSince       time.Time
+	speakingSince time.Time
+	totalSpeaking time.Duration
+	totalWait     time.Duration
+}
+
+// Build computes the report for a meeting from its event log, oldest event first. now
+// closes off anything still in progress if the meeting hasn't ended.
+func Build(meetingId string, meetingEvents []db.Event, now time.Time) Report {
+	report := Report{MeetingId: meetingId, Start: now, End: now, Participants: []Participant{}}
+	if len(meetingEvents) > 0 {
+		report.Start = meetingEvents[0].Time
+	}
+
+	participants := map[string]*participant{}
+	get := func(event db.Event) *participant {
+		p, ok := participants[event.SpeakerId]
+		if !ok {
+			p = &participant{firstSeen: event.Time}
+			p.SpeakerId = event.SpeakerId
+			participants[event.SpeakerId] = p
+		}
+		if event.Name != "" {
+			p.Name = event.Name
+		}
+		return p
+	}
+
+	for _, event := range meetingEvents {
+		switch events.Type(event.Type) {
+		case events.StackOn:
+			p := get(event)
+			p.TimesOnStack++
+			p.onSince = event.Time
+		case events.SpeakingStarted:
+			p := get(event)
+			p.Turns++
+			p.speakingSince = event.Time
+			if !p.onSince.IsZero() {
+				p.totalWait += event.Time.Sub(p.onSince)
+				p.onSince = time.Time{}
+			}
+		case events.SpeakingEnded:
+			p := get(event)
+			if !p.speakingSince.IsZero() {
+				p.totalSpeaking += event.Time.Sub(p.speakingSince)
+				p.speakingSince = time.Time{}
+			}
+		case events.MeetingPruned:
+			report.End = event.Time
+			report.Ended = true
+		}
+	}
+
+	speaking := make([]float64, 0, len(participants))
+	for _, p := range participants {
+		if !p.speakingSince.IsZero() {
+			p.totalSpeaking += report.End.Sub(p.speakingSince)
+		}
+		if p.TimesOnStack == 0 && p.Turns == 0 {
+			continue
+		}
+		p.TotalSpeakingSeconds = p.totalSpeaking.Seconds()
+		if p.Turns > 0 {
+			p.AverageSpeakingSeconds = p.totalSpeaking.Seconds() / float64(p.Turns)
+			p.AverageWaitSeconds = p.totalWait.Seconds() / float64(p.Turns)
+		}
+		report.Participants = append(report.Participants, p.Participant)
+		report.Fairness.TotalSpeakingSeconds += p.TotalSpeakingSeconds
+		speaking = append(speaking, p.TotalSpeakingSeconds)
+	}
+	sort.SliceStable(report.Participants, func(i, j int) bool {
+		return participants[report.Participants[i].SpeakerId].firstSeen.Before(participants[report.Participants[j].SpeakerId].firstSeen)
+	})
+	report.Fairness.Gini = Gini(speaking)
+	return report
+}
+
+// Gini returns the Gini coefficient of the values, or 0 if there are none or they are
+// all zero.
+func Gini(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	var sum, weighted float64
+	for i, value := range sorted {
+		sum += value
+		weighted += float64(i+1) * value
+	}
+	if len(sorted) == 0 || sum == 0 {
+		return 0
+	}
+	n := float64(len(sorted))
+	return 2*weighted/(n*sum) - (n+1)/n
+}
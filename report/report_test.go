@@ -0,0 +1,155 @@
+package report
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"stack-web-app/db"
+	"stack-web-app/events"
+)
+
+func TestGini(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		want   float64
+	}{
+		{"nobody", nil, 0},
+		{"one speaker", []float64{42}, 0},
+		{"all silent", []float64{0, 0, 0}, 0},
+		{"equal shares", []float64{30, 30, 30, 30}, 0},
+		{"unequal shares", []float64{3, 1}, 0.25},
+		{"one did all the talking", []float64{0, 10, 0}, 2.0 / 3},
+		{"order doesn't matter", []float64{90, 30}, 0.25},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Gini(test.values); math.Abs(got-test.want) > 1e-9 {
+				t.Errorf("Gini(%v) = %v, want %v", test.values, got, test.want)
+			}
+		})
+	}
+}
+
+func TestBuild(t *testing.T) {
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	tests := []struct {
+		name   string
+		events []db.Event
+		now    time.Time
+		want   Report
+	}{
+		{
+			"no speakers",
+			[]db.Event{event(0, events.MeetingCreated, "", "")},
+			at(60),
+			Report{Start: at(0), End: at(60), Participants: []Participant{}},
+		},
+		{
+			"one speaker still speaking",
+			[]db.Event{
+				event(0, events.MeetingCreated, "", ""),
+				event(10, events.StackOn, "a", "Ada"),
+				event(15, events.SpeakingStarted, "a", "Ada"),
+			},
+			at(75),
+			Report{
+				Start: at(0),
+				End:   at(75),
+				Participants: []Participant{
+					{SpeakerId: "a", Name: "Ada", TimesOnStack: 1, Turns: 1,
+						TotalSpeakingSeconds: 60, AverageSpeakingSeconds: 60, AverageWaitSeconds: 5},
+				},
+				Fairness: Fairness{TotalSpeakingSeconds: 60},
+			},
+		},
+		{
+			"equal shares",
+			[]db.Event{
+				event(0, events.StackOn, "a", "Ada"),
+				event(0, events.SpeakingStarted, "a", "Ada"),
+				event(1, events.StackOn, "b", "Bo"),
+				event(30, events.SpeakingEnded, "a", "Ada"),
+				event(30, events.SpeakingStarted, "b", "Bo"),
+				event(60, events.SpeakingEnded, "b", "Bo"),
+				event(90, events.MeetingPruned, "", ""),
+			},
+			at(300),
+			Report{
+				Start: at(0),
+				End:   at(90),
+				Ended: true,
+				Participants: []Participant{
+					{SpeakerId: "a", Name: "Ada", TimesOnStack: 1, Turns: 1,
+						TotalSpeakingSeconds: 30, AverageSpeakingSeconds: 30},
+					{SpeakerId: "b", Name: "Bo", TimesOnStack: 1, Turns: 1,
+						TotalSpeakingSeconds: 30, AverageSpeakingSeconds: 30, AverageWaitSeconds: 29},
+				},
+				Fairness: Fairness{TotalSpeakingSeconds: 60},
+			},
+		},
+		{
+			"unequal shares over several turns",
+			[]db.Event{
+				event(0, events.StackOn, "a", "Ada"),
+				event(0, events.SpeakingStarted, "a", "Ada"),
+				event(10, events.StackOn, "b", "Bo"),
+				event(60, events.SpeakingEnded, "a", "Ada"),
+				event(60, events.SpeakingStarted, "b", "Bo"),
+				event(90, events.SpeakingEnded, "b", "Bo"),
+				event(100, events.StackOn, "a", "Ada"),
+				event(120, events.SpeakingStarted, "a", "Ada"),
+				event(150, events.MeetingPruned, "", ""),
+			},
+			at(300),
+			Report{
+				Start: at(0),
+				End:   at(150),
+				Ended: true,
+				Participants: []Participant{
+					{SpeakerId: "a", Name: "Ada", TimesOnStack: 2, Turns: 2,
+						TotalSpeakingSeconds: 90, AverageSpeakingSeconds: 45, AverageWaitSeconds: 10},
+					{SpeakerId: "b", Name: "Bo", TimesOnStack: 1, Turns: 1,
+						TotalSpeakingSeconds: 30, AverageSpeakingSeconds: 30, AverageWaitSeconds: 50},
+				},
+				Fairness: Fairness{TotalSpeakingSeconds: 120, Gini: 0.25},
+			},
+		},
+		{
+			"never reached the top",
+			[]db.Event{
+				event(0, events.StackOn, "a", "Ada"),
+				event(0, events.SpeakingStarted, "a", "Ada"),
+				event(5, events.StackOn, "b", "Bo"),
+				event(20, events.StackOff, "b", "Bo"),
+				event(60, events.SpeakingEnded, "a", "Ada"),
+				event(70, events.ParticipantJoined, "c", ""),
+			},
+			at(100),
+			Report{
+				Start: at(0),
+				End:   at(100),
+				Participants: []Participant{
+					{SpeakerId: "a", Name: "Ada", TimesOnStack: 1, Turns: 1,
+						TotalSpeakingSeconds: 60, AverageSpeakingSeconds: 60},
+					{SpeakerId: "b", Name: "Bo", TimesOnStack: 1},
+				},
+				Fairness: Fairness{TotalSpeakingSeconds: 60, Gini: 0.5},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.want.MeetingId = "meeting"
+			got := Build("meeting", test.events, test.now)
+			if math.Abs(got.Fairness.Gini-test.want.Fairness.Gini) < 1e-9 {
+				got.Fairness.Gini = test.want.Fairness.Gini
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Build() = %+v\nwant %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"stack-web-app/client"
+	"stack-web-app/db"
+	"stack-web-app/protocol"
+	"stack-web-app/server"
+	"stack-web-app/wshandler"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// waitTimeout is how long a test waits for the server to reach an expected state.
+const waitTimeout = 10 * time.Second
+
+// serverURL is the base URL of the server every test talks to.
+var serverURL string
+
+// TestMain serves the full router from an in-process server backed by an in-memory
+// database, with the pruner running often enough for tests to watch it work.
+func TestMain(m *testing.M) {
+	log.SetLevel(log.WarnLevel)
+	if err := db.StartInMemory(); err != nil {
+		fmt.Fprintln(os.Stderr, "starting in-memory database:", err)
+		os.Exit(1)
+	}
+	stopAuditLog := wshandler.StartAuditLog()
+
+	// Simulated clients all come from one address and act much faster than people
+	wshandler.DefaultLimits = wshandler.Limits{
+		ActionsPerSecond:  1000,
+		ActionBurst:       1000,
+		MeetingsPerMinute: 60000,
+		MeetingBurst:      1000,
+	}
+	wshandler.PruneInterval = 20 * time.Millisecond
+	pruneCtx, stopPruner := context.WithCancel(context.Background())
+	go wshandler.PruneMeetings(pruneCtx)
+
+	testServer := httptest.NewServer(server.NewRouter(server.Options{}))
+	serverURL = testServer.URL
+	code := m.Run()
+	testServer.Close()
+	stopPruner()
+	stopAuditLog()
+	os.Exit(code)
+}
+
+// createMeeting creates a meeting, failing the test if that doesn't work.
+func createMeeting(t *testing.T, request protocol.MeetingRequest) protocol.Meeting {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	meeting, err := client.Create(ctx, serverURL, request, nil)
+	if err != nil {
+		t.Fatalf("creating meeting: %v", err)
+	}
+	return meeting
+}
+
+// joinClients connects n participants named "participant-<i>" to the meeting
+// concurrently. They are closed when the test ends unless the test closes them first.
+func joinClients(t *testing.T, meetingRef string, n int, options client.Options) []*client.Meeting {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+
+	participants := make([]*client.Meeting, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range participants {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			options := options
+			if options.Name == "" {
+				options.Name = fmt.Sprintf("participant-%d", i)
+			}
+			if options.OnError == nil {
+				options.OnError = func(err error) {
+					t.Logf("participant %d: %v", i, err)
+				}
+			}
+			participants[i], errs[i] = client.Join(ctx, serverURL, meetingRef, options)
+		}(i)
+	}
+	wg.Wait()
+	for i, participant := range participants {
+		if participant != nil {
+			t.Cleanup(func() { participant.Close() })
+		}
+		if errs[i] != nil {
+			t.Fatalf("joining participant %d: %v", i, errs[i])
+		}
+	}
+	return participants
+}
+
+// waitForStack waits until the participant's copy of the stack satisfies the
+// condition, failing the test with the last stack seen if it never does.
+func waitForStack(t *testing.T, participant *client.Meeting, condition func(client.Stack) bool) client.Stack {
+	t.Helper()
+	changed := make(chan struct{}, 1)
+	unsubscribe := participant.Subscribe(func(client.Stack) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	timeout := time.NewTimer(waitTimeout)
+	defer timeout.Stop()
+	for {
+		stack := participant.Stack()
+		if condition(stack) {
+			return stack
+		}
+		select {
+		case <-changed:
+		case <-participant.Done():
+			t.Fatalf("participant disconnected waiting for the stack: %v", participant.Err())
+		case <-timeout.C:
+			t.Fatalf("timed out waiting for the stack, last saw %s", speakerIds(stack))
+		}
+	}
+}
+
+// waitForCondition polls the condition until it holds, failing the test if it
+// doesn't in time.
+func waitForCondition(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// speakerIds lists the speaker IDs on the stack in order.
+func speakerIds(stack client.Stack) []string {
+	ids := make([]string, len(stack))
+	for i, user := range stack {
+		ids[i] = user.SpeakerId
+	}
+	return ids
+}
+
+// hasLength returns a stack condition matching stacks of exactly n speakers.
+func hasLength(n int) func(client.Stack) bool {
+	return func(stack client.Stack) bool { return len(stack) == n }
+}
+
+// assertConverged checks that every participant ended up with the same stack.
+func assertConverged(t *testing.T, participants []*client.Meeting, want []string) {
+	t.Helper()
+	for i, participant := range participants {
+		stack := waitForStack(t, participant, hasLength(len(want)))
+		if got := speakerIds(stack); !reflect.DeepEqual(got, want) {
+			t.Errorf("participant %d has stack %v, want %v", i, got, want)
+		}
+	}
+}
+
+// getJSON decodes the JSON response to a GET request, returning the status code.
+func getJSON(t *testing.T, path string, v interface{}) int {
+	t.Helper()
+	response, err := http.Get(serverURL + path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusOK && v != nil {
+		if err = json.NewDecoder(response.Body).Decode(v); err != nil {
+			t.Fatalf("decoding GET %s: %v", path, err)
+		}
+	}
+	return response.StatusCode
+}
@@ -0,0 +1,78 @@
+// Package server builds the HTTP router serving the stack API, websockets and
+// frontend, so that the same routes can be served by main and by tests.
+package server
+
+import (
+	"net/http"
+
+	"stack-web-app/chatbot"
+	"stack-web-app/health"
+	"stack-web-app/logging"
+	"stack-web-app/metrics"
+	"stack-web-app/tracing"
+	"stack-web-app/webhook"
+	"stack-web-app/wshandler"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+)
+
+// Options choose the optional parts of the router.
+type Options struct {
+	// Webhooks serves the delivery log of every meeting under /admin/webhooks if set.
+	Webhooks *webhook.Dispatcher
+
+	// ChatSecret and SlackSigningSecret enable the chat command integrations.
+	ChatSecret         string
+	SlackSigningSecret string
+
+	// Frontend serves the web app under / if set, in which case only websocket
+	// upgrades on / go to the old websocket endpoint.
+	Frontend http.Handler
+}
+
+// NewRouter builds the router with every route the server serves.
+func NewRouter(options Options) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(otelmux.Middleware(tracing.ServiceName))
+	router.Use(logging.Middleware)
+	router.HandleFunc("/ws", wshandler.GetWS).Methods("GET")
+	router.HandleFunc("/api/meetings", wshandler.PostWS).Methods("POST")
+	router.HandleFunc("/api/meetings/{meetingId}", wshandler.GetMeeting).Methods("GET")
+	router.HandleFunc("/api/meetings/{meetingId}/events", wshandler.GetMeetingEvents).Methods("GET")
+	router.HandleFunc("/api/meetings/{meetingId}/report", wshandler.GetMeetingReport).Methods("GET")
+	router.HandleFunc("/api/meetings/{meetingId}/export", wshandler.GetMeetingExport).Methods("GET")
+	router.HandleFunc("/api/meetings/{meetingId}/webhooks", wshandler.GetMeetingWebhooks).Methods("GET")
+	router.Handle("/metrics", metrics.Handler()).Methods("GET")
+	bot := chatbot.NewBot()
+	if options.ChatSecret != "" {
+		router.HandleFunc("/integrations/chat", bot.Handler(chatbot.NewGeneric(options.ChatSecret))).Methods("POST")
+	}
+	if options.SlackSigningSecret != "" {
+		router.HandleFunc("/integrations/slack", bot.Handler(chatbot.NewSlack(options.SlackSigningSecret))).Methods("POST")
+	}
+	router.HandleFunc("/admin/loglevel", logging.LevelHandler).Methods("GET", "PUT")
+	if options.Webhooks != nil {
+		router.HandleFunc("/admin/webhooks", options.Webhooks.AdminHandler).Methods("GET")
+	}
+	router.HandleFunc("/healthz", health.Healthz).Methods("GET")
+	router.HandleFunc("/readyz", health.Readyz).Methods("GET")
+	router.HandleFunc("/debug/status", health.DebugStatus).Methods("GET")
+
+	// Keep the original endpoints working for existing clients
+	router.HandleFunc("/", wshandler.PostWS).Methods("POST")
+	router.HandleFunc("/meetings/{meetingId}", wshandler.GetMeeting).Methods("GET")
+
+	// Serve the frontend under / if enabled, in which case only websocket upgrades on
+	// / go to the old websocket endpoint
+	if options.Frontend != nil {
+		router.HandleFunc("/", wshandler.GetWS).Methods("GET").MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			return websocket.IsWebSocketUpgrade(r)
+		})
+		router.PathPrefix("/").Handler(options.Frontend).Methods("GET", "HEAD")
+	} else {
+		router.HandleFunc("/", wshandler.GetWS).Methods("GET")
+	}
+	return router
+}
@@ -0,0 +1,257 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"stack-web-app/client"
+	"stack-web-app/db"
+	"stack-web-app/events"
+	"stack-web-app/protocol"
+)
+
+// TestBroadcastConvergence has many participants get on the stack at once and checks
+// that they all end up seeing the same stack.
+func TestBroadcastConvergence(t *testing.T) {
+	meeting := createMeeting(t, protocol.MeetingRequest{})
+	participants := joinClients(t, meeting.MeetingId, 50, client.Options{})
+
+	var wg sync.WaitGroup
+	for _, participant := range participants {
+		wg.Add(1)
+		go func(participant *client.Meeting) {
+			defer wg.Done()
+			if err := participant.GetOnStack(); err != nil {
+				t.Errorf("getting on the stack: %v", err)
+			}
+		}(participant)
+	}
+	wg.Wait()
+
+	want := speakerIds(waitForStack(t, participants[0], hasLength(len(participants))))
+	assertConverged(t, participants, want)
+
+	// Everyone is on the stack exactly once
+	seen := map[string]bool{}
+	for _, speakerId := range want {
+		seen[speakerId] = true
+	}
+	for i, participant := range participants {
+		if !seen[participant.ClientId()] {
+			t.Errorf("participant %d is missing from the stack", i)
+		}
+	}
+}
+
+// TestStackOrdering checks that the stack keeps the order people got on it in, and
+// that moderation and getting off the stack keep everyone else's order.
+func TestStackOrdering(t *testing.T) {
+	meeting := createMeeting(t, protocol.MeetingRequest{})
+	moderator := joinClients(t, meeting.MeetingId, 1, client.Options{ModeratorToken: meeting.ModeratorToken})[0]
+	participants := joinClients(t, meeting.MeetingId, 10, client.Options{})
+
+	var want []string
+	for _, participant := range participants {
+		if err := participant.GetOnStack(); err != nil {
+			t.Fatalf("getting on the stack: %v", err)
+		}
+		want = append(want, participant.ClientId())
+		waitForStack(t, moderator, hasLength(len(want)))
+	}
+	assertConverged(t, append(participants, moderator), want)
+
+	// Next takes the first speaker off, the second starts speaking
+	if err := moderator.Next(); err != nil {
+		t.Fatalf("moving to the next speaker: %v", err)
+	}
+	want = want[1:]
+	assertConverged(t, append(participants, moderator), want)
+	if current, _ := moderator.Stack().Current(); current.SpeakerId != participants[1].ClientId() {
+		t.Errorf("current speaker is %q, want %q", current.SpeakerId, participants[1].ClientId())
+	}
+
+	// Getting off and removing someone from the middle keeps the others in order
+	if err := participants[4].GetOffStack(); err != nil {
+		t.Fatalf("getting off the stack: %v", err)
+	}
+	if err := moderator.Remove(participants[7].ClientId()); err != nil {
+		t.Fatalf("removing a speaker: %v", err)
+	}
+	want = []string{
+		participants[1].ClientId(), participants[2].ClientId(), participants[3].ClientId(),
+		participants[5].ClientId(), participants[6].ClientId(), participants[8].ClientId(),
+		participants[9].ClientId(),
+	}
+	assertConverged(t, append(participants, moderator), want)
+
+	// Getting back on goes to the end of the stack
+	if err := participants[4].GetOnStack(); err != nil {
+		t.Fatalf("getting on the stack: %v", err)
+	}
+	want = append(want, participants[4].ClientId())
+	assertConverged(t, append(participants, moderator), want)
+}
+
+// TestModeratorOnly checks that participants without the moderator token can't move
+// the stack on.
+func TestModeratorOnly(t *testing.T) {
+	meeting := createMeeting(t, protocol.MeetingRequest{})
+	errs := make(chan error, 1)
+	participant := joinClients(t, meeting.MeetingId, 1, client.Options{
+		OnError: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})[0]
+	if err := participant.GetOnStack(); err != nil {
+		t.Fatalf("getting on the stack: %v", err)
+	}
+	waitForStack(t, participant, hasLength(1))
+	if err := participant.Next(); err != nil {
+		t.Fatalf("sending next: %v", err)
+	}
+
+	// The server answers with an error and leaves the stack alone
+	select {
+	case err := <-errs:
+		var serverError client.ServerError
+		if !errors.As(err, &serverError) {
+			t.Errorf("got error %v, want a ServerError", err)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("timed out waiting for the server to reject next")
+	}
+	if stack := participant.Stack(); len(stack) != 1 {
+		t.Errorf("stack has %d speakers after a rejected next, want 1", len(stack))
+	}
+}
+
+// TestDisconnectCleanup checks that participants who disconnect are taken off the
+// stack for everyone still in the meeting.
+func TestDisconnectCleanup(t *testing.T) {
+	meeting := createMeeting(t, protocol.MeetingRequest{})
+	participants := joinClients(t, meeting.MeetingId, 20, client.Options{})
+	var want []string
+	for _, participant := range participants {
+		if err := participant.GetOnStack(); err != nil {
+			t.Fatalf("getting on the stack: %v", err)
+		}
+		want = append(want, participant.ClientId())
+		waitForStack(t, participants[0], hasLength(len(want)))
+	}
+
+	// Every other participant leaves at the same time
+	var wg sync.WaitGroup
+	var staying []*client.Meeting
+	want = want[:0]
+	for i, participant := range participants {
+		if i%2 == 0 {
+			staying = append(staying, participant)
+			want = append(want, participant.ClientId())
+			continue
+		}
+		wg.Add(1)
+		go func(participant *client.Meeting) {
+			defer wg.Done()
+			participant.Close()
+		}(participant)
+	}
+	wg.Wait()
+	assertConverged(t, staying, want)
+
+	// The departures are in the meeting's event log
+	waitForCondition(t, "the departures to be logged", func() bool {
+		var log struct {
+			Events []db.Event `json:"events"`
+		}
+		getJSON(t, "/api/meetings/"+meeting.MeetingId+"/events", &log)
+		left := 0
+		for _, event := range log.Events {
+			if event.Type == string(events.ParticipantLeft) {
+				left++
+			}
+		}
+		return left == len(participants)-len(staying)
+	})
+}
+
+// TestPruning checks that meetings are pruned once everyone has left and stayed away
+// for the idle timeout, but not while anyone is still connected.
+func TestPruning(t *testing.T) {
+	request := protocol.MeetingRequest{GracePeriod: "300ms", IdleTimeout: "100ms"}
+	idle := createMeeting(t, request)
+	busy := createMeeting(t, request)
+	participants := joinClients(t, idle.MeetingId, 5, client.Options{})
+	staying := joinClients(t, busy.MeetingId, 1, client.Options{})[0]
+	for _, participant := range participants {
+		if err := participant.GetOnStack(); err != nil {
+			t.Fatalf("getting on the stack: %v", err)
+		}
+	}
+	waitForStack(t, participants[0], hasLength(len(participants)))
+
+	// Still around while people are connected, even past the grace period and idle
+	// timeout
+	time.Sleep(500 * time.Millisecond)
+	if status := getJSON(t, "/api/meetings/"+idle.MeetingId, nil); status != 200 {
+		t.Fatalf("meeting with participants was pruned, got status %d", status)
+	}
+
+	for _, participant := range participants {
+		participant.Close()
+	}
+	waitForCondition(t, "the idle meeting to be pruned", func() bool {
+		return getJSON(t, "/api/meetings/"+idle.MeetingId, nil) == 404
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	if _, err := client.GetMeeting(ctx, serverURL, idle.MeetingCode, nil); !errors.Is(err, client.ErrMeetingNotFound) {
+		t.Errorf("looking up the pruned meeting by code returned %v, want ErrMeetingNotFound", err)
+	}
+
+	// The event log outlives the meeting and says why it went
+	waitForCondition(t, "the pruning to be logged", func() bool {
+		var log struct {
+			Events []db.Event `json:"events"`
+		}
+		getJSON(t, "/api/meetings/"+idle.MeetingId+"/events", &log)
+		for _, event := range log.Events {
+			if event.Type == string(events.MeetingPruned) {
+				return event.Detail == "idle_timeout"
+			}
+		}
+		return false
+	})
+
+	// The meeting someone stayed in is untouched
+	if status := getJSON(t, "/api/meetings/"+busy.MeetingId, nil); status != 200 {
+		t.Errorf("meeting with a participant was pruned, got status %d", status)
+	}
+	select {
+	case <-staying.Done():
+		t.Errorf("participant of the busy meeting was disconnected: %v", staying.Err())
+	default:
+	}
+}
+
+// TestEventLogOnlyByMeetingId checks that the event log, report and export, which name
+// everyone in the meeting, can't be fetched by the guessable meeting code or slug.
+func TestEventLogOnlyByMeetingId(t *testing.T) {
+	meeting := createMeeting(t, protocol.MeetingRequest{Slug: "event-log-by-id"})
+	for _, path := range []string{"/events", "/report", "/export"} {
+		if status := getJSON(t, "/api/meetings/"+meeting.MeetingId+path, nil); status != 200 {
+			t.Errorf("GET %s by meeting ID returned %d, want 200", path, status)
+		}
+		for _, ref := range []string{meeting.MeetingCode, "event-log-by-id", strings.ToUpper(meeting.MeetingId)} {
+			if status := getJSON(t, "/api/meetings/"+ref+path, nil); status != 404 {
+				t.Errorf("GET %s by %q returned %d, want 404", path, ref, status)
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Minimal client for the speaker stack server. It talks to the same endpoints as any
+// other client: POST /api/meetings to create a meeting and the /ws websocket to join.
+(function () {
+  "use strict";
+
+  var socket = null;
+
+  // Our copy of the stack and its revision, kept up to date with stack.v2 patches
+  var stack = [];
+  var revision = 0;
+
+  // Token to reclaim our place on the stack if the server drops us for being too slow
+  var resumeToken = "";
+
+  function $(id) {
+    return document.getElementById(id);
+  }
+
+  function showError(id, message) {
+    var element = $(id);
+    element.textContent = message;
+    element.hidden = !message;
+  }
+
+  function renderStack(users) {
+    var list = $("stack");
+    list.textContent = "";
+    (users || []).forEach(function (user) {
+      var item = document.createElement("li");
+      item.textContent = user.name;
+      list.appendChild(item);
+    });
+    $("empty-stack").hidden = list.children.length > 0;
+  }
+
+  function applyPatch(ops) {
+    ops.forEach(function (op) {
+      var index = stack.findIndex(function (user) {
+        return user.speakerId === op.speakerId;
+      });
+      switch (op.op) {
+        case "insert":
+          stack.splice(op.position - 1, 0, op.user);
+          break;
+        case "remove":
+          if (index >= 0) {
+            stack.splice(index, 1);
+          }
+          break;
+        case "move":
+          if (index >= 0) {
+            stack.splice(op.position - 1, 0, stack.splice(index, 1)[0]);
+          }
+          break;
+      }
+    });
+  }
+
+  function handleStackMessage(message) {
+    if (message.type === "welcome") {
+      resumeToken = message.resumeToken;
+      return;
+    }
+    if (message.type === "snapshot") {
+      stack = message.stack || [];
+      revision = message.rev;
+    } else if (message.type === "patch") {
+      if (message.rev !== revision + 1) {
+        // We missed a change, so ask for the whole stack again
+        socket.send(JSON.stringify({ Action: "resync" }));
+        return;
+      }
+      applyPatch(message.ops);
+      revision = message.rev;
+    }
+    renderStack(stack);
+  }
+
+  function handleMessage(data) {
+    // Several messages may be joined with newlines in one frame
+    data.split("\n").forEach(function (line) {
+      if (!line) {
+        return;
+      }
+      var message = JSON.parse(line);
+      if (message === null || Array.isArray(message)) {
+        renderStack(message);
+      } else if (message.error) {
+        showError("meeting-error", message.error);
+      } else if (message.warning) {
+        showError("meeting-error", message.warning);
+      } else if (message.type) {
+        handleStackMessage(message);
+      }
+    });
+  }
+
+  function connect(meeting, resume) {
+    var scheme = location.protocol === "https:" ? "wss:" : "ws:";
+    var url = scheme + "//" + location.host + "/ws?meeting_id=" + encodeURIComponent(meeting.meetingId);
+    if (resume) {
+      url += "&resume=" + encodeURIComponent(resume);
+    }
+    if (meeting.moderatorToken) {
+      url += "&moderator=" + encodeURIComponent(meeting.moderatorToken);
+    }
+    socket = new WebSocket(url, "stack.v2");
+    socket.onmessage = function (event) {
+      handleMessage(event.data);
+    };
+    socket.onclose = function (event) {
+      // 1013 (try again later) means we were too slow, so reconnect keeping our place
+      if (event.code === 1013 && resumeToken) {
+        var token = resumeToken;
+        resumeToken = "";
+        connect(meeting, token);
+        return;
+      }
+      showError("meeting-error", "Disconnected from the meeting.");
+    };
+  }
+
+  function join(meeting) {
+    connect(meeting, "");
+    // Only whoever created the meeting gets the moderator token
+    $("next-button").hidden = !meeting.moderatorToken;
+    $("meeting-code").textContent = meeting.slug || meeting.meetingCode;
+    $("lobby").hidden = true;
+    $("meeting").hidden = false;
+    history.replaceState(null, "", "#" + (meeting.slug || meeting.meetingCode));
+  }
+
+  function send(action) {
+    if (socket && socket.readyState === WebSocket.OPEN) {
+      socket.send(JSON.stringify({ Action: action, Name: $("name").value }));
+    }
+  }
+
+  function request(method, url, body) {
+    return fetch(url, {
+      method: method,
+      headers: { "Content-Type": "application/json" },
+      body: body ? JSON.stringify(body) : undefined,
+    }).then(function (response) {
+      return response.json().then(function (json) {
+        if (!response.ok) {
+          throw new Error(json.error || response.statusText);
+        }
+        return json;
+      });
+    });
+  }
+
+  function lookup(code) {
+    return request("GET", "/api/meetings/" + encodeURIComponent(code.trim()))
+      .then(join)
+      .catch(function (err) {
+        showError("lobby-error", err.message);
+      });
+  }
+
+  $("create-form").addEventListener("submit", function (event) {
+    event.preventDefault();
+    var slug = $("create-slug").value.trim();
+    request("POST", "/api/meetings", slug ? { slug: slug } : {})
+      .then(join)
+      .catch(function (err) {
+        showError("lobby-error", err.message);
+      });
+  });
+
+  $("join-form").addEventListener("submit", function (event) {
+    event.preventDefault();
+    lookup($("join-code").value);
+  });
+
+  $("stack-form").addEventListener("submit", function (event) {
+    event.preventDefault();
+    send("on");
+  });
+
+  $("off-button").addEventListener("click", function () {
+    send("off");
+  });
+
+  $("next-button").addEventListener("click", function () {
+    send("next");
+  });
+
+  if (location.hash.length > 1) {
+    lookup(decodeURIComponent(location.hash.slice(1)));
+  }
+})();
@@ -0,0 +1,34 @@
+// Package static serves the browser frontend for the speaker stack, either from the
+// copy bundled into the binary or from a directory on disk.
+package static
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"os"
+)
+
+// files holds the frontend bundled at build time.
+//go:embed dist
+var files embed.FS
+
+// Handler returns a file server for the frontend and whether it is enabled. Setting
+// FRONTEND_DIR serves the files in that directory, which is handy while working on
+// the frontend, otherwise SERVE_FRONTEND=true serves the bundled copy.
+func Handler() (handler http.Handler, enabled bool, err error) {
+	if dir := os.Getenv("FRONTEND_DIR"); dir != "" {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, false, err
+		}
+		return http.FileServer(http.Dir(dir)), true, nil
+	}
+	if os.Getenv("SERVE_FRONTEND") != "true" {
+		return nil, false, nil
+	}
+	dist, err := fs.Sub(files, "dist")
+	if err != nil {
+		return nil, false, err
+	}
+	return http.FileServer(http.FS(dist)), true, nil
+}
@@ -0,0 +1,119 @@
+package tlsserver
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certReloader serves a certificate loaded from disk and reloads it when the
+// certificate or key file changes, so renewed certificates are picked up without a
+// restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	version     fileVersion
+}
+
+// fileVersion identifies the contents of the certificate and key files well enough to
+// notice when either is replaced, even by a file with an older modification time.
+type fileVersion struct {
+	certModTime time.Time
+	certSize    int64
+	keyModTime  time.Time
+	keySize     int64
+}
+
+// newCertReloader loads the certificate and key, failing if they can't be used.
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// currentVersion returns the version of the certificate and key files on disk.
+func (c *certReloader) currentVersion() (fileVersion, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{
+		certModTime: certInfo.ModTime(),
+		certSize:    certInfo.Size(),
+		keyModTime:  keyInfo.ModTime(),
+		keySize:     keyInfo.Size(),
+	}, nil
+}
+
+// reload reads the certificate and key from disk and swaps them in.
+func (c *certReloader) reload() error {
+	version, err := c.currentVersion()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.certificate = &certificate
+	c.version = version
+	return nil
+}
+
+// watch checks the files every interval and reloads them when they have changed. A
+// failed reload keeps serving the previous certificate, which is what we want while
+// a certificate and key are being replaced one after the other.
+func (c *certReloader) watch(interval time.Duration) {
+	reloadLogger := logger.WithFields(log.Fields{
+		"certFile": c.certFile,
+		"keyFile":  c.keyFile,
+	})
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		version, err := c.currentVersion()
+		if err != nil {
+			reloadLogger.WithField("error", err.Error()).Warning("Error checking TLS certificate files.")
+			continue
+		}
+		c.mu.RLock()
+		changed := !version.equal(c.version)
+		c.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := c.reload(); err != nil {
+			reloadLogger.WithField("error", err.Error()).Warning("Error reloading TLS certificate, keeping the previous one.")
+			continue
+		}
+		reloadLogger.Info("Reloaded TLS certificate.")
+	}
+}
+
+// equal reports whether both versions describe the same files.
+func (v fileVersion) equal(other fileVersion) bool {
+	return v.certModTime.Equal(other.certModTime) && v.certSize == other.certSize &&
+		v.keyModTime.Equal(other.keyModTime) && v.keySize == other.keySize
+}
+
+// getCertificate is used as tls.Config.GetCertificate.
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.certificate, nil
+}
@@ -0,0 +1,142 @@
+package tlsserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setenv sets an environment variable until the test ends.
+func setenv(t *testing.T, name string, value string) {
+	previous, set := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if set {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+// writeCertificate writes a self-signed certificate for the common name and its key
+// to the files, leaving the key file alone if it is empty.
+func writeCertificate(t *testing.T, certFile string, keyFile string, commonName string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyFile != "" {
+		writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), modTime)
+	}
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), modTime)
+}
+
+// writeFile writes the file and sets its modification time, so that tests don't
+// depend on the resolution of the file system's timestamps.
+func writeFile(t *testing.T, name string, contents []byte, modTime time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(name, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedName connects to the server and returns the common name of its certificate.
+func servedName(t *testing.T, addr string) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+// waitForName waits for the server to serve the certificate for the common name.
+func waitForName(t *testing.T, addr string, commonName string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for servedName(t, addr) != commonName {
+		if time.Now().After(deadline) {
+			t.Fatalf("server still serves %q, want %q", servedName(t, addr), commonName)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCertificateFilesAreReloaded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+	writeCertificate(t, certFile, keyFile, "first", start)
+
+	setenv(t, "TLS_CERT_FILE", certFile)
+	setenv(t, "TLS_KEY_FILE", keyFile)
+	setenv(t, "TLS_RELOAD_INTERVAL", "10ms")
+	config, err := FromEnv("8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config.TLSConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	go server.Serve(listener)
+	defer server.Close()
+	addr := listener.Addr().String()
+
+	if got := servedName(t, addr); got != "first" {
+		t.Fatalf("server serves %q, want the first certificate", got)
+	}
+
+	// A certificate that doesn't match the key yet keeps the previous one in service
+	writeCertificate(t, certFile, "", "mismatched", start.Add(time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	if got := servedName(t, addr); got != "first" {
+		t.Errorf("server serves %q while the key doesn't match, want the first certificate", got)
+	}
+
+	// Replacing both files swaps the certificate without restarting
+	writeCertificate(t, certFile, keyFile, "second", start.Add(2*time.Minute))
+	waitForName(t, addr, "second")
+
+	// So does swapping in files with older modification times, as a restored backup has
+	writeCertificate(t, certFile, keyFile, "restored", start.Add(-time.Hour))
+	waitForName(t, addr, "restored")
+}
@@ -0,0 +1,162 @@
+// Package tlsserver configures native TLS for self-hosted deployments without a proxy
+// in front, either from certificate files that are reloaded when they change or from
+// an ACME certificate authority such as Let's Encrypt.
+package tlsserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// logger is the package logger. TLS setup happens outside of any request so there is
+// no request context to take a logger from.
+var logger = log.WithField("package", "tlsserver")
+
+// Config describes how the server should terminate TLS.
+type Config struct {
+	// TLSConfig is used by the HTTPS server.
+	TLSConfig *tls.Config
+
+	// RedirectAddr is the address of the plain HTTP listener that redirects to HTTPS
+	// and answers ACME HTTP-01 challenges. Empty means no plain HTTP listener.
+	RedirectAddr string
+
+	// RedirectHandler serves the plain HTTP listener.
+	RedirectHandler http.Handler
+}
+
+// FromEnv builds the TLS configuration from the environment, returning nil if TLS is
+// not enabled. Set TLS_CERT_FILE and TLS_KEY_FILE to serve a certificate from disk,
+// which is reloaded when the files change, or ACME_DOMAINS to a comma separated list
+// of host names to obtain certificates automatically. ACME_EMAIL, ACME_CACHE_DIR
+// (default "acme-cache"), ACME_DIRECTORY_URL (default Let's Encrypt) and ACME_CA_FILE
+// (a CA bundle to trust the directory with, e.g. for a local Pebble server) tune the
+// ACME client. HTTP_REDIRECT_PORT enables the plain HTTP redirect listener, which is
+// always started on port 80 in ACME mode unless another port is given. httpsPort is
+// used to build redirect URLs.
+func FromEnv(httpsPort string) (*Config, error) {
+	certFile := os.Getenv("TLS_CERT_FILE")
+	keyFile := os.Getenv("TLS_KEY_FILE")
+	domains := os.Getenv("ACME_DOMAINS")
+	redirectPort := os.Getenv("HTTP_REDIRECT_PORT")
+
+	var config Config
+	redirect := redirectHandler(httpsPort)
+	switch {
+	case certFile != "" && domains != "":
+		return nil, errors.New("TLS_CERT_FILE and ACME_DOMAINS can not both be set")
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		}
+		reloader, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		go reloader.watch(reloadInterval())
+		config.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.getCertificate,
+		}
+	case domains != "":
+		manager, err := newACMEManager(strings.Split(domains, ","))
+		if err != nil {
+			return nil, err
+		}
+		config.TLSConfig = manager.TLSConfig()
+		config.TLSConfig.MinVersion = tls.VersionTLS12
+		redirect = manager.HTTPHandler(redirect)
+		if redirectPort == "" {
+			redirectPort = "80"
+		}
+	default:
+		return nil, nil
+	}
+
+	if redirectPort != "" {
+		config.RedirectAddr = ":" + redirectPort
+		config.RedirectHandler = redirect
+	}
+	return &config, nil
+}
+
+// reloadInterval is how often certificate files are checked for changes, read from
+// TLS_RELOAD_INTERVAL and defaulting to 30 seconds.
+func reloadInterval() time.Duration {
+	if value := os.Getenv("TLS_RELOAD_INTERVAL"); value != "" {
+		if interval, err := time.ParseDuration(value); err == nil && interval > 0 {
+			return interval
+		}
+		logger.WithField("value", value).Warning("Ignoring invalid TLS_RELOAD_INTERVAL.")
+	}
+	return 30 * time.Second
+}
+
+// redirectHandler sends plain HTTP requests to the same URL over HTTPS.
+func redirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
+
+// newACMEManager builds an autocert manager for the given domains.
+func newACMEManager(domains []string) (*autocert.Manager, error) {
+	for i := range domains {
+		domains[i] = strings.TrimSpace(domains[i])
+	}
+	cacheDir := os.Getenv("ACME_CACHE_DIR")
+	if cacheDir == "" {
+		cacheDir = "acme-cache"
+	}
+
+	client := &acme.Client{DirectoryURL: os.Getenv("ACME_DIRECTORY_URL")}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	if caFile := os.Getenv("ACME_CA_FILE"); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ACME_CA_FILE %s", caFile)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		}
+	}
+
+	logger.WithFields(log.Fields{
+		"domains":   domains,
+		"directory": client.DirectoryURL,
+		"cacheDir":  cacheDir,
+	}).Info("Using ACME for TLS certificates.")
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      os.Getenv("ACME_EMAIL"),
+		Client:     client,
+	}, nil
+}
@@ -0,0 +1,135 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrMeetingWebhooksDisabled is returned by ValidateMeetingURL when no hosts are allowed
+// for per-meeting webhooks.
+var ErrMeetingWebhooksDisabled = errors.New("webhooks are not enabled on this server")
+
+// errNotPublic is returned when dialling an address that isn't on the public internet.
+var errNotPublic = errors.New("webhook address is not public")
+
+// nonPublic lists the address ranges per-meeting webhooks may never be delivered to, on
+// top of those net.IP already knows to be loopback, link-local or multicast.
+var nonPublic = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // "this" network
+		"10.0.0.0/8",     // private
+		"172.16.0.0/12",  // private
+		"192.168.0.0/16", // private
+		"fc00::/7",       // unique local
+		"100.64.0.0/10",  // carrier-grade NAT
+		"192.0.0.0/24",   // IETF protocol assignments
+		"198.18.0.0/15",  // benchmarking
+		"240.0.0.0/4",    // reserved, including broadcast
+		"64:ff9b::/96",   // NAT64, which could reach any of the above
+		"2002::/16",      // 6to4, likewise
+	} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// isPublic reports whether ip is a unicast address on the public internet.
+func isPublic(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range nonPublic {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicOnly is a net.Dialer Control function refusing connections to addresses that
+// aren't public. It runs after name resolution, for every address dialled, so a host
+// name that resolves to an internal address, whether from the start or after the URL
+// was checked, can't be used to reach it.
+func publicOnly(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublic(ip) {
+		return fmt.Errorf("%w: %s", errNotPublic, host)
+	}
+	return nil
+}
+
+// newMeetingClient returns the client per-meeting webhooks are delivered with. Anyone
+// can create a meeting, so it only connects to public addresses and ignores any proxy
+// configured in the environment, which would do the connecting on its behalf.
+func newMeetingClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: publicOnly}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// parseHosts reads a comma separated list of host names, as used for
+// WEBHOOK_MEETING_HOSTS.
+func parseHosts(value string) []string {
+	var hosts []string
+	for _, host := range strings.Split(value, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// allowedHost reports whether host is one of the allowed hosts, or a subdomain of one
+// given as ".example.com". "*" allows every host.
+func allowedHost(allowed []string, host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range allowed {
+		switch {
+		case pattern == "*", pattern == host:
+			return true
+		case strings.HasPrefix(pattern, ".") && strings.HasSuffix(host, pattern):
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateMeetingURL checks a webhook URL given when creating a meeting: it must be an
+// absolute http or https URL whose host is allowed by MeetingHosts.
+func (d *Dispatcher) ValidateMeetingURL(target string) error {
+	if len(d.config.MeetingHosts) == 0 {
+		return ErrMeetingWebhooksDisabled
+	}
+	if err := ValidateURL(target); err != nil {
+		return err
+	}
+	parsed, _ := url.Parse(target)
+	if !allowedHost(d.config.MeetingHosts, parsed.Hostname()) {
+		return fmt.Errorf("webhook URL %q is not on an allowed host", target)
+	}
+	return nil
+}
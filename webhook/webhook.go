@@ -0,0 +1,434 @@
+// Package webhook delivers meeting events to HTTP endpoints as signed JSON POSTs,
+// retrying failed deliveries with exponential backoff and keeping a log of recent
+// delivery attempts.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"stack-web-app/events"
+	"stack-web-app/logging"
+	"stack-web-app/metrics"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Headers sent with every delivery. The signature is the hex encoded HMAC-SHA256 of
+// the timestamp header, a full stop and the request body, keyed with the endpoint's
+// secret, and prefixed with "sha256=".
+const (
+	HeaderEvent     = "X-Stack-Event"
+	HeaderDelivery  = "X-Stack-Delivery"
+	HeaderTimestamp = "X-Stack-Timestamp"
+	HeaderSignature = "X-Stack-Signature"
+)
+
+// logger is the package logger. Deliveries happen in the background outside of any
+// request.
+var logger = log.WithField("package", "webhook")
+
+// Endpoint is a URL events are delivered to and the secret deliveries are signed with.
+type Endpoint struct {
+	URL    string `json:"url"`
+	Secret string `json:"-"`
+}
+
+// Payload is the JSON body of a delivery.
+type Payload struct {
+	Id        string                 `json:"id"`
+	Type      events.Type            `json:"type"`
+	MeetingId string                 `json:"meetingId"`
+	Time      time.Time              `json:"time"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// Delivery records the outcome of delivering an event to an endpoint. The event's
+// payload ID is shared by its deliveries to every endpoint.
+type Delivery struct {
+	Id        string      `json:"id"`
+	EventId   string      `json:"eventId"`
+	URL       string      `json:"url"`
+	MeetingId string      `json:"meetingId"`
+	Event     events.Type `json:"event"`
+	Attempts  int         `json:"attempts"`
+	Status    int         `json:"status,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Delivered bool        `json:"delivered"`
+	Time      time.Time   `json:"time"`
+}
+
+// job is a payload waiting to be delivered to an endpoint.
+type job struct {
+	id       string
+	endpoint Endpoint
+	payload  Payload
+	body     []byte
+
+	// meeting is set for deliveries to a meeting's own endpoints
+	meeting bool
+}
+
+// Config tunes a Dispatcher.
+type Config struct {
+	// Endpoints receive the events of every meeting.
+	Endpoints []Endpoint
+
+	// MeetingHosts are the hosts meetings may register their own webhooks on, with
+	// ".example.com" allowing its subdomains and "*" allowing any host. Meetings can't
+	// have webhooks when it is empty. They are only ever delivered to public addresses.
+	MeetingHosts []string
+
+	// MaxAttempts is how many times a delivery is tried before giving up.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry, doubled for every retry after.
+	Backoff time.Duration
+
+	// Timeout bounds each delivery attempt.
+	Timeout time.Duration
+
+	// Workers is the number of deliveries made concurrently.
+	Workers int
+
+	// LogSize is the number of recent deliveries kept in the delivery log.
+	LogSize int
+}
+
+// DefaultConfig is the configuration used for anything not set in the environment.
+var DefaultConfig = Config{
+	MaxAttempts: 5,
+	Backoff:     time.Second,
+	Timeout:     10 * time.Second,
+	Workers:     4,
+	LogSize:     1000,
+}
+
+// Dispatcher delivers events to the server wide endpoints and the endpoints of the
+// meeting the event belongs to.
+type Dispatcher struct {
+	config Config
+	client *http.Client
+	queue  chan job
+
+	// meetingClient delivers to the endpoints of meetings, which anyone can set
+	meetingClient *http.Client
+
+	wg   sync.WaitGroup
+	done chan struct{}
+
+	// Guards meetings and log
+	mu       sync.Mutex
+	meetings map[string][]Endpoint
+	log      []Delivery
+}
+
+// ConfigFromEnv reads the dispatcher configuration from WEBHOOK_URLS (a comma separated
+// list of server wide endpoints), WEBHOOK_SECRET (used to sign deliveries to them),
+// WEBHOOK_MEETING_HOSTS, WEBHOOK_MAX_ATTEMPTS, WEBHOOK_BACKOFF and WEBHOOK_TIMEOUT.
+func ConfigFromEnv() (Config, error) {
+	config := DefaultConfig
+	config.MeetingHosts = parseHosts(os.Getenv("WEBHOOK_MEETING_HOSTS"))
+	secret := os.Getenv("WEBHOOK_SECRET")
+	for _, target := range strings.Split(os.Getenv("WEBHOOK_URLS"), ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+		if err := ValidateURL(target); err != nil {
+			return config, fmt.Errorf("invalid WEBHOOK_URLS: %w", err)
+		}
+		config.Endpoints = append(config.Endpoints, Endpoint{URL: target, Secret: secret})
+	}
+	if len(config.Endpoints) > 0 && secret == "" {
+		return config, errors.New("WEBHOOK_SECRET must be set along with WEBHOOK_URLS")
+	}
+	if value, ok := os.LookupEnv("WEBHOOK_MAX_ATTEMPTS"); ok {
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts < 1 {
+			return config, errors.New("invalid value for WEBHOOK_MAX_ATTEMPTS: must be a positive integer")
+		}
+		config.MaxAttempts = attempts
+	}
+	for name, target := range map[string]*time.Duration{
+		"WEBHOOK_BACKOFF": &config.Backoff,
+		"WEBHOOK_TIMEOUT": &config.Timeout,
+	} {
+		if value, ok := os.LookupEnv(name); ok {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return config, fmt.Errorf("invalid duration for %s", name)
+			}
+			*target = d
+		}
+	}
+	return config, nil
+}
+
+// ValidateURL checks that a webhook URL is an absolute http or https URL.
+func ValidateURL(target string) error {
+	parsed, err := url.Parse(target)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("webhook URL %q must be an absolute http or https URL", target)
+	}
+	return nil
+}
+
+// NewDispatcher creates a dispatcher and starts its delivery workers.
+func NewDispatcher(config Config) *Dispatcher {
+	d := &Dispatcher{
+		config:        config,
+		client:        &http.Client{Timeout: config.Timeout},
+		meetingClient: newMeetingClient(config.Timeout),
+		queue:         make(chan job, 1000),
+		done:          make(chan struct{}),
+		meetings:      map[string][]Endpoint{},
+	}
+	for i := 0; i < config.Workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+	return d
+}
+
+// Stop stops the delivery workers, abandoning queued deliveries and pending retries.
+func (d *Dispatcher) Stop() {
+	close(d.done)
+	d.wg.Wait()
+}
+
+// SetMeetingEndpoints sets the endpoints that receive the events of a single meeting.
+func (d *Dispatcher) SetMeetingEndpoints(meetingId string, endpoints []Endpoint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(endpoints) == 0 {
+		delete(d.meetings, meetingId)
+		return
+	}
+	d.meetings[meetingId] = endpoints
+}
+
+// Handle queues an event for delivery to every endpoint interested in it. It is meant
+// to be subscribed to the event bus. Events replicated from other instances are left
+// to the instance they happened on.
+func (d *Dispatcher) Handle(event events.Event) {
+	if event.Remote {
+		return
+	}
+
+	d.mu.Lock()
+	endpoints := d.config.Endpoints
+	meetingEndpoints := d.meetings[event.MeetingId]
+	if event.Type == events.MeetingPruned {
+		// Nothing more will happen in the meeting once this has been delivered
+		delete(d.meetings, event.MeetingId)
+	}
+	d.mu.Unlock()
+	if len(endpoints) == 0 && len(meetingEndpoints) == 0 {
+		return
+	}
+
+	payload := Payload{
+		Id:        uuid.New().String(),
+		Type:      event.Type,
+		MeetingId: event.MeetingId,
+		Time:      event.Time,
+		Data:      event.Data,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Error encoding webhook payload.")
+		return
+	}
+	for _, endpoint := range endpoints {
+		d.enqueue(job{id: uuid.New().String(), endpoint: endpoint, payload: payload, body: body})
+	}
+	for _, endpoint := range meetingEndpoints {
+		d.enqueue(job{id: uuid.New().String(), endpoint: endpoint, payload: payload, body: body, meeting: true})
+	}
+}
+
+// enqueue queues a job for the delivery workers, dropping it if the queue is full.
+func (d *Dispatcher) enqueue(j job) {
+	select {
+	case d.queue <- j:
+	default:
+		metrics.WebhookDeliveries.WithLabelValues("dropped").Inc()
+		logger.WithFields(log.Fields{
+			"url":   j.endpoint.URL,
+			"event": j.payload.Type,
+		}).Warning("Webhook queue full, dropping delivery.")
+	}
+}
+
+// Deliveries returns the recent deliveries, newest first, optionally only those of a
+// single meeting.
+func (d *Dispatcher) Deliveries(meetingId string) []Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	deliveries := []Delivery{}
+	for i := len(d.log) - 1; i >= 0; i-- {
+		if meetingId == "" || d.log[i].MeetingId == meetingId {
+			deliveries = append(deliveries, d.log[i])
+		}
+	}
+	return deliveries
+}
+
+// work delivers queued jobs until the dispatcher is stopped.
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.done:
+			return
+		case j := <-d.queue:
+			d.deliver(j)
+		}
+	}
+}
+
+// deliver posts a job to its endpoint, retrying with exponential backoff, and records
+// the outcome in the delivery log.
+func (d *Dispatcher) deliver(j job) {
+	delivery := Delivery{
+		Id:        j.id,
+		EventId:   j.payload.Id,
+		URL:       j.endpoint.URL,
+		MeetingId: j.payload.MeetingId,
+		Event:     j.payload.Type,
+	}
+	logger := logger.WithFields(log.Fields{
+		"url":        j.endpoint.URL,
+		"event":      j.payload.Type,
+		"deliveryId": j.id,
+	})
+
+	backoff := d.config.Backoff
+	for delivery.Attempts < d.config.MaxAttempts {
+		delivery.Attempts++
+		status, err := d.post(j)
+		delivery.Status = status
+		delivery.Error = ""
+		if err == nil {
+			delivery.Delivered = true
+			break
+		}
+		delivery.Error = err.Error()
+		if !retryable(status) || delivery.Attempts == d.config.MaxAttempts {
+			break
+		}
+		logger.WithFields(log.Fields{
+			"attempt": delivery.Attempts,
+			"error":   err.Error(),
+		}).Debug("Webhook delivery failed, retrying.")
+		select {
+		case <-time.After(backoff):
+		case <-d.done:
+			return
+		}
+		backoff *= 2
+	}
+
+	delivery.Time = time.Now()
+	if delivery.Delivered {
+		metrics.WebhookDeliveries.WithLabelValues("delivered").Inc()
+	} else {
+		metrics.WebhookDeliveries.WithLabelValues("failed").Inc()
+		logger.WithFields(log.Fields{
+			"attempts": delivery.Attempts,
+			"error":    delivery.Error,
+		}).Warning("Giving up on webhook delivery.")
+	}
+	d.record(delivery)
+}
+
+// post makes a single delivery attempt, returning the response status if there was
+// one.
+func (d *Dispatcher) post(j job) (status int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.config.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, j.endpoint.URL, bytes.NewReader(j.body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "stack-web-app-webhook")
+	request.Header.Set(HeaderEvent, string(j.payload.Type))
+	request.Header.Set(HeaderDelivery, j.id)
+	request.Header.Set(HeaderTimestamp, timestamp)
+	request.Header.Set(HeaderSignature, Sign(j.endpoint.Secret, timestamp, j.body))
+
+	client := d.client
+	if j.meeting {
+		client = d.meetingClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("endpoint responded with %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+// retryable reports whether a failed attempt with the given status is worth retrying:
+// network errors, rate limiting and server errors are, other client errors aren't.
+func retryable(status int) bool {
+	return status == 0 || status == http.StatusTooManyRequests || status >= 500
+}
+
+// record adds a delivery to the log, forgetting the oldest ones beyond LogSize.
+func (d *Dispatcher) record(delivery Delivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.log = append(d.log, delivery)
+	if overflow := len(d.log) - d.config.LogSize; overflow > 0 {
+		d.log = append(d.log[:0], d.log[overflow:]...)
+	}
+}
+
+// Sign returns the signature header value for a delivery body sent at timestamp.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a delivery's signature header, for receivers written in Go.
+func Verify(secret string, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// AdminHandler serves the delivery log of every meeting. Requests must carry the
+// ADMIN_TOKEN environment variable as a bearer token.
+func (d *Dispatcher) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	if !logging.AdminAuthorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(d.Deliveries(r.URL.Query().Get("meetingId")))
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Error writing webhook delivery log.")
+	}
+}
@@ -0,0 +1,263 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"stack-web-app/events"
+)
+
+// receiver is a local webhook endpoint answering each delivery attempt with the next
+// of its statuses, repeating the last one once they run out.
+type receiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	attempts []time.Time
+}
+
+func newReceiver(t *testing.T, secret string, statuses ...int) *receiver {
+	r := &receiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if !Verify(secret, req.Header.Get(HeaderTimestamp), body, req.Header.Get(HeaderSignature)) {
+			t.Error("delivery has an invalid signature")
+		}
+		var payload Payload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("delivery isn't a JSON payload: %v", err)
+		}
+		if req.Header.Get(HeaderEvent) != string(payload.Type) {
+			t.Errorf("%s header is %q, want %q", HeaderEvent, req.Header.Get(HeaderEvent), payload.Type)
+		}
+
+		r.mu.Lock()
+		r.attempts = append(r.attempts, time.Now())
+		status := r.statuses[len(r.statuses)-1]
+		if len(r.attempts) <= len(r.statuses) {
+			status = r.statuses[len(r.attempts)-1]
+		}
+		r.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// attemptTimes returns when each delivery attempt arrived.
+func (r *receiver) attemptTimes() []time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]time.Time(nil), r.attempts...)
+}
+
+// newTestDispatcher starts a dispatcher with short backoffs, stopped when the test ends.
+func newTestDispatcher(t *testing.T, config Config) *Dispatcher {
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = 3
+	}
+	config.Backoff = 20 * time.Millisecond
+	config.Timeout = time.Second
+	config.Workers = 1
+	if config.LogSize == 0 {
+		config.LogSize = 10
+	}
+	d := NewDispatcher(config)
+	t.Cleanup(d.Stop)
+	return d
+}
+
+// waitFor waits for a delivery worker to get to where condition holds.
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitForDeliveries waits until the dispatcher has logged n deliveries.
+func waitForDeliveries(t *testing.T, d *Dispatcher, n int) []Delivery {
+	t.Helper()
+	waitFor(t, "deliveries", func() bool { return len(d.Deliveries("")) >= n })
+	return d.Deliveries("")
+}
+
+func TestSignAndVerify(t *testing.T) {
+	body := []byte(`{"type":"stack.on"}`)
+	signature := Sign("secret", "1622538000", body)
+	if !strings.HasPrefix(signature, "sha256=") {
+		t.Errorf("signature %q isn't prefixed with sha256=", signature)
+	}
+	if !Verify("secret", "1622538000", body, signature) {
+		t.Error("Verify rejected a valid signature")
+	}
+	for name, verify := range map[string]func() bool{
+		"secret":    func() bool { return Verify("other", "1622538000", body, signature) },
+		"timestamp": func() bool { return Verify("secret", "1622538001", body, signature) },
+		"body":      func() bool { return Verify("secret", "1622538000", []byte(`{"type":"stack.off"}`), signature) },
+		"signature": func() bool { return Verify("secret", "1622538000", body, "sha256=00") },
+	} {
+		if verify() {
+			t.Errorf("Verify accepted a signature with a different %s", name)
+		}
+	}
+}
+
+func TestRetriesServerErrorsWithBackoff(t *testing.T) {
+	r := newReceiver(t, "secret", http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK)
+	d := newTestDispatcher(t, Config{Endpoints: []Endpoint{{URL: r.URL, Secret: "secret"}}, MaxAttempts: 5})
+
+	d.Handle(events.Event{Type: events.StackOn, MeetingId: "meeting", Time: time.Now()})
+	deliveries := waitForDeliveries(t, d, 1)
+	if !deliveries[0].Delivered || deliveries[0].Attempts != 3 || deliveries[0].Status != http.StatusOK {
+		t.Errorf("delivery = %+v, want delivered on the third attempt", deliveries[0])
+	}
+
+	// The backoff doubles after each retry
+	attempts := r.attemptTimes()
+	if len(attempts) != 3 {
+		t.Fatalf("receiver got %d attempts, want 3", len(attempts))
+	}
+	if wait := attempts[1].Sub(attempts[0]); wait < 20*time.Millisecond {
+		t.Errorf("first retry after %v, want at least 20ms", wait)
+	}
+	if wait := attempts[2].Sub(attempts[1]); wait < 40*time.Millisecond {
+		t.Errorf("second retry after %v, want at least 40ms", wait)
+	}
+}
+
+func TestGivesUpAfterMaxAttempts(t *testing.T) {
+	r := newReceiver(t, "secret", http.StatusServiceUnavailable)
+	d := newTestDispatcher(t, Config{Endpoints: []Endpoint{{URL: r.URL, Secret: "secret"}}, MaxAttempts: 3})
+
+	d.Handle(events.Event{Type: events.StackOn, MeetingId: "meeting", Time: time.Now()})
+	deliveries := waitForDeliveries(t, d, 1)
+	if deliveries[0].Delivered || deliveries[0].Attempts != 3 || deliveries[0].Status != http.StatusServiceUnavailable {
+		t.Errorf("delivery = %+v, want failed after 3 attempts", deliveries[0])
+	}
+	if deliveries[0].Error == "" {
+		t.Error("failed delivery has no error")
+	}
+	if got := len(r.attemptTimes()); got != 3 {
+		t.Errorf("receiver got %d attempts, want 3", got)
+	}
+}
+
+func TestDoesNotRetryClientErrors(t *testing.T) {
+	r := newReceiver(t, "secret", http.StatusBadRequest)
+	d := newTestDispatcher(t, Config{Endpoints: []Endpoint{{URL: r.URL, Secret: "secret"}}})
+
+	d.Handle(events.Event{Type: events.StackOn, MeetingId: "meeting", Time: time.Now()})
+	deliveries := waitForDeliveries(t, d, 1)
+	if deliveries[0].Delivered || deliveries[0].Attempts != 1 {
+		t.Errorf("delivery = %+v, want failed after 1 attempt", deliveries[0])
+	}
+}
+
+func TestDeliveryLog(t *testing.T) {
+	r := newReceiver(t, "secret", http.StatusOK)
+	d := newTestDispatcher(t, Config{Endpoints: []Endpoint{{URL: r.URL, Secret: "secret"}}, LogSize: 2})
+
+	// One worker delivers the events in order
+	d.Handle(events.Event{Type: events.MeetingCreated, MeetingId: "first", Time: time.Now()})
+	d.Handle(events.Event{Type: events.StackOn, MeetingId: "second", Time: time.Now()})
+	d.Handle(events.Event{Type: events.StackOff, MeetingId: "second", Time: time.Now()})
+	waitFor(t, "the last event to be delivered", func() bool {
+		deliveries := d.Deliveries("")
+		return len(deliveries) > 0 && deliveries[0].MeetingId == "second" && deliveries[0].Event == events.StackOff
+	})
+
+	deliveries := d.Deliveries("")
+	if len(deliveries) != 2 {
+		t.Fatalf("log has %d deliveries, want the last 2", len(deliveries))
+	}
+	if deliveries[0].Event != events.StackOff || deliveries[1].Event != events.StackOn {
+		t.Errorf("log = %s, %s, want stack.off then stack.on", deliveries[0].Event, deliveries[1].Event)
+	}
+	if deliveries[0].EventId == deliveries[1].EventId || deliveries[0].Id == deliveries[1].Id {
+		t.Error("deliveries of different events share IDs")
+	}
+	if got := d.Deliveries("first"); len(got) != 0 {
+		t.Errorf("log has %d deliveries for a forgotten meeting", len(got))
+	}
+	if got := d.Deliveries("second"); len(got) != 2 {
+		t.Errorf("log has %d deliveries for the second meeting, want 2", len(got))
+	}
+}
+
+func TestMeetingEndpointsOnlyReachPublicAddresses(t *testing.T) {
+	r := newReceiver(t, "secret", http.StatusOK)
+	d := newTestDispatcher(t, Config{MeetingHosts: []string{"*"}, MaxAttempts: 1})
+	d.SetMeetingEndpoints("meeting", []Endpoint{{URL: r.URL, Secret: "secret"}})
+
+	d.Handle(events.Event{Type: events.StackOn, MeetingId: "meeting", Time: time.Now()})
+	deliveries := waitForDeliveries(t, d, 1)
+	if deliveries[0].Delivered || !strings.Contains(deliveries[0].Error, "not public") {
+		t.Errorf("delivery = %+v, want refused as not public", deliveries[0])
+	}
+	if got := len(r.attemptTimes()); got != 0 {
+		t.Errorf("receiver on loopback got %d attempts", got)
+	}
+}
+
+func TestValidateMeetingURL(t *testing.T) {
+	d := newTestDispatcher(t, Config{MeetingHosts: []string{"hooks.example.com", ".example.org"}})
+	for target, valid := range map[string]bool{
+		"https://hooks.example.com/stack":  true,
+		"http://HOOKS.example.com:8080/":   true,
+		"https://a.example.org/stack":      true,
+		"https://example.org/stack":        false,
+		"https://other.example.com/stack":  false,
+		"ftp://hooks.example.com/stack":    false,
+		"/stack":                           false,
+		"https://hooks.example.com.evil/x": false,
+	} {
+		if err := d.ValidateMeetingURL(target); (err == nil) != valid {
+			t.Errorf("ValidateMeetingURL(%q) = %v, want valid %v", target, err, valid)
+		}
+	}
+
+	disabled := newTestDispatcher(t, Config{})
+	if err := disabled.ValidateMeetingURL("https://hooks.example.com/stack"); err != ErrMeetingWebhooksDisabled {
+		t.Errorf("ValidateMeetingURL without MeetingHosts = %v, want %v", err, ErrMeetingWebhooksDisabled)
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	for address, public := range map[string]bool{
+		"93.184.216.34":    true,
+		"2606:2800:220::1": true,
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"255.255.255.255":  false,
+		"::1":              false,
+		"fd00::1":          false,
+		"fe80::1":          false,
+		"::ffff:10.0.0.1":  false,
+		"64:ff9b::a00:1":   false,
+	} {
+		if got := isPublic(net.ParseIP(address)); got != public {
+			t.Errorf("isPublic(%s) = %v, want %v", address, got, public)
+		}
+	}
+}
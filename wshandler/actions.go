@@ -0,0 +1,84 @@
+package wshandler
+
+import (
+	"context"
+	"errors"
+
+	"stack-web-app/db"
+	"stack-web-app/protocol"
+)
+
+var (
+	// ErrMeetingNotFound is returned when no live meeting has the given ID, code or
+	// slug.
+	ErrMeetingNotFound = errors.New("meeting not found")
+
+	// ErrUnknownAction is returned by ApplyAction for anything but on, off, next and
+	// remove.
+	ErrUnknownAction = errors.New("unknown stack action")
+)
+
+// Action is a stack operation taken by a participant, over a websocket or through an
+// integration such as a chat bot.
+type Action struct {
+	// Action is "on" or "off" for the participant themselves, or the moderator actions
+	// "next" and "remove".
+	Action string
+
+	// SpeakerId identifies the participant taking the action and Name is the name
+	// shown for them on the stack.
+	SpeakerId string
+	Name      string
+
+	// TargetId is the participant taken off the stack by "remove".
+	TargetId string
+
+	// Moderator is true when the participant proved they hold the moderator token.
+	Moderator bool
+}
+
+// apply sends the action to every instance serving the meeting. Moderator actions are
+// refused unless the participant is the moderator, and anything that isn't a moderator
+// action is passed on as is, so that unknown actions just rebroadcast the stack.
+func (h *Hub) apply(ctx context.Context, action Action) error {
+	if moderatorAction(action.Action) {
+		if !action.Moderator {
+			return ErrNotModerator
+		}
+		return h.publishModeration(ctx, action.Action, action.TargetId, action.SpeakerId)
+	}
+	return h.publishMutation(ctx, action.Action, action.SpeakerId, action.Name)
+}
+
+// ApplyAction takes a stack action in the meeting with the given ID, code or slug,
+// exactly as if the participant had sent it over a websocket.
+func ApplyAction(ctx context.Context, meetingRef string, action Action) error {
+	switch action.Action {
+	case protocol.ActionOn, protocol.ActionOff, protocol.ActionNext, protocol.ActionRemove:
+	default:
+		return ErrUnknownAction
+	}
+	hub, ok := lookupHub(meetingRef)
+	if !ok {
+		return ErrMeetingNotFound
+	}
+	return hub.apply(ctx, action)
+}
+
+// MeetingStack returns the ID and current stack of the meeting with the given ID,
+// code or slug.
+func MeetingStack(ctx context.Context, meetingRef string) (meetingId string, stack []db.User, err error) {
+	hub, ok := lookupHub(meetingRef)
+	if !ok {
+		return "", nil, ErrMeetingNotFound
+	}
+	stack, err = db.ShowCurrentStack(ctx, hub.hubId)
+	return hub.hubId, stack, err
+}
+
+// IsModerator reports whether the token is the moderator token of the meeting with
+// the given ID, code or slug.
+func IsModerator(meetingRef string, token string) bool {
+	hub, ok := lookupHub(meetingRef)
+	return ok && hub.isModerator(token)
+}
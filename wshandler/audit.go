@@ -0,0 +1,253 @@
+package wshandler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"stack-web-app/db"
+	"stack-web-app/events"
+	"stack-web-app/logging"
+	"stack-web-app/protocol"
+	"stack-web-app/report"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Participant activity replicated to every instance so that they all record it in
+// their copy of the meeting's event log.
+const (
+	activityJoin  = "join"
+	activityLeave = "leave"
+)
+
+// meetingEventsReturn is the JSON body returned by GetMeetingEvents.
+type meetingEventsReturn struct {
+	MeetingId string     `json:"meetingId"`
+	Events    []db.Event `json:"events"`
+}
+
+// StartAuditLog records every meeting event published on the event bus in the
+// meeting's event log in the database. It returns a function that stops recording.
+func StartAuditLog() (stop func()) {
+	return events.Subscribe(func(event events.Event) {
+		logger := contextLogger(context.Background()).WithFields(log.Fields{
+			"module":   "audit",
+			"function": "StartAuditLog",
+			"hubId":    event.MeetingId,
+		})
+		stringData := func(key string) string {
+			value, _ := event.Data[key].(string)
+			return value
+		}
+		err := db.RecordEvent(logging.WithLogger(context.Background(), logger), db.Event{
+			MeetingId: event.MeetingId,
+			Type:      string(event.Type),
+			SpeakerId: stringData("speakerId"),
+			Name:      stringData("name"),
+			ActorId:   stringData("actorId"),
+			Detail:    stringData("reason"),
+			Time:      event.Time,
+		})
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Error recording meeting event.")
+		}
+	})
+}
+
+// publishActivity tells every instance that a participant joined or left the meeting.
+func (h *Hub) publishActivity(activity string, clientId string) {
+	err := publishReplication(context.Background(), meetingTopic(h.hubId), replicationMessage{
+		Type:      meetingActivity,
+		MeetingId: h.hubId,
+		Action:    activity,
+		SpeakerId: clientId,
+	})
+	if err != nil {
+		h.logger.WithField("error", err.Error()).Warning("Error publishing participant activity to the backplane.")
+	}
+}
+
+// applyActivity publishes the event for a participant joining or leaving the meeting.
+// Events for activity on other instances are marked as remote.
+func (h *Hub) applyActivity(message replicationMessage) {
+	eventType := events.ParticipantJoined
+	if message.Action == activityLeave {
+		eventType = events.ParticipantLeft
+	}
+	events.Publish(events.Event{
+		Type:      eventType,
+		MeetingId: h.hubId,
+		Time:      h.clock.Now(),
+		Data:      map[string]interface{}{"speakerId": message.SpeakerId},
+		Remote:    message.Instance != instanceId,
+	})
+}
+
+// publishStackEvents publishes the events for the difference between the stack before
+// and after a mutation: participants getting on or off the stack and the speaker at
+// the top of the stack changing. Events for mutations made on other instances are
+// marked as remote.
+func (h *Hub) publishStackEvents(message replicationMessage, before []db.User, after []db.User) {
+	publish := func(eventType events.Type, user db.User, actorId string) {
+		data := map[string]interface{}{
+			"speakerId": user.SpeakerId,
+			"name":      user.Name,
+		}
+		if actorId != "" {
+			data["actorId"] = actorId
+		}
+		events.Publish(events.Event{
+			Type:      eventType,
+			MeetingId: h.hubId,
+			Time:      h.clock.Now(),
+			Data:      data,
+			Remote:    message.Instance != instanceId,
+		})
+	}
+
+	onStack := make(map[string]bool, len(before))
+	for _, user := range before {
+		onStack[user.SpeakerId] = true
+	}
+	for _, user := range after {
+		if !onStack[user.SpeakerId] {
+			publish(events.StackOn, user, "")
+		}
+		delete(onStack, user.SpeakerId)
+	}
+	for _, user := range before {
+		if !onStack[user.SpeakerId] {
+			continue
+		}
+		if message.ActorId != "" && message.ActorId != user.SpeakerId {
+			publish(events.StackRemoved, user, message.ActorId)
+		} else {
+			publish(events.StackOff, user, "")
+		}
+	}
+
+	if currentSpeaker(before) != currentSpeaker(after) {
+		if len(before) > 0 {
+			publish(events.SpeakingEnded, before[0], "")
+		}
+		if len(after) > 0 {
+			publish(events.SpeakingStarted, after[0], "")
+		}
+	}
+}
+
+// loadMeetingEvents reads the event log of the meeting in the request's meetingId path
+// variable, writing an error response and returning false if that fails. Only meeting
+// IDs are accepted: the log names everyone who took part, and codes are short enough to
+// guess.
+func loadMeetingEvents(w http.ResponseWriter, r *http.Request) (meetingId string, meetingEvents []db.Event, ok bool) {
+	// Get logger from request context
+	logger := contextLogger(r.Context()).WithFields(log.Fields{
+		"module":   "audit",
+		"function": "loadMeetingEvents",
+	})
+
+	meetingId = mux.Vars(r)["meetingId"]
+	if parsed, err := uuid.Parse(meetingId); err != nil || parsed.String() != meetingId {
+		writeJSON(w, r, http.StatusNotFound, protocol.Error{Error: "meeting not found"})
+		return "", nil, false
+	}
+	meetingEvents, err := db.ListEvents(r.Context(), meetingId)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Error listing meeting events.")
+		writeJSON(w, r, http.StatusInternalServerError, protocol.Error{Error: "unable to read meeting events"})
+		return "", nil, false
+	}
+	if len(meetingEvents) == 0 {
+		writeJSON(w, r, http.StatusNotFound, protocol.Error{Error: "meeting not found"})
+		return "", nil, false
+	}
+	return meetingId, meetingEvents, true
+}
+
+// GetMeetingEvents returns the event log of a meeting, which is kept after the meeting
+// has been pruned.
+func GetMeetingEvents(w http.ResponseWriter, r *http.Request) {
+	meetingId, meetingEvents, ok := loadMeetingEvents(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, r, http.StatusOK, meetingEventsReturn{MeetingId: meetingId, Events: meetingEvents})
+}
+
+// GetMeetingReport returns the participation report of a meeting built from its event
+// log, as JSON or, with "format=html", as an HTML page.
+func GetMeetingReport(w http.ResponseWriter, r *http.Request) {
+	// Get logger from request context
+	logger := contextLogger(r.Context()).WithFields(log.Fields{
+		"module":   "audit",
+		"function": "GetMeetingReport",
+	})
+
+	meetingId, meetingEvents, ok := loadMeetingEvents(w, r)
+	if !ok {
+		return
+	}
+	meetingReport := report.Build(meetingId, meetingEvents, Clock.Now())
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		writeJSON(w, r, http.StatusOK, meetingReport)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := report.WriteHTML(w, meetingReport)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Error rendering meeting report.")
+		}
+	default:
+		writeJSON(w, r, http.StatusBadRequest, protocol.Error{Error: "format must be json or html"})
+	}
+}
+
+// exportFormats maps the formats GetMeetingExport supports to their content type, file
+// extension and writer.
+var exportFormats = map[string]struct {
+	contentType string
+	extension   string
+	write       func(io.Writer, report.Export) error
+}{
+	"json": {"application/json", "json", report.WriteJSON},
+	"csv":  {"text/csv; charset=utf-8", "csv", report.WriteCSV},
+	"md":   {"text/markdown; charset=utf-8", "md", report.WriteMarkdown},
+}
+
+// GetMeetingExport downloads a meeting's event log and speaker timeline in the format
+// given by the "format" query parameter: "json" (the default), "csv" for the events or
+// "md" for a Markdown minutes skeleton.
+func GetMeetingExport(w http.ResponseWriter, r *http.Request) {
+	// Get logger from request context
+	logger := contextLogger(r.Context()).WithFields(log.Fields{
+		"module":   "audit",
+		"function": "GetMeetingExport",
+	})
+
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		name = "json"
+	}
+	format, ok := exportFormats[name]
+	if !ok {
+		writeJSON(w, r, http.StatusBadRequest, protocol.Error{Error: "format must be csv, json or md"})
+		return
+	}
+
+	meetingId, meetingEvents, ok := loadMeetingEvents(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"meeting-%s.%s\"", meetingId, format.extension))
+	err := format.write(w, report.NewExport(meetingId, meetingEvents, Clock.Now()))
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Error writing meeting export.")
+	}
+}
@@ -0,0 +1,50 @@
+package wshandler
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"stack-web-app/db"
+	"stack-web-app/events"
+)
+
+func TestStackEventsFollowTheHubClock(t *testing.T) {
+	fake := useFakeClock(t)
+	hub, err := newHub(context.Background(), "", DefaultPrunePolicy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeHub(hub.hubId)
+
+	var (
+		mu       sync.Mutex
+		received []events.Event
+	)
+	unsubscribe := events.Subscribe(func(event events.Event) {
+		if event.MeetingId == hub.hubId {
+			mu.Lock()
+			received = append(received, event)
+			mu.Unlock()
+		}
+	})
+	defer unsubscribe()
+
+	speaker := db.User{SpeakerPostition: 1, SpeakerId: "speaker", Name: "Speaker"}
+	hub.publishStackEvents(replicationMessage{Instance: instanceId}, nil, []db.User{speaker})
+	fake.Advance(90 * time.Second)
+	hub.publishStackEvents(replicationMessage{Instance: instanceId}, []db.User{speaker}, nil)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 4 {
+		t.Fatalf("got %d events, want on, started, off and ended", len(received))
+	}
+	if started, ended := received[1], received[3]; started.Type != events.SpeakingStarted || ended.Type != events.SpeakingEnded {
+		t.Fatalf("events are %s and %s, want speaking started and ended", started.Type, ended.Type)
+	}
+	if spoke := received[3].Time.Sub(received[1].Time); spoke != 90*time.Second {
+		t.Errorf("speaking time is %v by the event times, want the 90s the clock moved", spoke)
+	}
+}
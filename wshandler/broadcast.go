@@ -0,0 +1,197 @@
+package wshandler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"stack-web-app/db"
+	"stack-web-app/logging"
+	"stack-web-app/metrics"
+	"stack-web-app/protocol"
+	"stack-web-app/tracing"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// CoalesceWindow is how long a hub waits after a stack change for more changes before
+// broadcasting the stack, so a burst of actions results in a single broadcast. Zero
+// broadcasts after every change.
+var CoalesceWindow = 50 * time.Millisecond
+
+// ConfigureBroadcast reads the broadcast coalescing window from the
+// BROADCAST_COALESCE_WINDOW environment variable, a Go duration string like "100ms".
+func ConfigureBroadcast() error {
+	return durationFromEnv("BROADCAST_COALESCE_WINDOW", &CoalesceWindow)
+}
+
+// notifyChanged tells the hub that the meeting's stack has changed and should be
+// broadcast, giving up if the hub is stopped so callers don't block forever on a hub
+// that is no longer running.
+func (h *Hub) notifyChanged(ctx context.Context) {
+	select {
+	case h.changed <- ctx:
+	case <-h.done:
+	}
+}
+
+// outbound is a broadcast that is encoded lazily, once for each subprotocol used by
+// the hub's clients rather than once for every client.
+type outbound struct {
+	// Message for legacy clients
+	legacy interface{}
+
+	// Message for stack.v2 clients, nil if they shouldn't be sent anything
+	patched interface{}
+
+	// Encoded messages by subprotocol
+	encoded map[string][]byte
+}
+
+// newOutbound prepares a broadcast of the given messages.
+func newOutbound(legacy interface{}, patched interface{}) *outbound {
+	return &outbound{legacy: legacy, patched: patched, encoded: map[string][]byte{}}
+}
+
+// encode returns the message for clients of the subprotocol, encoding it the first
+// time the subprotocol is seen. It returns nil if there is nothing to send them.
+func (o *outbound) encode(subprotocol string) ([]byte, error) {
+	if message, ok := o.encoded[subprotocol]; ok {
+		return message, nil
+	}
+	message := o.legacy
+	if patches(subprotocol) {
+		message = o.patched
+	}
+	if message == nil {
+		o.encoded[subprotocol] = nil
+		return nil, nil
+	}
+	encoded, err := codecFor(subprotocol).marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	o.encoded[subprotocol] = encoded
+	return encoded, nil
+}
+
+// loadStack reads the meeting's stack into the run goroutine's copy, which patches
+// are computed against. It must only be called from the run goroutine.
+func (h *Hub) loadStack(ctx context.Context) error {
+	stackUsers, err := db.ShowCurrentStack(ctx, h.hubId)
+	if err != nil {
+		return err
+	}
+	h.stack = stackUsers
+	return nil
+}
+
+// snapshot encodes the run goroutine's copy of the stack for a single client, as the
+// bare array for legacy clients or a snapshot message at the current revision for
+// stack.v2 clients, in the client's encoding. It must only be called from the run
+// goroutine.
+func (h *Hub) snapshot(client *Client) ([]byte, error) {
+	if patches(client.protocol) {
+		return client.codec.marshal(protocol.StackMessage{Type: protocol.MessageSnapshot, Rev: h.revision, Stack: h.stack})
+	}
+	return client.codec.marshal(h.stack)
+}
+
+// sendSnapshot queues a snapshot of the stack for a single client, for clients that
+// just joined or asked to resync. It must only be called from the run goroutine.
+func (h *Hub) sendSnapshot(client *Client) {
+	message, err := h.snapshot(client)
+	if err != nil {
+		h.logger.WithField("error", err.Error()).Error("Error encoding stack snapshot.")
+		return
+	}
+	select {
+	case client.send <- message:
+	default:
+	}
+}
+
+// requestSnapshot asks the hub to send the client a fresh snapshot, giving up if the
+// hub is stopped.
+func (h *Hub) requestSnapshot(client *Client) {
+	select {
+	case h.resync <- client:
+	case <-h.done:
+	}
+}
+
+// flush broadcasts the changes made to the stack during the coalescing window, as a
+// patch for stack.v2 clients and the whole stack for legacy clients. ctx is the
+// context of the first of those changes. It must only be called from the run
+// goroutine.
+func (h *Hub) flush(ctx context.Context, changes int) {
+	ctx, span := tracing.Tracer().Start(ctx, "hub.broadcast", trace.WithAttributes(
+		attribute.String("meeting.id", h.hubId),
+		attribute.Int("clients", len(h.clients)),
+		attribute.Int("changes", changes),
+	))
+	defer span.End()
+	logger := h.logger.WithFields(log.Fields{
+		"function": "flush",
+		"changes":  changes,
+	})
+	ctx = logging.WithLogger(ctx, logger)
+
+	metrics.ChangesCoalesced.Add(float64(changes - 1))
+	previous := h.stack
+	err := h.loadStack(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+		logger.WithField("error", err.Error()).Error("Error getting current meeting stack contents.")
+		return
+	}
+
+	// Legacy clients get the whole stack every time. stack.v2 clients only hear about
+	// actual changes.
+	messages := newOutbound(h.stack, nil)
+	if ops := diffStack(previous, h.stack); len(ops) > 0 {
+		h.revision++
+		messages.patched = protocol.StackMessage{Type: protocol.MessagePatch, Rev: h.revision, Ops: ops}
+	}
+	span.SetAttributes(attribute.Int64("revision", int64(h.revision)))
+
+	dropped := h.fanOut(messages)
+	span.SetAttributes(attribute.Int("clients.dropped", dropped))
+}
+
+// fanOut sends every client of the hub the message for its protocol, if there is one,
+// applying the slow consumer policy to clients whose send buffer is full, and returns
+// how many were disconnected. It must only be called from the run goroutine.
+func (h *Hub) fanOut(messages *outbound) (dropped int) {
+	logger := h.logger.WithField("function", "fanOut")
+	logger.WithFields(log.Fields{
+		"message": fmt.Sprintf("%+v", messages.legacy),
+	}).Debug("Message being sent to all clients in hub.")
+	metrics.MessagesBroadcast.Inc()
+	for client := range h.clients {
+		message, err := messages.encode(client.protocol)
+		if err != nil {
+			logger.WithFields(log.Fields{
+				"protocol": client.protocol,
+				"error":    err.Error(),
+			}).Error("Error encoding message for clients.")
+			continue
+		}
+		if message == nil {
+			continue
+		}
+		if !h.deliver(client, message) {
+			dropped++
+			continue
+		}
+		logger.WithFields(log.Fields{
+			"clientId": client.clientId,
+		}).Debug("Broadcast message being sent to client.")
+	}
+	if dropped > 0 {
+		h.publishPresence()
+	}
+	return dropped
+}
@@ -5,18 +5,26 @@
 package wshandler
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"time"
 
-	"stack-web-app/db"
+	"stack-web-app/logging"
+	"stack-web-app/metrics"
+	"stack-web-app/protocol"
+	"stack-web-app/tracing"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -41,6 +49,7 @@ var (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{protocol.ProtocolV2, protocol.ProtocolV2MsgPack, protocol.ProtocolV2CBOR},
 }
 
 // Client is a middleman between the websocket connection and the hub.
@@ -55,11 +64,111 @@ type Client struct {
 
 	// Unique client ID
 	clientId string
+
+	// Span context of the HTTP request that opened the websocket, linked from the
+	// spans of every action the client sends
+	connSpan trace.SpanContext
+
+	// Logger carrying the meeting, client and request IDs for this connection
+	logger *log.Entry
+
+	// Token bucket limiting how quickly the client can send stack actions
+	limiter *rate.Limiter
+
+	// Negotiated websocket subprotocol, empty for legacy clients, and its encoding
+	protocol string
+	codec    codec
+
+	// Whether permessage-deflate was negotiated for the connection
+	compress bool
+
+	// Token the client can reconnect with to keep its place on the stack if it is
+	// disconnected for being too slow
+	resumeToken string
+
+	// Times the client's send buffer has filled up since it last caught up, and
+	// whether it was disconnected for it. Owned by the hub's run goroutine, evicted is
+	// set before send is closed.
+	strikes int
+	evicted bool
+
+	// Whether the client joined with the meeting's moderator token
+	moderator bool
 }
 
-// The websocket information struct for the a new meeting creation POST method
-type WsReturn struct {
-	MeetingId string `json:"meetingId"`
+// prunePolicy applies any per-meeting overrides in the request on top of the server
+// default policy. Grace periods and idle timeouts longer than MaxPrunePolicy allows are
+// rejected, and a meeting may not outlive the server wide maximum lifetime.
+func prunePolicy(m protocol.MeetingRequest) (policy PrunePolicy, err error) {
+	policy = DefaultPrunePolicy
+	overrides := []struct {
+		name   string
+		value  string
+		target *time.Duration
+		limit  time.Duration
+	}{
+		{"gracePeriod", m.GracePeriod, &policy.GracePeriod, maxDuration(MaxPrunePolicy.GracePeriod, DefaultPrunePolicy.GracePeriod)},
+		{"idleTimeout", m.IdleTimeout, &policy.IdleTimeout, maxDuration(MaxPrunePolicy.IdleTimeout, DefaultPrunePolicy.IdleTimeout)},
+		{"maxLifetime", m.MaxLifetime, &policy.MaxLifetime, 0},
+	}
+	for _, override := range overrides {
+		if override.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(override.value)
+		if err != nil || d < 0 {
+			return policy, fmt.Errorf("%s must be a non-negative duration like \"30m\"", override.name)
+		}
+		if override.limit > 0 && d > override.limit {
+			return policy, fmt.Errorf("%s may be at most %s", override.name, override.limit)
+		}
+		*override.target = d
+	}
+	limit := DefaultPrunePolicy.MaxLifetime
+	if limit > 0 && (policy.MaxLifetime == 0 || policy.MaxLifetime > limit) {
+		policy.MaxLifetime = limit
+	}
+	return policy, nil
+}
+
+// maxDuration returns the longer of two durations.
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// errorMessage encodes an error to send to a websocket client.
+func errorMessage(c codec, err error) []byte {
+	message, _ := c.marshal(protocol.Error{Error: err.Error()})
+	return message
+}
+
+// newWsReturn builds the API description of a meeting hub.
+func newWsReturn(hub *Hub) protocol.Meeting {
+	return protocol.Meeting{
+		MeetingId:   hub.hubId,
+		MeetingCode: hub.code,
+		Slug:        hub.slug,
+	}
+}
+
+// writeJSON marshals the body and writes it to the response with the given status.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, body interface{}) {
+	logger := contextLogger(r.Context())
+	rJson, err := json.Marshal(body)
+	if err != nil {
+		logger.Error("Error marshalling JSON response.")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(rJson)
+	if err != nil {
+		logger.Error("Error writing JSON response back to web session.")
+	}
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -68,79 +177,100 @@ type WsReturn struct {
 // ensures that there is at most one reader on a connection by executing all
 // reads from this goroutine.
 func (c *Client) readPump() {
-	// Update context logger
-	ContextLogger = ContextLogger.WithFields(log.Fields{
-		"module":   "client",
-		"function": "readPump",
-		"client":   fmt.Sprintf("%+v", c),
-		"hub":      fmt.Sprintf("%+v", c.hub),
-	})
+	// Get client logger
+	logger := c.logger.WithField("function", "readPump")
 
 	defer func() {
-		c.hub.unregister <- c
+		c.hub.sendUnregister(c)
 		c.conn.Close()
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
-	err := c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	if err != nil {
-		ContextLogger.Error("Error setting client connection read deadline")
-	}
+
+	// Drop the connection if the client stops answering pings. The deadline is kept
+	// on the hub's clock rather than as a read deadline on the connection so that it can be
+	// tested without waiting for it.
+	pongTimer := c.hub.clock.AfterFunc(pongWait, func() {
+		logger.Debug("Client stopped answering pings.")
+		c.conn.Close()
+	})
+	defer pongTimer.Stop()
 	c.conn.SetPongHandler(func(string) error {
-		err := c.conn.SetReadDeadline(time.Now().Add(pongWait))
-		if err != nil {
-			ContextLogger.Error("Error setting client connection read deadline")
-		}
+		pongTimer.Reset(pongWait)
 		return nil
 	})
 	for {
-		// Read next JSON message for user updates
-		type userMessage struct {
-			TableId string
-			Action  string
-			Name    string
-		}
-		var messageJson userMessage
-		err := c.conn.ReadJSON(&messageJson)
+		// Read next message for user updates, JSON in text frames or the client's
+		// binary encoding
+		var messageJson protocol.ClientMessage
+		messageType, data, err := c.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				ContextLogger.WithFields(log.Fields{
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				logger.WithFields(log.Fields{
 					"closeError": err.Error(),
 				}).Error("Unexpected closure from client.")
 			}
 			break
 		}
+		unmarshal := json.Unmarshal
+		if messageType == websocket.BinaryMessage {
+			unmarshal = c.codec.unmarshal
+		}
+		err = unmarshal(data, &messageJson)
+		if err != nil {
+			logger.WithField("error", err.Error()).Warning("Unable to decode message from client.")
+			break
+		}
 
-		// Put user on/off stack based on action in request
-		if messageJson.Action == "on" {
-			err := db.GetOnStack(messageJson.TableId, c.clientId, messageJson.Name)
-			if err != nil {
-				ContextLogger.Error("Error getting user on stack")
-			}
-		} else if messageJson.Action == "off" {
-			err := db.GetOffStack(messageJson.TableId, c.clientId)
-			if err != nil {
-				ContextLogger.Error("Error getting user on stack")
-			}
+		// Trace handling of the action, linked back to the request that opened the socket
+		ctx, span := tracing.Tracer().Start(context.Background(), "websocket.action",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithLinks(trace.Link{SpanContext: c.connSpan}),
+			trace.WithAttributes(
+				attribute.String("meeting.id", c.hub.hubId),
+				attribute.String("client.id", c.clientId),
+				attribute.String("action", messageJson.Action),
+			),
+		)
+		ctx = logging.WithLogger(ctx, c.logger)
+
+		// Tell clients spamming actions to slow down rather than hitting the database
+		// and every other client in the meeting
+		if !c.limiter.AllowN(c.hub.clock.Now(), 1) {
+			metrics.RateLimited.WithLabelValues("action").Inc()
+			logger.Debug("Client is sending actions too quickly.")
+			c.hub.sendTo(c, errorMessage(c.codec, ErrActionRateLimited))
+			span.End()
+			continue
 		}
 
-		// Get current stack back and push to the broadcast message queue
-		stackUsers, err := db.ShowCurrentStack(messageJson.TableId)
-		if err != nil {
-			ContextLogger.WithFields(log.Fields{
-				"dbError": err.Error(),
-			}).Error("Error getting current meeting stack contents.")
+		// Clients that missed a patch get a fresh snapshot from this instance only
+		if messageJson.Action == protocol.ActionResync {
+			logger.Debug("Client asked for a fresh snapshot.")
+			c.hub.requestSnapshot(c)
+			span.End()
+			continue
 		}
-		messageUsers, err := json.Marshal(stackUsers)
-		if err != nil {
-			ContextLogger.WithFields(log.Fields{
-				"dbError": err.Error(),
-			}).Error("Error marshalling JSON for response to client.")
+
+		// Send the action to every instance serving the meeting, which put the user
+		// on/off the stack and broadcast the result. The TableId sent by the client is
+		// ignored in favour of the hub the client joined so that meetings joined by code
+		// or slug resolve to the right table.
+		err = c.hub.apply(ctx, Action{
+			Action:    messageJson.Action,
+			SpeakerId: c.clientId,
+			Name:      messageJson.Name,
+			TargetId:  messageJson.SpeakerId,
+			Moderator: c.moderator,
+		})
+		switch {
+		case err == ErrNotModerator:
+			logger.Debug("Client tried a moderator action without the moderator token.")
+			c.hub.sendTo(c, errorMessage(c.codec, ErrNotModerator))
+		case err != nil:
+			tracing.RecordError(span, err)
+			logger.WithField("error", err.Error()).Error("Error publishing stack action to the backplane.")
 		}
-		message := bytes.TrimSpace(bytes.Replace(messageUsers, newline, space, -1))
-		ContextLogger.WithFields(log.Fields{
-			"message": fmt.Sprintf("%+v", string(message)),
-		}).Debug("Sending message from client to hub broadcast.")
-		c.hub.broadcast <- message
+		span.End()
 	}
 }
 
@@ -150,16 +280,12 @@ func (c *Client) readPump() {
 // application ensures that there is at most one writer to a connection by
 // executing all writes from this goroutine.
 func (c *Client) writePump() {
-	// Update context logger
-	ContextLogger = ContextLogger.WithFields(log.Fields{
-		"module":   "client",
-		"function": "writePump",
-		"client":   fmt.Sprintf("%+v", c),
-		"hub":      fmt.Sprintf("%+v", c.hub),
-	})
+	// Get client logger
+	logger := c.logger.WithField("function", "writePump")
 
-	// Set ticker
-	ticker := time.NewTicker(pingPeriod)
+	// Set ticker. Write deadlines are enforced by the network stack, so unlike the
+	// pings they stay on the real clock.
+	ticker := c.hub.clock.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
@@ -167,77 +293,96 @@ func (c *Client) writePump() {
 	for {
 		select {
 		case message, ok := <-c.send:
-			ContextLogger.Debug("Sending message to client?")
+			logger.Debug("Sending message to client?")
 			err := c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err != nil {
-				ContextLogger.Error("Error setting write deadline for client.")
+				logger.Error("Error setting write deadline for client.")
 			}
 			if !ok {
 				// The hub closed the channel.
-				ContextLogger.Debug("Hub has closed this channel, sending update to users.")
+				logger.Debug("Hub has closed this channel, sending update to users.")
+
+				// Slow clients keep their place on the stack for a while so they can resume.
+				// Legacy clients aren't sent a welcome message, so the close reason is the
+				// only place they can learn their resume token from.
+				if c.evicted {
+					_ = c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow to keep up, resume="+c.resumeToken))
+					return
+				}
 
 				// We don't care if the write message fails, so to appease the golangci-lint gods we just log err out to nothing
 				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 
-				// Sending update to all still connected clients// Get current stack back and push to the broadcast message queue
-				err = db.GetOffStack(c.hub.hubId, c.clientId)
-				if err != nil {
-					ContextLogger.Error("Error getting user off stack from client closure.")
-				}
-				stackUsers, err := db.ShowCurrentStack(c.hub.hubId)
-				if err != nil {
-					ContextLogger.WithFields(log.Fields{
-						"dbError": err.Error(),
-					}).Error("Error getting current meeting stack contents.")
+				// If the whole meeting has been pruned there is nobody left to update
+				if c.hub.stopped() {
+					return
 				}
-				messageUsers, err := json.Marshal(stackUsers)
+
+				// Take the user off the stack and update all still connected clients
+				ctx, span := tracing.Tracer().Start(context.Background(), "websocket.disconnect",
+					trace.WithLinks(trace.Link{SpanContext: c.connSpan}),
+					trace.WithAttributes(
+						attribute.String("meeting.id", c.hub.hubId),
+						attribute.String("client.id", c.clientId),
+					),
+				)
+				defer span.End()
+				ctx = logging.WithLogger(ctx, c.logger)
+				err = c.hub.publishMutation(ctx, protocol.ActionOff, c.clientId, "")
 				if err != nil {
-					ContextLogger.WithFields(log.Fields{
-						"dbError": err.Error(),
-					}).Error("Error marshalling JSON for response to client.")
+					logger.Error("Error getting user off stack from client closure.")
 				}
-				message := bytes.TrimSpace(bytes.Replace(messageUsers, newline, space, -1))
-				ContextLogger.WithFields(log.Fields{
-					"message": fmt.Sprintf("%+v", string(message)),
-				}).Debug("Sending message from client to hub broadcast.")
-				c.hub.broadcast <- message
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			_, err = w.Write(message)
-			if err != nil {
-				ContextLogger.Error("Error writing back message to rest of clients after client connection closed.")
+			// Binary encodings can't be joined with newlines, so they get a frame each
+			if c.codec.binary {
+				c.compressFrame(message)
+				err = c.conn.WriteMessage(websocket.BinaryMessage, message)
+				if err != nil {
+					logger.Warning("Error writing binary message to client.")
+					return
+				}
+				continue
 			}
 
 			// Add queued chat messages to the current websocket message.
+			frame := [][]byte{message}
 			n := len(c.send)
 			for i := 0; i < n; i++ {
-				_, err = w.Write(newline)
-				if err != nil {
-					ContextLogger.Error("Error writing back newline back to rest of clients after client connection closed.")
+				frame = append(frame, <-c.send)
+			}
+			c.compressFrame(frame...)
+
+			w, err := c.conn.NextWriter(websocket.TextMessage)
+			if err != nil {
+				return
+			}
+			for i, queued := range frame {
+				if i > 0 {
+					_, err = w.Write(newline)
+					if err != nil {
+						logger.Error("Error writing back newline back to rest of clients after client connection closed.")
+					}
 				}
-				_, err = w.Write(<-c.send)
+				_, err = w.Write(queued)
 				if err != nil {
-					ContextLogger.Error("Error sending message to rest of clients after client connection closed.")
+					logger.Error("Error sending message to rest of clients after client connection closed.")
 				}
 			}
 
 			if err := w.Close(); err != nil {
-				ContextLogger.Warning("Error closing writer channel or something?")
+				logger.Warning("Error closing writer channel or something?")
 				return
 			}
-		case <-ticker.C:
+		case <-ticker.C():
 			err := c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err != nil {
-				ContextLogger.Error("Error setting write deadline for client connection.")
+				logger.Error("Error setting write deadline for client connection.")
 			}
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				ContextLogger.Warning("Error pinging the websocket, assuming client is dead and unregistering.")
-				c.hub.unregister <- c
+				logger.Warning("Error pinging the websocket, assuming client is dead and unregistering.")
+				c.hub.sendUnregister(c)
 				return
 			}
 		}
@@ -245,27 +390,28 @@ func (c *Client) writePump() {
 }
 
 // GetWS sets up the new WebSocket and connects the client to it. On first connect it also fetches
-// the current speaker stack and pushes it out to all the connected clients.
+// the current speaker stack and pushes it out to the new client. Clients passing the
+// meeting's token in the "moderator" query parameter may use the moderator actions.
 func GetWS(w http.ResponseWriter, r *http.Request) {
-	// Update context logger
-	ContextLogger = ContextLogger.WithFields(log.Fields{
+	// Get logger from request context
+	logger := contextLogger(r.Context()).WithFields(log.Fields{
 		"module":   "client",
 		"function": "GetWS",
 	})
 
-	// Getting hub ID from http request query params
-	hubId := r.URL.Query().Get("meeting_id")
-	ContextLogger = ContextLogger.WithField("hubId", hubId)
-	var hub *Hub
+	// Getting hub ID, meeting code or slug from http request query params
+	meetingRef := r.URL.Query().Get("meeting_id")
+	logger = logger.WithField("meetingRef", meetingRef)
 
 	// Look for existing meeting hub from ID provided in URL
-	if v, ok := HubPool[hubId]; ok {
-		hub = v
-		ContextLogger = ContextLogger.WithField("hub", fmt.Sprintf("%+v", hub))
-	} else {
-		ContextLogger.Debug("Meeting not found.")
+	hub, ok := lookupHub(meetingRef)
+	if !ok {
+		logger.Debug("Meeting not found.")
+		writeJSON(w, r, http.StatusNotFound, protocol.Error{Error: "meeting not found"})
 		return
 	}
+	hubId := hub.hubId
+	logger = logger.WithField("hubId", hubId)
 
 	// This is to enable local testing for myself. Probably stupid
 	_, disableCORS := os.LookupEnv("DISABLEWEBSOCKETORIGINCHECK")
@@ -275,63 +421,163 @@ func GetWS(w http.ResponseWriter, r *http.Request) {
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		metrics.UpgradeFailures.Inc()
+		logger.WithField("error", err.Error()).Warning("Error upgrading websocket connection.")
 		return
 	}
-	clientId := uuid.New().String()
-	ContextLogger = ContextLogger.WithField("clientId", clientId)
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), clientId: clientId}
-	ContextLogger = ContextLogger.WithField("client", fmt.Sprintf("%+v", client))
-	client.hub.register <- client
-	ContextLogger.Debug("New client successfully registered with hub.")
-
-	// Push current stack out to clients. Should update eventually to only push out to new users somehow
-	// Get current stack back and push to the broadcast message queue
-	stackUsers, err := db.ShowCurrentStack(hubId)
-	if err != nil {
-		ContextLogger.WithField("error", err.Error()).Error("Error fetching current speaker stack.")
+
+	// Turn people away from full meetings with a message the client can show them
+	if hub.full() {
+		metrics.RateLimited.WithLabelValues("meeting_clients").Inc()
+		logger.Debug("Meeting is full.")
+		_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+		codec := codecFor(conn.Subprotocol())
+		_ = conn.WriteMessage(codec.frameType(), errorMessage(codec, errMeetingFull))
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, errMeetingFull.Error()))
+		_ = conn.Close()
+		return
 	}
-	messageUsers, err := json.Marshal(stackUsers)
-	if err != nil {
-		ContextLogger.WithField("error", err.Error()).Error("Error marshaling current stack for client response message.")
+
+	if compressionRequested(r) {
+		err = conn.SetCompressionLevel(DefaultCompression.Level)
+		if err != nil {
+			logger.WithField("error", err.Error()).Warning("Error setting websocket compression level.")
+		}
 	}
-	message := bytes.TrimSpace(bytes.Replace(messageUsers, newline, space, -1))
-	client.hub.broadcast <- message
-	ContextLogger.Debug("Message successfully sent to hub broadcast channel.")
+
+	// Slow clients that were disconnected get their old client ID back, and with it
+	// their place on the stack
+	clientId, resumed := hub.resume(r.URL.Query().Get("resume"))
+	resumeToken := r.URL.Query().Get("resume")
+	if !resumed {
+		clientId = uuid.New().String()
+		resumeToken = uuid.New().String()
+	}
+	logger = logger.WithFields(log.Fields{
+		"clientId": clientId,
+		"resumed":  resumed,
+	})
+	client := &Client{
+		hub:         hub,
+		conn:        conn,
+		send:        make(chan []byte, 256),
+		clientId:    clientId,
+		connSpan:    trace.SpanContextFromContext(r.Context()),
+		limiter:     NewActionLimiter(),
+		protocol:    conn.Subprotocol(),
+		codec:       codecFor(conn.Subprotocol()),
+		compress:    compressionRequested(r),
+		resumeToken: resumeToken,
+		moderator:   hub.isModerator(r.URL.Query().Get("moderator")),
+		logger: contextLogger(r.Context()).WithFields(log.Fields{
+			"module":   "client",
+			"hubId":    hubId,
+			"clientId": clientId,
+		}),
+	}
+	select {
+	case client.hub.register <- client:
+	case <-client.hub.done:
+		logger.Debug("Meeting was pruned before the client could register.")
+		_ = conn.Close()
+		return
+	}
+	logger.Debug("New client successfully registered with hub, which sends it the current stack.")
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
-	ContextLogger.Debug("Starting client read/write goroutines.")
+	logger.Debug("Starting client read/write goroutines.")
 	go client.writePump()
 	go client.readPump()
 }
 
-// PostWS creates new meeting table in SQLite DB and returns the ID to the client
+// PostWS creates new meeting table in SQLite DB and returns the ID to the client. The
+// request body may optionally be a JSON object with a custom "slug" for the meeting
+// and "gracePeriod", "idleTimeout" or "maxLifetime" overrides for pruning.
 func PostWS(w http.ResponseWriter, r *http.Request) {
-	// Update context logger
-	ContextLogger = ContextLogger.WithFields(log.Fields{
+	// Get logger from request context
+	logger := contextLogger(r.Context()).WithFields(log.Fields{
 		"module":   "client",
 		"function": "PostWS",
 	})
 
-	// Create new hub for meeting and return to be used for client creation
-	hub := newHub()
-	ContextLogger = ContextLogger.WithField("hub", fmt.Sprintf("%+v", hub))
-	ContextLogger.Debug("Starting new hub goroutine.")
-	go hub.run()
+	// Stop a single address from creating unlimited meetings
+	if !allowMeetingCreation(clientIP(r)) {
+		metrics.RateLimited.WithLabelValues("meeting_create").Inc()
+		w.Header().Set("Retry-After", "60")
+		writeJSON(w, r, http.StatusTooManyRequests, protocol.Error{Error: errMeetingRateLimited.Error()})
+		return
+	}
 
-	// Return new meeting ID to client
-	returnBlob := WsReturn{hub.hubId}
-	rJson, err := json.Marshal(returnBlob)
+	// Read optional meeting options from the request body
+	var request protocol.MeetingRequest
+	if r.Body != nil {
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil && err != io.EOF {
+			logger.WithField("error", err.Error()).Debug("Invalid meeting creation request body.")
+			writeJSON(w, r, http.StatusBadRequest, protocol.Error{Error: "invalid request body: " + err.Error()})
+			return
+		}
+	}
+
+	policy, err := prunePolicy(request)
 	if err != nil {
-		ContextLogger.Error("Error marshalling JSON response.")
+		writeJSON(w, r, http.StatusBadRequest, protocol.Error{Error: err.Error()})
 		return
 	}
-	ContextLogger.WithField("responseJson", fmt.Sprintf("%+v", returnBlob)).Debug("Sending response to requestor.")
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	_, err = w.Write(rJson)
+
+	err = validateWebhooks(request.Webhooks)
 	if err != nil {
-		ContextLogger.Error("Error writing response back to web session after user requested new meeting.")
+		writeJSON(w, r, http.StatusBadRequest, protocol.Error{Error: err.Error()})
+		return
+	}
+
+	// Create new hub for meeting and return to be used for client creation
+	hub, err := newHub(r.Context(), request.Slug, policy, request.Webhooks)
+	switch err {
+	case nil:
+	case ErrInvalidSlug:
+		writeJSON(w, r, http.StatusBadRequest, protocol.Error{Error: err.Error()})
+		return
+	case ErrSlugTaken:
+		writeJSON(w, r, http.StatusConflict, protocol.Error{Error: err.Error()})
+		return
+	case ErrTooManyMeetings:
+		metrics.RateLimited.WithLabelValues("meetings").Inc()
+		writeJSON(w, r, http.StatusServiceUnavailable, protocol.Error{Error: err.Error()})
+		return
+	default:
+		logger.WithField("error", err.Error()).Error("Error creating new meeting hub.")
+		writeJSON(w, r, http.StatusInternalServerError, protocol.Error{Error: "unable to create meeting"})
+		return
+	}
+	logger = logger.WithField("hubId", hub.hubId)
+	logger.Debug("Starting new hub goroutine.")
+	go hub.run()
+
+	// Return new meeting ID to client
+	returnBlob := newWsReturn(hub)
+	logger.WithField("responseJson", fmt.Sprintf("%+v", returnBlob)).Debug("Sending response to requestor.")
+	returnBlob.ModeratorToken = hub.moderatorToken
+	returnBlob.WebhookSecret = hub.webhookSecret
+	writeJSON(w, r, http.StatusOK, returnBlob)
+}
+
+// GetMeeting resolves a meeting UUID, code or slug and returns the meeting details so
+// clients can turn a code read out on a call into the meeting ID.
+func GetMeeting(w http.ResponseWriter, r *http.Request) {
+	// Get logger from request context
+	logger := contextLogger(r.Context()).WithFields(log.Fields{
+		"module":   "client",
+		"function": "GetMeeting",
+	})
+
+	meetingRef := mux.Vars(r)["meetingId"]
+	hub, ok := lookupHub(meetingRef)
+	if !ok {
+		logger.WithField("meetingRef", meetingRef).Debug("Meeting not found.")
+		writeJSON(w, r, http.StatusNotFound, protocol.Error{Error: "meeting not found"})
+		return
 	}
+	writeJSON(w, r, http.StatusOK, newWsReturn(hub))
 }
@@ -0,0 +1,82 @@
+package wshandler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"stack-web-app/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClientsThatStopAnsweringPingsAreDropped(t *testing.T) {
+	fake := useFakeClock(t)
+	hub, err := newHub(context.Background(), "", DefaultPrunePolicy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hub.run()
+	server := httptest.NewServer(http.HandlerFunc(GetWS))
+	defer server.Close()
+
+	// The client never reads from the connection, so it never answers pings
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?meeting_id="+hub.hubId, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Wait for the ping ticker and pong deadline of the client's pumps
+	fake.BlockUntil(2)
+	waitFor(t, "the client to register", func() bool { return hub.clientCount() == 1 })
+
+	fake.Advance(pongWait - time.Second)
+	if hub.clientCount() != 1 {
+		t.Fatal("client was dropped before the pong deadline")
+	}
+	fake.Advance(time.Second)
+	waitFor(t, "the client to be dropped", func() bool { return hub.clientCount() == 0 })
+}
+
+func TestPrunePolicyOverridesAreCapped(t *testing.T) {
+	previousDefault, previousMax := DefaultPrunePolicy, MaxPrunePolicy
+	defer func() { DefaultPrunePolicy, MaxPrunePolicy = previousDefault, previousMax }()
+	DefaultPrunePolicy = PrunePolicy{GracePeriod: 5 * time.Minute, IdleTimeout: 2 * time.Hour, MaxLifetime: 24 * time.Hour}
+	MaxPrunePolicy = PrunePolicy{GracePeriod: time.Hour, IdleTimeout: time.Hour}
+
+	tests := []struct {
+		name    string
+		request protocol.MeetingRequest
+		want    PrunePolicy
+		invalid bool
+	}{
+		{"defaults", protocol.MeetingRequest{}, DefaultPrunePolicy, false},
+		{"within limits", protocol.MeetingRequest{GracePeriod: "1h", IdleTimeout: "30m"},
+			PrunePolicy{GracePeriod: time.Hour, IdleTimeout: 30 * time.Minute, MaxLifetime: 24 * time.Hour}, false},
+		{"grace period too long", protocol.MeetingRequest{GracePeriod: "876000h"}, PrunePolicy{}, true},
+		{"idle timeout up to the longer default", protocol.MeetingRequest{IdleTimeout: "2h"}, DefaultPrunePolicy, false},
+		{"idle timeout too long", protocol.MeetingRequest{IdleTimeout: "2h1m"}, PrunePolicy{}, true},
+		{"lifetime shortened", protocol.MeetingRequest{MaxLifetime: "1h"},
+			PrunePolicy{GracePeriod: 5 * time.Minute, IdleTimeout: 2 * time.Hour, MaxLifetime: time.Hour}, false},
+		{"lifetime clamped", protocol.MeetingRequest{MaxLifetime: "0s"}, DefaultPrunePolicy, false},
+		{"negative", protocol.MeetingRequest{GracePeriod: "-1m"}, PrunePolicy{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, err := prunePolicy(test.request)
+			if test.invalid {
+				if err == nil {
+					t.Errorf("prunePolicy() = %+v, want an error", policy)
+				}
+				return
+			}
+			if err != nil || policy != test.want {
+				t.Errorf("prunePolicy() = %+v, %v, want %+v", policy, err, test.want)
+			}
+		})
+	}
+}
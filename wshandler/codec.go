@@ -0,0 +1,85 @@
+package wshandler
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"stack-web-app/protocol"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// codec encodes and decodes the messages exchanged with clients of a subprotocol.
+type codec struct {
+	// Binary codecs send every message in its own binary frame, text codecs join
+	// queued messages with newlines in a single text frame.
+	binary    bool
+	marshal   func(v interface{}) ([]byte, error)
+	unmarshal func(data []byte, v interface{}) error
+}
+
+// jsonCodec is used by legacy and stack.v2 clients.
+var jsonCodec = codec{
+	marshal:   encodeMessage,
+	unmarshal: json.Unmarshal,
+}
+
+// codecs maps each supported subprotocol to its codec, with legacy clients under the
+// empty string.
+var codecs = map[string]codec{
+	"":                  jsonCodec,
+	protocol.ProtocolV2: jsonCodec,
+	protocol.ProtocolV2MsgPack: {
+		binary:    true,
+		marshal:   marshalMsgPack,
+		unmarshal: unmarshalMsgPack,
+	},
+	protocol.ProtocolV2CBOR: {
+		binary:    true,
+		marshal:   cbor.Marshal,
+		unmarshal: cbor.Unmarshal,
+	},
+}
+
+// marshalMsgPack encodes a message with MessagePack, using the JSON field names.
+func marshalMsgPack(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := msgpack.NewEncoder(&buffer)
+	encoder.SetCustomStructTag("json")
+	encoder.UseCompactInts(true)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// unmarshalMsgPack decodes a MessagePack message, using the JSON field names.
+func unmarshalMsgPack(data []byte, v interface{}) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(v)
+}
+
+// codecFor returns the codec for a negotiated subprotocol.
+func codecFor(subprotocol string) codec {
+	if c, ok := codecs[subprotocol]; ok {
+		return c
+	}
+	return jsonCodec
+}
+
+// frameType is the websocket message type the codec's messages are sent in.
+func (c codec) frameType() int {
+	if c.binary {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// patches reports whether clients of the subprotocol get snapshot and patch messages
+// rather than the bare stack.
+func patches(subprotocol string) bool {
+	return subprotocol != ""
+}
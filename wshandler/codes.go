@@ -0,0 +1,159 @@
+package wshandler
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"sync"
+
+	"stack-web-app/metrics"
+
+	"github.com/google/uuid"
+)
+
+// Word lists used to build human friendly meeting codes like BRAVE-OTTER-42. They are
+// kept short and free of homophones so the codes are easy to read out loud on a call.
+var (
+	codeAdjectives = []string{
+		"AMBER", "BRAVE", "BRISK", "CALM", "CLEVER", "COSMIC", "CRISP", "DARING",
+		"EAGER", "FANCY", "GENTLE", "GOLDEN", "HAPPY", "JOLLY", "KIND", "LIVELY",
+		"LUCKY", "MELLOW", "MIGHTY", "NIMBLE", "PLUCKY", "PROUD", "QUICK", "QUIET",
+		"RAPID", "ROYAL", "RUSTY", "SILVER", "SUNNY", "SWIFT", "TIDY", "WITTY",
+	}
+	codeAnimals = []string{
+		"BADGER", "BEAVER", "BISON", "COYOTE", "CRANE", "DOLPHIN", "EAGLE", "FALCON",
+		"FERRET", "GECKO", "HERON", "IBIS", "JACKAL", "KOALA", "LEMUR", "LLAMA",
+		"LYNX", "MARMOT", "MOOSE", "OTTER", "PANDA", "PELICAN", "PUFFIN", "RAVEN",
+		"SALMON", "SEAL", "TAPIR", "TOUCAN", "TURTLE", "WALRUS", "WOMBAT", "ZEBRA",
+	}
+)
+
+// maxCodeAttempts is how many random codes we will try before giving up on finding
+// one that is not already in use.
+const maxCodeAttempts = 32
+
+// slugPattern restricts custom slugs to lower case letters, digits and single hyphens
+// so they are safe to put in a URL and easy to type.
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+var (
+	// ErrInvalidSlug is returned when a requested custom slug is malformed.
+	ErrInvalidSlug = errors.New("slug must be 3-64 characters of lower case letters, digits and hyphens")
+
+	// ErrSlugTaken is returned when a requested custom slug is already in use by
+	// another meeting.
+	ErrSlugTaken = errors.New("slug is already in use by another meeting")
+
+	// ErrNoCodeAvailable is returned when we could not find a free meeting code.
+	ErrNoCodeAvailable = errors.New("unable to generate a unique meeting code")
+)
+
+// hubAliases maps lower cased meeting codes and slugs to the hub ID they belong to.
+// It shares hubPoolLock with HubPool so that collision checks and registration
+// happen atomically.
+var hubAliases = map[string]string{}
+
+// hubPoolLock guards HubPool and hubAliases.
+var hubPoolLock sync.RWMutex
+
+// normalizeAlias returns the lookup key used for meeting codes and slugs so that
+// BRAVE-OTTER-42, brave-otter-42 and " Brave-Otter-42 " all resolve the same way.
+func normalizeAlias(alias string) string {
+	return strings.ToLower(strings.TrimSpace(alias))
+}
+
+// validateSlug checks that a requested custom slug is well formed and can not be
+// confused with a raw meeting UUID.
+func validateSlug(slug string) error {
+	if len(slug) < 3 || len(slug) > 64 || !slugPattern.MatchString(slug) {
+		return ErrInvalidSlug
+	}
+	if _, err := uuid.Parse(slug); err == nil {
+		return ErrInvalidSlug
+	}
+	return nil
+}
+
+// randomIndex returns a uniformly random index in [0, n).
+func randomIndex(n int) int {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		// crypto/rand failing is not something we can recover from in a useful way
+		panic(err)
+	}
+	return int(i.Int64())
+}
+
+// generateMeetingCode builds a random ADJECTIVE-ANIMAL-NN meeting code.
+func generateMeetingCode() string {
+	return fmt.Sprintf("%s-%s-%d",
+		codeAdjectives[randomIndex(len(codeAdjectives))],
+		codeAnimals[randomIndex(len(codeAnimals))],
+		10+randomIndex(90),
+	)
+}
+
+// reserveAliases picks an unused meeting code and, if requested, claims the custom
+// slug for the given hub ID. The caller must hold hubPoolLock for writing.
+func reserveAliases(hubId string, slug string) (code string, err error) {
+	if slug != "" {
+		if _, taken := hubAliases[slug]; taken {
+			return "", ErrSlugTaken
+		}
+	}
+
+	for i := 0; i < maxCodeAttempts; i++ {
+		candidate := generateMeetingCode()
+		key := normalizeAlias(candidate)
+		if _, taken := hubAliases[key]; taken || key == slug {
+			continue
+		}
+		code = candidate
+		break
+	}
+	if code == "" {
+		return "", ErrNoCodeAvailable
+	}
+
+	hubAliases[normalizeAlias(code)] = hubId
+	if slug != "" {
+		hubAliases[slug] = hubId
+	}
+	return code, nil
+}
+
+// lookupHub resolves a meeting UUID, meeting code or custom slug to its hub.
+func lookupHub(meetingRef string) (hub *Hub, ok bool) {
+	hubPoolLock.RLock()
+	defer hubPoolLock.RUnlock()
+
+	if hub, ok = HubPool[meetingRef]; ok {
+		return hub, true
+	}
+	if hubId, found := hubAliases[normalizeAlias(meetingRef)]; found {
+		hub, ok = HubPool[hubId]
+	}
+	return hub, ok
+}
+
+// removeHub drops a hub and any codes or slugs pointing at it from the pool.
+func removeHub(hubId string) {
+	hubPoolLock.Lock()
+	defer hubPoolLock.Unlock()
+
+	if hub, ok := HubPool[hubId]; ok {
+		for _, alias := range []string{hub.code, hub.slug} {
+			// Only drop aliases this hub actually owns, a replicated meeting may not
+			// have been able to claim its code or slug locally
+			key := normalizeAlias(alias)
+			if alias != "" && hubAliases[key] == hubId {
+				delete(hubAliases, key)
+			}
+		}
+	}
+	delete(HubPool, hubId)
+	metrics.ActiveMeetings.Set(float64(len(HubPool)))
+}
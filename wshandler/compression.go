@@ -0,0 +1,133 @@
+package wshandler
+
+import (
+	"compress/flate"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"stack-web-app/metrics"
+)
+
+// compressionSampleRate is how many compressed frames there are for each one that is
+// compressed a second time to estimate the bytes saved, which would otherwise double
+// the CPU spent on compression.
+const compressionSampleRate = 64
+
+// compressedFrames counts the compressed frames for sampling.
+var compressedFrames uint64
+
+// Compression configures permessage-deflate for websocket connections.
+type Compression struct {
+	// Enabled offers compression to clients that ask for it.
+	Enabled bool
+
+	// Threshold is the size in bytes from which frames are compressed, smaller frames
+	// aren't worth the CPU.
+	Threshold int
+
+	// Level is the flate compression level, from -2 (Huffman only) to 9.
+	Level int
+}
+
+// DefaultCompression is the compression used unless configured otherwise.
+var DefaultCompression = Compression{
+	Threshold: 512,
+	Level:     flate.BestSpeed,
+}
+
+// ConfigureCompression reads the websocket compression settings from the
+// WEBSOCKET_COMPRESSION (set to "true" to enable), WEBSOCKET_COMPRESSION_THRESHOLD
+// (bytes) and WEBSOCKET_COMPRESSION_LEVEL environment variables.
+func ConfigureCompression() error {
+	DefaultCompression.Enabled = strings.EqualFold(os.Getenv("WEBSOCKET_COMPRESSION"), "true")
+	if err := intFromEnv("WEBSOCKET_COMPRESSION_THRESHOLD", &DefaultCompression.Threshold); err != nil {
+		return err
+	}
+	if value, ok := os.LookupEnv("WEBSOCKET_COMPRESSION_LEVEL"); ok {
+		level, err := strconv.Atoi(value)
+		if err != nil || level < flate.HuffmanOnly || level > flate.BestCompression {
+			return fmt.Errorf("invalid value for WEBSOCKET_COMPRESSION_LEVEL: must be between %d and %d", flate.HuffmanOnly, flate.BestCompression)
+		}
+		DefaultCompression.Level = level
+	}
+	upgrader.EnableCompression = DefaultCompression.Enabled
+	return nil
+}
+
+// compressionRequested reports whether the client offered permessage-deflate, which
+// the upgrader accepts whenever compression is enabled.
+func compressionRequested(r *http.Request) bool {
+	if !DefaultCompression.Enabled {
+		return false
+	}
+	for _, extension := range r.Header.Values("Sec-Websocket-Extensions") {
+		if strings.Contains(extension, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// compressFrame decides whether the next frame written to the client, made up of the
+// given messages, should be compressed, and estimates the bytes compression saves from
+// a sample of the frames.
+func (c *Client) compressFrame(messages ...[]byte) {
+	if !c.compress {
+		return
+	}
+	size := 0
+	for _, message := range messages {
+		size += len(message)
+	}
+	compress := size >= DefaultCompression.Threshold
+	c.conn.EnableWriteCompression(compress)
+	if !compress {
+		return
+	}
+	metrics.CompressedFrames.Inc()
+	if atomic.AddUint64(&compressedFrames, 1)%compressionSampleRate == 0 {
+		// Small frames can come out larger, and counters can't go down
+		if saved := size - compressedSize(messages); saved > 0 {
+			metrics.CompressionBytesSaved.Add(float64(saved * compressionSampleRate))
+		}
+	}
+}
+
+// flateWriters pools flate writers at the configured level for compressedSize.
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		writer, _ := flate.NewWriter(nil, DefaultCompression.Level)
+		return writer
+	},
+}
+
+// byteCounter is an io.Writer that only counts what is written to it.
+type byteCounter int
+
+// Write counts the bytes written.
+func (b *byteCounter) Write(p []byte) (int, error) {
+	*b += byteCounter(len(p))
+	return len(p), nil
+}
+
+// compressedSize estimates the size of the messages after permessage-deflate, which
+// the websocket library doesn't report, by compressing them again at the same level.
+func compressedSize(messages [][]byte) int {
+	var counter byteCounter
+	writer := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(writer)
+	writer.Reset(&counter)
+	for i, message := range messages {
+		if i > 0 {
+			_, _ = writer.Write(newline)
+		}
+		_, _ = writer.Write(message)
+	}
+	_ = writer.Flush()
+	return int(counter)
+}
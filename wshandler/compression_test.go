@@ -0,0 +1,49 @@
+package wshandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"stack-web-app/metrics"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSmallCompressedFramesDontLowerTheSavings(t *testing.T) {
+	previous := DefaultCompression
+	defer func() { DefaultCompression = previous }()
+	DefaultCompression.Threshold = 0
+
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{EnableCompression: true}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	defer server.Close()
+	dialer := websocket.Dialer{EnableCompression: true}
+	clientConn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	conn := <-conns
+	defer conn.Close()
+
+	// Flate makes frames this small larger, so every sample saves less than nothing
+	client := &Client{conn: conn, compress: true}
+	before := testutil.ToFloat64(metrics.CompressionBytesSaved)
+	for i := 0; i < 2*compressionSampleRate; i++ {
+		client.compressFrame([]byte("ok"))
+	}
+	if saved := testutil.ToFloat64(metrics.CompressionBytesSaved); saved != before {
+		t.Errorf("bytes saved went from %v to %v compressing tiny frames", before, saved)
+	}
+}
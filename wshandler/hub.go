@@ -5,9 +5,16 @@
 package wshandler
 
 import (
-	"fmt"
+	"context"
+	"sync"
+	"time"
 
+	"stack-web-app/backplane"
+	"stack-web-app/clock"
 	"stack-web-app/db"
+	"stack-web-app/events"
+	"stack-web-app/logging"
+	"stack-web-app/metrics"
 
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
@@ -19,8 +26,8 @@ type Hub struct {
 	// Registered clients.
 	clients map[*Client]bool
 
-	// Inbound messages from the clients.
-	broadcast chan []byte
+	// Notifications that the stack changed, carrying the context of the change.
+	changed chan context.Context
 
 	// Register requests from the clients.
 	register chan *Client
@@ -28,105 +35,339 @@ type Hub struct {
 	// Unregister requests from clients.
 	unregister chan *Client
 
+	// Messages for a single client rather than the whole meeting.
+	direct chan directMessage
+
+	// Clients asking for a fresh snapshot of the stack.
+	resync chan *Client
+
+	// The stack as last broadcast and its revision, owned by the run goroutine.
+	stack    []db.User
+	revision uint64
+
 	// Hub ID so users can join asynchronously
 	hubId string
+
+	// Human friendly join code, e.g. BRAVE-OTTER-42
+	code string
+
+	// Optional custom slug chosen when the meeting was created
+	slug string
+
+	// Secret handed to whoever created the meeting, which lets clients joining with it
+	// use moderator actions
+	moderatorToken string
+
+	// Webhook URLs the meeting's events are delivered to and the secret deliveries to
+	// them are signed with
+	webhooks      []string
+	webhookSecret string
+
+	// Pruning policy for this meeting
+	policy PrunePolicy
+
+	// When the meeting was created and when the last client left it, used by the pruner
+	createdAt  time.Time
+	lastActive time.Time
+
+	// Guards clients and lastActive for readers outside of the run goroutine
+	mu sync.Mutex
+
+	// Serialises applying mutations, so that the stack before and after each one can
+	// be compared even when the backplane delivers them concurrently
+	applyMu sync.Mutex
+
+	// Closed when the hub has been stopped by the pruner
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// Logger carrying the meeting ID
+	logger *log.Entry
+
+	// Clients connected to this meeting on other instances, by instance ID
+	remoteClients map[string]int
+
+	// Subscription to this meeting's topic on the backplane
+	subscription backplane.Subscription
+
+	// Slow clients that were disconnected and may resume, by resume token
+	resumable map[string]resumable
+
+	// Clock the hub and its clients tell the time and set timers with
+	clock clock.Clock
+}
+
+// directMessage is a message for one client of the hub.
+type directMessage struct {
+	client *Client
+	data   []byte
 }
 
 // Declare global slice of hub ID to hub pointer map to track existing meeting hubs
 var HubPool = map[string]*Hub{}
 
-// newHub crates a new hub and registers it with the HubPool global hub table.
-func newHub() *Hub {
-	// Update context logger
-	ContextLogger = ContextLogger.WithFields(log.Fields{
+// Clock is what hubs, their clients and the pruner tell the time and set their timers
+// with, so tests can swap in a fake clock and move time on themselves. Hubs keep the
+// clock they were created with and the pruner the one it was started with.
+var Clock clock.Clock = clock.Real
+
+// newHub crates a new hub and registers it with the HubPool global hub table. A custom
+// slug may be supplied so the meeting can be joined by name, pass an empty string to
+// only get the generated meeting code. The policy controls when the pruner may remove
+// the meeting and any webhook URLs receive its events.
+func newHub(ctx context.Context, slug string, policy PrunePolicy, webhookURLs []string) (*Hub, error) {
+	// Get logger from request context
+	logger := contextLogger(ctx).WithFields(log.Fields{
 		"module":   "hub",
 		"function": "newHub",
+		"slug":     slug,
 	})
 
+	// Validate custom slug before doing any work
+	slug = normalizeAlias(slug)
+	if slug != "" {
+		if err := validateSlug(slug); err != nil {
+			return nil, err
+		}
+	}
+
 	// Create new UUID to declare new hub with
 	hubId := uuid.New().String()
 
+	// Reserve the meeting code and slug so nobody else can claim them while we set up
+	hubPoolLock.Lock()
+	if DefaultLimits.MaxMeetings > 0 && len(HubPool) >= DefaultLimits.MaxMeetings {
+		hubPoolLock.Unlock()
+		return nil, ErrTooManyMeetings
+	}
+	code, err := reserveAliases(hubId, slug)
+	if err != nil {
+		hubPoolLock.Unlock()
+		logger.WithField("error", err.Error()).Debug("Unable to reserve meeting code or slug.")
+		return nil, err
+	}
+	hub := allocateHub(hubId, code, slug, policy, Clock.Now())
+	hub.moderatorToken = uuid.New().String()
+	if len(webhookURLs) > 0 {
+		hub.webhooks = webhookURLs
+		hub.webhookSecret = uuid.New().String()
+	}
+
+	// Add hub ID to hub pointer map for quick meeting hub lookup
+	HubPool[hubId] = hub
+	metrics.ActiveMeetings.Set(float64(len(HubPool)))
+	hubPoolLock.Unlock()
+
 	// Create new DB table to store users in
-	ContextLogger.WithFields(log.Fields{
+	logger.WithFields(log.Fields{
 		"hubId": hubId,
+		"code":  code,
 	}).Debug("Creating meeting hub and database table.")
-	err := db.CreateTable(hubId)
+	err = db.CreateTable(ctx, hubId)
 	if err != nil {
-		ContextLogger.Error("Error creating new meeting table.")
+		logger.Error("Error creating new meeting table.")
+		removeHub(hubId)
+		return nil, err
 	}
-	hub := Hub{
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
-		hubId:      hubId,
-	}
-	ContextLogger.WithFields(log.Fields{
-		"hubId": hubId,
-		"hub":   fmt.Sprintf("%+v", hub),
-	}).Debug("Meeting hub and database table successfully created.")
+	logger.WithField("hubId", hubId).Debug("Meeting hub and database table successfully created and added to HubPool.")
 
-	// Add hub ID to hub pointer map for quick meeting hub lookup
-	HubPool[hubId] = &hub
-	ContextLogger.WithFields(log.Fields{
-		"hub":        fmt.Sprintf("%+v", hub),
-		"hubPoolMap": HubPool,
-	}).Debug("Meeting hub successfully added to HubPool.")
+	// Listen for stack changes to the meeting and tell other instances it exists
+	err = hub.subscribe()
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Error subscribing to meeting on the backplane.")
+		removeHub(hubId)
+		return nil, err
+	}
+	hub.publishLifecycle(ctx, lifecycleCreated, nil)
+	hub.registerWebhooks()
+	events.Publish(events.Event{Type: events.MeetingCreated, MeetingId: hubId, Time: hub.createdAt})
 
 	// Return pointer to the hub object
-	return &hub
+	return hub, nil
+}
+
+// allocateHub builds a hub that has not been registered or started yet.
+func allocateHub(hubId string, code string, slug string, policy PrunePolicy, createdAt time.Time) *Hub {
+	return &Hub{
+		changed:       make(chan context.Context),
+		register:      make(chan *Client),
+		unregister:    make(chan *Client),
+		direct:        make(chan directMessage),
+		resync:        make(chan *Client),
+		clients:       make(map[*Client]bool),
+		hubId:         hubId,
+		code:          code,
+		slug:          slug,
+		policy:        policy,
+		createdAt:     createdAt,
+		done:          make(chan struct{}),
+		remoteClients: make(map[string]int),
+		clock:         Clock,
+		resumable:     make(map[string]resumable),
+		logger: contextLogger(context.Background()).WithFields(log.Fields{
+			"module": "hub",
+			"hubId":  hubId,
+		}),
+	}
+}
+
+// stop shuts down the hub's run goroutine, disconnecting any remaining clients, and
+// stops listening to the meeting on the backplane. It is safe to call more than once.
+func (h *Hub) stop() {
+	h.stopOnce.Do(func() {
+		close(h.done)
+		if h.subscription != nil {
+			if err := h.subscription.Unsubscribe(); err != nil {
+				h.logger.WithField("error", err.Error()).Warning("Error unsubscribing from meeting on the backplane.")
+			}
+		}
+	})
+}
+
+// stopped reports whether the hub has been stopped.
+func (h *Hub) stopped() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendTo queues a message for a single client of the hub, giving up if the hub is
+// stopped.
+func (h *Hub) sendTo(client *Client, message []byte) {
+	select {
+	case h.direct <- directMessage{client: client, data: message}:
+	case <-h.done:
+	}
+}
+
+// sendUnregister asks the hub to unregister a client, giving up if the hub is stopped.
+func (h *Hub) sendUnregister(client *Client) {
+	select {
+	case h.unregister <- client:
+	case <-h.done:
+	}
+}
+
+// removeClient deletes a client from the hub, remembering when the meeting became
+// empty so the pruner can apply the idle timeout.
+func (h *Hub) removeClient(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.clients[client] {
+		delete(h.clients, client)
+		metrics.ConnectedClients.Dec()
+	}
+	if len(h.clients) == 0 && h.remoteClientCount() == 0 {
+		h.lastActive = h.clock.Now()
+	}
+}
+
+// clientCount is the number of clients connected to the hub on this instance.
+func (h *Hub) clientCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// remoteClientCount is the number of clients connected to this meeting on other
+// instances. The caller must hold h.mu.
+func (h *Hub) remoteClientCount() (count int) {
+	for _, clients := range h.remoteClients {
+		count += clients
+	}
+	return count
 }
 
 // run is used to start new hubs that have been created.
 func (h *Hub) run() {
-	// Update context logger
-	ContextLogger = ContextLogger.WithFields(log.Fields{
-		"module":   "hub",
-		"function": "run",
-	})
+	// Get hub logger
+	logger := h.logger.WithField("function", "run")
+
+	// Load the stack that patches will be computed against
+	err := h.loadStack(logging.WithLogger(context.Background(), logger))
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Error loading meeting stack.")
+	}
+
+	// Stack changes waiting to be broadcast when the coalescing window closes
+	var (
+		pending    int
+		pendingCtx context.Context
+		flushTimer clock.Timer
+		flushC     <-chan time.Time
+	)
 
 	for {
 		select {
+		case <-h.done:
+			if flushTimer != nil {
+				flushTimer.Stop()
+			}
+			// The meeting has been pruned, so close out any clients still connected
+			for client := range h.clients {
+				close(client.send)
+				h.removeClient(client)
+			}
+			logger.Debug("Hub stopped.")
+			return
 		case client := <-h.register:
+			h.mu.Lock()
 			h.clients[client] = true
-			ContextLogger.WithFields(log.Fields{
-				"client": fmt.Sprintf("%+v", client),
-				"hub":    fmt.Sprintf("%+v", h),
+			metrics.ConnectedClients.Inc()
+			h.mu.Unlock()
+			h.sendWelcome(client)
+			h.sendSnapshot(client)
+			h.publishPresence()
+			h.publishActivity(activityJoin, client.clientId)
+			logger.WithFields(log.Fields{
+				"clientId": client.clientId,
 			}).Debug("Client successfully registered to hub.")
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				// Closing the client connection
 				close(client.send)
 				_ = client.conn.Close()
-				delete(h.clients, client)
-				ContextLogger.WithFields(log.Fields{
-					"client": fmt.Sprintf("%+v", client),
-					"hub":    fmt.Sprintf("%+v", h),
+				h.removeClient(client)
+				h.publishPresence()
+				h.publishActivity(activityLeave, client.clientId)
+				logger.WithFields(log.Fields{
+					"clientId": client.clientId,
 				}).Debug("Client successfully unregistered from hub, updating stack to rest of group.")
 			}
-		case message := <-h.broadcast:
-			ContextLogger.WithFields(log.Fields{
-				"message": fmt.Sprintf("%+v", string(message)),
-				"hub":     fmt.Sprintf("%+v", h),
-			}).Debug("Message being sent to all clients in hub.")
-			for client := range h.clients {
+		case direct := <-h.direct:
+			// Only send to clients that are still registered, otherwise their send
+			// channel has already been closed. Clients that can't keep up just miss it.
+			if _, ok := h.clients[direct.client]; ok {
 				select {
-				case client.send <- message:
-					ContextLogger.WithFields(log.Fields{
-						"client":  fmt.Sprintf("%+v", client),
-						"hub":     fmt.Sprintf("%+v", h),
-						"message": fmt.Sprintf("%+v", string(message)),
-					}).Debug("Broadcast message being sent to client.")
+				case direct.client.send <- direct.data:
 				default:
-					close(client.send)
-					delete(h.clients, client)
-					ContextLogger.WithFields(log.Fields{
-						"client":  fmt.Sprintf("%+v", client),
-						"hub":     fmt.Sprintf("%+v", h),
-						"message": fmt.Sprintf("%+v", string(message)),
-					}).Debug("Unable to send message to client, successfully unregistered client from hub.")
 				}
 			}
+		case client := <-h.resync:
+			if _, ok := h.clients[client]; ok {
+				h.sendSnapshot(client)
+			}
+		case ctx := <-h.changed:
+			pending++
+			if pending == 1 {
+				pendingCtx = ctx
+				if CoalesceWindow > 0 {
+					flushTimer = h.clock.NewTimer(CoalesceWindow)
+					flushC = flushTimer.C()
+				}
+			}
+			if CoalesceWindow == 0 {
+				h.flush(pendingCtx, pending)
+				pending, pendingCtx = 0, nil
+			}
+		case <-flushC:
+			flushC = nil
+			h.flush(pendingCtx, pending)
+			pending, pendingCtx = 0, nil
 		}
 	}
 }
@@ -0,0 +1,215 @@
+package wshandler
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limits caps how hard a single client or address can push the server.
+type Limits struct {
+	// ActionsPerSecond and ActionBurst limit the stack actions each websocket client
+	// may send.
+	ActionsPerSecond float64
+	ActionBurst      int
+
+	// MeetingsPerMinute and MeetingBurst limit meeting creation per client IP.
+	MeetingsPerMinute float64
+	MeetingBurst      int
+
+	// MaxMeetings caps the number of concurrent meetings, zero means no limit.
+	MaxMeetings int
+
+	// MaxClientsPerMeeting caps the clients connected to a meeting on this instance,
+	// zero means no limit.
+	MaxClientsPerMeeting int
+
+	// TrustedProxies is the number of proxies in front of the server that append the
+	// address they received a request from to X-Forwarded-For, for deployments behind a
+	// load balancer. The client IP is the address that many entries from the right,
+	// since anything further left could have been sent by the client itself. Zero
+	// ignores X-Forwarded-For.
+	TrustedProxies int
+}
+
+// DefaultLimits are the limits applied unless configured otherwise.
+var DefaultLimits = Limits{
+	ActionsPerSecond:  2,
+	ActionBurst:       5,
+	MeetingsPerMinute: 10,
+	MeetingBurst:      5,
+	MaxMeetings:       1000,
+}
+
+var (
+	// ErrTooManyMeetings is returned when the server is already hosting MaxMeetings.
+	ErrTooManyMeetings = errors.New("the server has reached its limit of concurrent meetings, please try again later")
+
+	// errMeetingFull is sent to clients joining a meeting at MaxClientsPerMeeting.
+	errMeetingFull = errors.New("this meeting is full")
+
+	// ErrActionRateLimited is sent to participants taking stack actions too quickly.
+	ErrActionRateLimited = errors.New("too many stack actions, please slow down")
+
+	// errMeetingRateLimited is returned to addresses creating meetings too quickly.
+	errMeetingRateLimited = errors.New("too many meetings created from this address, please try again later")
+)
+
+// ipLimiterIdle is how long an address can go without creating a meeting before we
+// forget its rate limiter.
+const ipLimiterIdle = 10 * time.Minute
+
+// ipLimiter is the meeting creation rate limiter for a single address.
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+var (
+	ipLimitersLock sync.Mutex
+	ipLimiters     = map[string]*ipLimiter{}
+	ipLimiterSweep time.Time
+)
+
+// intFromEnv parses the named environment variable as an integer, leaving the target
+// untouched if the variable is unset.
+func intFromEnv(name string, target *int) error {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return fmt.Errorf("invalid value for %s: must be a non-negative integer", name)
+	}
+	*target = i
+	return nil
+}
+
+// floatFromEnv parses the named environment variable as a positive number, leaving
+// the target untouched if the variable is unset.
+func floatFromEnv(name string, target *float64) error {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f <= 0 {
+		return fmt.Errorf("invalid value for %s: must be a positive number", name)
+	}
+	*target = f
+	return nil
+}
+
+// ConfigureLimits reads the rate limits and caps from the ACTION_RATE_LIMIT,
+// ACTION_RATE_BURST, MEETING_CREATE_RATE_LIMIT (per minute), MEETING_CREATE_BURST,
+// MAX_MEETINGS, MAX_CLIENTS_PER_MEETING, TRUST_PROXY_HEADERS and TRUSTED_PROXIES
+// environment variables. TRUST_PROXY_HEADERS trusts a single proxy, TRUSTED_PROXIES
+// sets how many there are.
+func ConfigureLimits() error {
+	if err := floatFromEnv("ACTION_RATE_LIMIT", &DefaultLimits.ActionsPerSecond); err != nil {
+		return err
+	}
+	if err := intFromEnv("ACTION_RATE_BURST", &DefaultLimits.ActionBurst); err != nil {
+		return err
+	}
+	if err := floatFromEnv("MEETING_CREATE_RATE_LIMIT", &DefaultLimits.MeetingsPerMinute); err != nil {
+		return err
+	}
+	if err := intFromEnv("MEETING_CREATE_BURST", &DefaultLimits.MeetingBurst); err != nil {
+		return err
+	}
+	if err := intFromEnv("MAX_MEETINGS", &DefaultLimits.MaxMeetings); err != nil {
+		return err
+	}
+	if err := intFromEnv("MAX_CLIENTS_PER_MEETING", &DefaultLimits.MaxClientsPerMeeting); err != nil {
+		return err
+	}
+	if DefaultLimits.ActionBurst < 1 || DefaultLimits.MeetingBurst < 1 {
+		return errors.New("ACTION_RATE_BURST and MEETING_CREATE_BURST must be at least 1")
+	}
+	if _, ok := os.LookupEnv("TRUST_PROXY_HEADERS"); ok {
+		DefaultLimits.TrustedProxies = 1
+	}
+	return intFromEnv("TRUSTED_PROXIES", &DefaultLimits.TrustedProxies)
+}
+
+// NewActionLimiter returns the token bucket for a new participant's stack actions, for
+// websocket clients and integrations taking actions through ApplyAction alike.
+func NewActionLimiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(DefaultLimits.ActionsPerSecond), DefaultLimits.ActionBurst)
+}
+
+// clientIP returns the address a request came from. Behind trusted proxies, it is the
+// address the outermost of them added to X-Forwarded-For.
+func clientIP(r *http.Request) string {
+	if DefaultLimits.TrustedProxies > 0 {
+		var forwarded []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, address := range strings.Split(header, ",") {
+				if address = strings.TrimSpace(address); address != "" {
+					forwarded = append(forwarded, address)
+				}
+			}
+		}
+		if len(forwarded) > 0 {
+			// Fewer entries than proxies means the outermost one saw the client itself
+			i := len(forwarded) - DefaultLimits.TrustedProxies
+			if i < 0 {
+				i = 0
+			}
+			return forwarded[i]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allowMeetingCreation takes a token from the address's meeting creation bucket,
+// returning false if the address is creating meetings too quickly.
+func allowMeetingCreation(ip string) bool {
+	ipLimitersLock.Lock()
+	defer ipLimitersLock.Unlock()
+
+	// Forget addresses we haven't heard from in a while so the map doesn't grow forever
+	now := Clock.Now()
+	if now.Sub(ipLimiterSweep) > time.Minute {
+		for address, entry := range ipLimiters {
+			if now.Sub(entry.lastSeen) > ipLimiterIdle {
+				delete(ipLimiters, address)
+			}
+		}
+		ipLimiterSweep = now
+	}
+
+	entry, ok := ipLimiters[ip]
+	if !ok {
+		entry = &ipLimiter{
+			limiter: rate.NewLimiter(rate.Limit(DefaultLimits.MeetingsPerMinute/60), DefaultLimits.MeetingBurst),
+		}
+		ipLimiters[ip] = entry
+	}
+	entry.lastSeen = now
+	return entry.limiter.AllowN(now, 1)
+}
+
+// full reports whether the meeting has reached the per-meeting client cap.
+func (h *Hub) full() bool {
+	if DefaultLimits.MaxClientsPerMeeting == 0 {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients) >= DefaultLimits.MaxClientsPerMeeting
+}
@@ -0,0 +1,39 @@
+package wshandler
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	previous := DefaultLimits
+	defer func() { DefaultLimits = previous }()
+
+	tests := []struct {
+		name      string
+		proxies   int
+		forwarded []string
+		want      string
+	}{
+		{"untrusted", 0, []string{"203.0.113.9"}, "192.0.2.1"},
+		{"no header", 1, nil, "192.0.2.1"},
+		{"one proxy", 1, []string{"203.0.113.9"}, "203.0.113.9"},
+		{"spoofed by client", 1, []string{"10.0.0.1, 203.0.113.9"}, "203.0.113.9"},
+		{"two proxies", 2, []string{"10.0.0.1, 203.0.113.9, 198.51.100.7"}, "203.0.113.9"},
+		{"split headers", 2, []string{"10.0.0.1, 203.0.113.9", "198.51.100.7"}, "203.0.113.9"},
+		{"fewer entries than proxies", 3, []string{"203.0.113.9, 198.51.100.7"}, "203.0.113.9"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			DefaultLimits.TrustedProxies = test.proxies
+			r := httptest.NewRequest("POST", "/api/meetings", nil)
+			r.RemoteAddr = "192.0.2.1:41234"
+			for _, header := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+			if got := clientIP(r); got != test.want {
+				t.Errorf("clientIP() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -1,10 +1,14 @@
 package wshandler
 
 import (
+	"context"
+
+	"stack-web-app/logging"
+
 	log "github.com/sirupsen/logrus"
 )
 
-// ContextLogger declares top level context logger to use in package
-var ContextLogger = log.WithFields(log.Fields{
-	"package": "wshandler",
-})
+// contextLogger returns the logger carried by ctx, tagged with this package's name.
+func contextLogger(ctx context.Context) *log.Entry {
+	return logging.FromContext(ctx).WithField("package", "wshandler")
+}
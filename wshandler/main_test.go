@@ -0,0 +1,43 @@
+package wshandler
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"stack-web-app/clock"
+	"stack-web-app/db"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.WarnLevel)
+	if err := db.StartInMemory(); err != nil {
+		fmt.Fprintln(os.Stderr, "starting in-memory database:", err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// useFakeClock swaps the package Clock for a fake one until the test ends.
+func useFakeClock(t *testing.T) *clock.Fake {
+	fake := clock.NewFake(time.Date(2021, 6, 1, 9, 0, 0, 0, time.UTC))
+	previous := Clock
+	Clock = fake
+	t.Cleanup(func() { Clock = previous })
+	return fake
+}
+
+// waitFor waits for a goroutine woken by the fake clock to finish what it was doing.
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
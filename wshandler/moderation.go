@@ -0,0 +1,35 @@
+package wshandler
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+
+	"stack-web-app/protocol"
+)
+
+// ErrNotModerator is returned for moderator actions taken without the moderator token.
+var ErrNotModerator = errors.New("only the meeting's moderator can do that")
+
+// moderatorAction reports whether the action needs the moderator token.
+func moderatorAction(action string) bool {
+	return action == protocol.ActionRemove || action == protocol.ActionNext
+}
+
+// isModerator reports whether the token is the meeting's moderator token.
+func (h *Hub) isModerator(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.moderatorToken)) == 1
+}
+
+// publishModeration sends a moderator action to every instance serving the meeting.
+// The target is resolved when the action is applied, so that "next" takes off whoever
+// is speaking at that point on every instance.
+func (h *Hub) publishModeration(ctx context.Context, action string, targetId string, moderatorId string) error {
+	return publishReplication(ctx, meetingTopic(h.hubId), replicationMessage{
+		Type:      meetingMutation,
+		MeetingId: h.hubId,
+		Action:    action,
+		SpeakerId: targetId,
+		ActorId:   moderatorId,
+	})
+}
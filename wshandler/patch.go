@@ -0,0 +1,74 @@
+package wshandler
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"stack-web-app/db"
+	"stack-web-app/protocol"
+)
+
+// diffStack returns the operations that turn the old stack into the new one. Speakers
+// who left are removed first, then the new stack is walked in order moving or inserting
+// speakers until both match, and finally the current speaker is set if it changed.
+// Speakers whose details changed, such as their position, are removed and inserted
+// again so that clients don't keep stale copies.
+func diffStack(old []db.User, new []db.User) (ops []protocol.PatchOp) {
+	wanted := make(map[string]db.User, len(new))
+	for _, user := range new {
+		wanted[user.SpeakerId] = user
+	}
+
+	working := make([]db.User, 0, len(old))
+	for _, user := range old {
+		if match, ok := wanted[user.SpeakerId]; ok && match == user {
+			working = append(working, user)
+			continue
+		}
+		ops = append(ops, protocol.PatchOp{Op: protocol.OpRemove, SpeakerId: user.SpeakerId})
+	}
+
+	for i, user := range new {
+		if i < len(working) && working[i].SpeakerId == user.SpeakerId {
+			continue
+		}
+		from := -1
+		for j := i + 1; j < len(working); j++ {
+			if working[j].SpeakerId == user.SpeakerId {
+				from = j
+				break
+			}
+		}
+		if from >= 0 {
+			ops = append(ops, protocol.PatchOp{Op: protocol.OpMove, SpeakerId: user.SpeakerId, Position: i + 1})
+			working = append(working[:from], working[from+1:]...)
+		} else {
+			inserted := user
+			ops = append(ops, protocol.PatchOp{Op: protocol.OpInsert, Position: i + 1, User: &inserted})
+		}
+		working = append(working[:i], append([]db.User{user}, working[i:]...)...)
+	}
+
+	if currentSpeaker(old) != currentSpeaker(new) {
+		ops = append(ops, protocol.PatchOp{Op: protocol.OpCurrent, SpeakerId: currentSpeaker(new)})
+	}
+	return ops
+}
+
+// currentSpeaker is the ID of the speaker at the top of the stack.
+func currentSpeaker(stack []db.User) string {
+	if len(stack) == 0 {
+		return ""
+	}
+	return stack[0].SpeakerId
+}
+
+// encodeMessage marshals a message on a single line so that writePump can join queued
+// messages with newlines.
+func encodeMessage(message interface{}) ([]byte, error) {
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(bytes.Replace(encoded, newline, space, -1)), nil
+}
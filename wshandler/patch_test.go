@@ -0,0 +1,112 @@
+package wshandler
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"stack-web-app/db"
+	"stack-web-app/protocol"
+)
+
+// speaker is a user on the stack in patch tests.
+func speaker(position int16, id string) db.User {
+	return db.User{SpeakerPostition: position, SpeakerId: id, Name: "Speaker " + id}
+}
+
+// checkPatch checks that the patch from old to new turns old into new.
+func checkPatch(t *testing.T, old []db.User, new []db.User) []protocol.PatchOp {
+	t.Helper()
+	ops := diffStack(old, new)
+	got := protocol.ApplyPatch(old, ops)
+	if len(got) != len(new) || (len(new) > 0 && !reflect.DeepEqual(got, new)) {
+		t.Errorf("ApplyPatch(%v, %+v) = %v, want %v", old, ops, got, new)
+	}
+	return ops
+}
+
+// opKinds lists the kinds of operation in a patch.
+func opKinds(ops []protocol.PatchOp) []string {
+	kinds := []string{}
+	for _, op := range ops {
+		kinds = append(kinds, op.Op)
+	}
+	return kinds
+}
+
+func TestDiffStack(t *testing.T) {
+	a, b, c := speaker(1, "a"), speaker(2, "b"), speaker(3, "c")
+	tests := []struct {
+		name string
+		old  []db.User
+		new  []db.User
+		ops  []string
+	}{
+		{"unchanged", []db.User{a, b}, []db.User{a, b}, []string{}},
+		{"empty to empty", nil, []db.User{}, []string{}},
+		{"empty to one", nil, []db.User{a}, []string{protocol.OpInsert, protocol.OpCurrent}},
+		{"one to empty", []db.User{a}, nil, []string{protocol.OpRemove, protocol.OpCurrent}},
+		{"insert at the end", []db.User{a}, []db.User{a, b}, []string{protocol.OpInsert}},
+		{"insert at the top", []db.User{b}, []db.User{a, b}, []string{protocol.OpInsert, protocol.OpCurrent}},
+		{"remove from the middle", []db.User{a, b, c}, []db.User{a, c}, []string{protocol.OpRemove}},
+		{"next speaker", []db.User{a, b, c}, []db.User{b, c}, []string{protocol.OpRemove, protocol.OpCurrent}},
+		{"move", []db.User{a, b, c}, []db.User{a, c, b}, []string{protocol.OpMove}},
+		{"move to the top", []db.User{a, b, c}, []db.User{c, a, b}, []string{protocol.OpMove, protocol.OpCurrent}},
+		{"position changed", []db.User{a, b}, []db.User{a, speaker(5, "b")}, []string{protocol.OpRemove, protocol.OpInsert}},
+		{"name changed", []db.User{a, b}, []db.User{a, {SpeakerPostition: 2, SpeakerId: "b", Name: "Renamed"}}, []string{protocol.OpRemove, protocol.OpInsert}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ops := checkPatch(t, test.old, test.new)
+			if kinds := opKinds(ops); !reflect.DeepEqual(kinds, test.ops) {
+				t.Errorf("diffStack() ops = %v, want %v", kinds, test.ops)
+			}
+		})
+	}
+}
+
+func TestDiffStackCurrent(t *testing.T) {
+	ops := diffStack([]db.User{speaker(1, "a"), speaker(2, "b")}, []db.User{speaker(2, "b")})
+	last := ops[len(ops)-1]
+	if last.Op != protocol.OpCurrent || last.SpeakerId != "b" {
+		t.Errorf("last op = %+v, want current b", last)
+	}
+	ops = diffStack([]db.User{speaker(1, "a")}, nil)
+	last = ops[len(ops)-1]
+	if last.Op != protocol.OpCurrent || last.SpeakerId != "" {
+		t.Errorf("last op = %+v, want current cleared", last)
+	}
+}
+
+func TestDiffStackRandomized(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	randomStack := func() []db.User {
+		var stack []db.User
+		for _, i := range random.Perm(8)[:random.Intn(9)] {
+			// Positions are usually kept but sometimes change, like a speaker rejoining
+			position := int16(i)
+			if random.Intn(4) == 0 {
+				position += 10
+			}
+			stack = append(stack, speaker(position, fmt.Sprint(i)))
+		}
+		return stack
+	}
+	for i := 0; i < 2000; i++ {
+		old, new := randomStack(), randomStack()
+		ops := checkPatch(t, old, new)
+		current := ""
+		for _, op := range ops {
+			if op.Op == protocol.OpCurrent {
+				current = op.SpeakerId
+			}
+		}
+		if changed := currentSpeaker(old) != currentSpeaker(new); changed && current != currentSpeaker(new) {
+			t.Errorf("diffStack(%v, %v) sets current to %q, want %q", old, new, current, currentSpeaker(new))
+		}
+		if t.Failed() {
+			return
+		}
+	}
+}
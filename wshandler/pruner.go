@@ -1,48 +1,200 @@
 package wshandler
 
 import (
+	"context"
+	"fmt"
+	"os"
 	"time"
 
 	"stack-web-app/db"
+	"stack-web-app/events"
+	"stack-web-app/metrics"
+	"stack-web-app/tracing"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// pruneEmptyMeetings will be run as a goroutine to clean up references to empty
+// Reasons reported by the pruner when a meeting is removed.
+const (
+	pruneReasonNeverJoined = "grace_period_expired"
+	pruneReasonIdle        = "idle_timeout"
+	pruneReasonLifetime    = "max_lifetime"
+)
+
+// PrunePolicy controls when the pruner is allowed to remove a meeting.
+type PrunePolicy struct {
+	// GracePeriod is how long a new meeting is kept around before it may be pruned,
+	// giving people time to join after it was created.
+	GracePeriod time.Duration
+
+	// IdleTimeout is how long a meeting may sit without any clients after the last
+	// client has left before it is pruned.
+	IdleTimeout time.Duration
+
+	// MaxLifetime is the absolute maximum age of a meeting, after which it is pruned
+	// even if clients are still connected. Zero means meetings may live forever.
+	MaxLifetime time.Duration
+}
+
+var (
+	// DefaultPrunePolicy is applied to every meeting that does not override it.
+	DefaultPrunePolicy = PrunePolicy{
+		GracePeriod: 5 * time.Minute,
+		IdleTimeout: 60 * time.Second,
+	}
+
+	// MaxPrunePolicy caps the grace period and idle timeout a meeting may ask for, so
+	// that empty meetings can't be kept around forever. The server default is always
+	// allowed, even when it is longer.
+	MaxPrunePolicy = PrunePolicy{
+		GracePeriod: time.Hour,
+		IdleTimeout: time.Hour,
+	}
+
+	// PruneInterval is how often the pruner checks meetings against their policy.
+	PruneInterval = 60 * time.Second
+)
+
+// durationFromEnv parses the named environment variable as a time.Duration, leaving
+// the target untouched if the variable is unset.
+func durationFromEnv(name string, target *time.Duration) error {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration for %s: %w", name, err)
+	}
+	if d < 0 {
+		return fmt.Errorf("invalid duration for %s: must not be negative", name)
+	}
+	*target = d
+	return nil
+}
+
+// ConfigurePruner reads the server wide pruning policy from the MEETING_GRACE_PERIOD,
+// MEETING_IDLE_TIMEOUT, MEETING_MAX_LIFETIME and MEETING_PRUNE_INTERVAL environment
+// variables, and the most meetings may override it with from MAX_MEETING_GRACE_PERIOD
+// and MAX_MEETING_IDLE_TIMEOUT, all of which take Go duration strings like "90s" or
+// "2h".
+func ConfigurePruner() error {
+	if err := durationFromEnv("MEETING_GRACE_PERIOD", &DefaultPrunePolicy.GracePeriod); err != nil {
+		return err
+	}
+	if err := durationFromEnv("MEETING_IDLE_TIMEOUT", &DefaultPrunePolicy.IdleTimeout); err != nil {
+		return err
+	}
+	if err := durationFromEnv("MEETING_MAX_LIFETIME", &DefaultPrunePolicy.MaxLifetime); err != nil {
+		return err
+	}
+	if err := durationFromEnv("MAX_MEETING_GRACE_PERIOD", &MaxPrunePolicy.GracePeriod); err != nil {
+		return err
+	}
+	if err := durationFromEnv("MAX_MEETING_IDLE_TIMEOUT", &MaxPrunePolicy.IdleTimeout); err != nil {
+		return err
+	}
+	if err := durationFromEnv("MEETING_PRUNE_INTERVAL", &PruneInterval); err != nil {
+		return err
+	}
+	if PruneInterval == 0 {
+		return fmt.Errorf("invalid duration for MEETING_PRUNE_INTERVAL: must be greater than zero")
+	}
+	return nil
+}
+
+// pruneReason decides whether a hub should be pruned at the given time under its
+// policy, returning the reason or an empty string if the hub should be kept.
+func (h *Hub) pruneReason(now time.Time) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	age := now.Sub(h.createdAt)
+	if h.policy.MaxLifetime > 0 && age >= h.policy.MaxLifetime {
+		return pruneReasonLifetime
+	}
+	if len(h.clients) > 0 || h.remoteClientCount() > 0 || age < h.policy.GracePeriod {
+		return ""
+	}
+	if h.lastActive.IsZero() {
+		return pruneReasonNeverJoined
+	}
+	if now.Sub(h.lastActive) >= h.policy.IdleTimeout {
+		return pruneReasonIdle
+	}
+	return ""
+}
+
+// PruneMeetings will be run as a goroutine to clean up references to expired
 // meetings in the database and the HubPool map so that the Go Garbage Collector
-// can free up those resources (hopefully) because they are no longer referenced
-func PruneEmptyMeetings() {
-	// Add to context logger
-	ContextLogger = ContextLogger.WithFields(log.Fields{
-		"function": "pruneEmptyMeetings",
+// can free up those resources (hopefully) because they are no longer referenced.
+// Each meeting is checked against its PrunePolicy every PruneInterval until the context
+// is done.
+func PruneMeetings(ctx context.Context) {
+	// Get package logger
+	logger := contextLogger(context.Background()).WithFields(log.Fields{
+		"function": "PruneMeetings",
 		"module":   "pruner",
 	})
 
 	// Get all active hubs in hub pool
-	meetingPruneTicker := time.NewTicker(60 * time.Second)
+	pruneClock := Clock
+	meetingPruneTicker := pruneClock.NewTicker(PruneInterval)
+	defer meetingPruneTicker.Stop()
 	for {
-		<-meetingPruneTicker.C
-		ContextLogger.Debug("Running pruner.")
+		select {
+		case <-ctx.Done():
+			logger.Debug("Pruner stopped.")
+			return
+		case <-meetingPruneTicker.C():
+		}
+		logger.Debug("Running pruner.")
+		metrics.PrunerRuns.Inc()
+		hubPoolLock.RLock()
+		hubs := make(map[string]*Hub, len(HubPool))
 		for hubId, hub := range HubPool {
-			clearHub := true
-			// Iterate through all clients and break out if an active client is found
-			for _, client := range hub.clients {
-				if client {
-					clearHub = false
-					break
-				}
+			hubs[hubId] = hub
+		}
+		hubPoolLock.RUnlock()
+
+		now := pruneClock.Now()
+		for hubId, hub := range hubs {
+			reason := hub.pruneReason(now)
+			if reason == "" {
+				metrics.ClientsPerMeeting.Observe(float64(hub.clientCount()))
+				continue
 			}
 
-			// If no active clients found prune meeting from hubPool and delete table from SQL
-			if clearHub {
-				ContextLogger.Debug("Empty meeting found, attempting to prune.")
-				delete(HubPool, hubId)
-				ContextLogger.Debug("Successfully deleted meeting hub: " + hubId)
-				err := db.DeleteTable(hubId)
-				if err != nil {
-					ContextLogger.Warning("Error deleting meeting table: " + err.Error())
-				}
+			// Prune meeting from hubPool, stop the hub and delete table from SQL
+			pruneLogger := logger.WithFields(log.Fields{
+				"hubId":  hubId,
+				"reason": reason,
+			})
+			pruneLogger.Info("Pruning meeting.")
+			metrics.MeetingsPruned.WithLabelValues(reason).Inc()
+			ctx, span := tracing.Tracer().Start(context.Background(), "pruner.prune", trace.WithAttributes(
+				attribute.String("meeting.id", hubId),
+				attribute.String("reason", reason),
+			))
+			removeHub(hubId)
+			hub.stop()
+			err := db.DeleteTable(ctx, hubId)
+			if err != nil {
+				pruneLogger.Warning("Error deleting meeting table: " + err.Error())
 			}
+			span.End()
+			events.Publish(events.Event{
+				Type:      events.MeetingPruned,
+				MeetingId: hubId,
+				Time:      now,
+				Data: map[string]interface{}{
+					"reason":    reason,
+					"createdAt": hub.createdAt,
+				},
+			})
 		}
+		prunerLastRun.Store(now)
 	}
 }
@@ -0,0 +1,57 @@
+package wshandler
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPruneMeetingsFollowsPolicy(t *testing.T) {
+	fake := useFakeClock(t)
+	previousInterval := PruneInterval
+	PruneInterval = time.Minute
+	defer func() { PruneInterval = previousInterval }()
+
+	ctx := context.Background()
+	neverJoined, err := newHub(ctx, "", PrunePolicy{GracePeriod: 5 * time.Minute, IdleTimeout: time.Minute}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emptied, err := newHub(ctx, "", PrunePolicy{IdleTimeout: 3 * time.Minute}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go neverJoined.run()
+	go emptied.run()
+
+	// The last client leaves straight away, starting the idle timeout
+	emptied.removeClient(&Client{})
+
+	pruneCtx, stopPruner := context.WithCancel(ctx)
+	defer stopPruner()
+	go PruneMeetings(pruneCtx)
+	fake.BlockUntil(1)
+
+	// Each tick waits for the pruner to finish its run before checking on the hubs
+	tick := func() {
+		fake.Advance(PruneInterval)
+		waitFor(t, "the pruner to run", func() bool { return PrunerLastRun().Equal(fake.Now()) })
+	}
+	exists := func(hub *Hub) bool {
+		_, ok := lookupHub(hub.hubId)
+		return ok
+	}
+
+	for minute := 1; minute <= 5; minute++ {
+		tick()
+		if want := minute < 3; exists(emptied) != want {
+			t.Errorf("after %d minutes the emptied meeting exists = %v, want %v", minute, !want, want)
+		}
+		if want := minute < 5; exists(neverJoined) != want {
+			t.Errorf("after %d minutes the unjoined meeting exists = %v, want %v", minute, !want, want)
+		}
+	}
+	if !neverJoined.stopped() || !emptied.stopped() {
+		t.Error("pruned hubs weren't stopped")
+	}
+}
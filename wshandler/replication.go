@@ -0,0 +1,352 @@
+package wshandler
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"stack-web-app/backplane"
+	"stack-web-app/db"
+	"stack-web-app/events"
+	"stack-web-app/logging"
+	"stack-web-app/metrics"
+	"stack-web-app/protocol"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+)
+
+// Topic carrying meeting lifecycle messages shared by every instance.
+const meetingsTopic = "meetings"
+
+// Replication message types. Lifecycle messages go to meetingsTopic and the rest go to
+// the topic of the meeting they belong to.
+const (
+	lifecycleCreated = "created"
+	lifecycleSync    = "sync"
+	lifecycleState   = "state"
+	meetingMutation  = "mutation"
+	meetingPresence  = "presence"
+	meetingActivity  = "activity"
+)
+
+var (
+	// bus is the backplane hubs replicate through. It defaults to in-process so a
+	// single instance works without any configuration.
+	bus backplane.Backplane = backplane.NewMemory()
+
+	// instanceId identifies this server on the backplane so it can ignore its own
+	// lifecycle and presence messages.
+	instanceId = uuid.New().String()
+)
+
+// replicationMessage is the JSON payload sent over the backplane.
+type replicationMessage struct {
+	Type      string            `json:"type"`
+	Instance  string            `json:"instance"`
+	MeetingId string            `json:"meetingId,omitempty"`
+	Code      string            `json:"code,omitempty"`
+	Slug      string            `json:"slug,omitempty"`
+	Moderator string            `json:"moderator,omitempty"`
+	Webhooks  []string          `json:"webhooks,omitempty"`
+	Secret    string            `json:"secret,omitempty"`
+	Policy    *PrunePolicy      `json:"policy,omitempty"`
+	CreatedAt time.Time         `json:"createdAt,omitempty"`
+	Stack     []db.User         `json:"stack,omitempty"`
+	Action    string            `json:"action,omitempty"`
+	SpeakerId string            `json:"speakerId,omitempty"`
+	ActorId   string            `json:"actorId,omitempty"`
+	Name      string            `json:"name,omitempty"`
+	Clients   int               `json:"clients,omitempty"`
+	Trace     map[string]string `json:"trace,omitempty"`
+}
+
+// traceCarrier lets the OpenTelemetry propagator read and write the trace context
+// stored in a replicationMessage.
+type traceCarrier map[string]string
+
+// Get returns the value stored for the key.
+func (c traceCarrier) Get(key string) string { return c[key] }
+
+// Set stores the value for the key.
+func (c traceCarrier) Set(key string, value string) { c[key] = value }
+
+// Keys lists the stored keys.
+func (c traceCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// meetingTopic is the backplane topic for stack mutations and presence of a meeting.
+func meetingTopic(hubId string) string {
+	return "meeting." + hubId
+}
+
+// StartReplication switches hubs over to the given backplane, starts listening for
+// meetings created on other instances and asks those instances for the meetings
+// they already have. Meetings are handed over on a best effort basis: slug clashes
+// between instances are resolved in favour of whichever meeting claimed it first
+// locally, and mutations made while a meeting is being handed over may be missed.
+func StartReplication(b backplane.Backplane) error {
+	bus = b
+	_, err := bus.Subscribe(meetingsTopic, handleLifecycle)
+	if err != nil {
+		return err
+	}
+	return publishReplication(context.Background(), meetingsTopic, replicationMessage{Type: lifecycleSync})
+}
+
+// publishReplication stamps the message with our instance ID and the trace context
+// and publishes it to the topic.
+func publishReplication(ctx context.Context, topic string, message replicationMessage) error {
+	message.Instance = instanceId
+	message.Trace = map[string]string{}
+	otel.GetTextMapPropagator().Inject(ctx, traceCarrier(message.Trace))
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return bus.Publish(ctx, topic, payload)
+}
+
+// decodeReplication parses a backplane payload, returning a context carrying the
+// trace of the operation that published it.
+func decodeReplication(payload []byte) (ctx context.Context, message replicationMessage, err error) {
+	err = json.Unmarshal(payload, &message)
+	if err != nil {
+		return context.Background(), message, err
+	}
+	ctx = otel.GetTextMapPropagator().Extract(context.Background(), traceCarrier(message.Trace))
+	return ctx, message, nil
+}
+
+// handleLifecycle applies meeting lifecycle messages published by other instances.
+func handleLifecycle(payload []byte) {
+	logger := contextLogger(context.Background()).WithFields(log.Fields{
+		"module":   "replication",
+		"function": "handleLifecycle",
+	})
+
+	ctx, message, err := decodeReplication(payload)
+	if err != nil {
+		logger.WithField("error", err.Error()).Warning("Ignoring malformed lifecycle message.")
+		return
+	}
+	if message.Instance == instanceId {
+		return
+	}
+	ctx = logging.WithLogger(ctx, logger.WithField("hubId", message.MeetingId))
+
+	switch message.Type {
+	case lifecycleCreated, lifecycleState:
+		adoptHub(ctx, message)
+	case lifecycleSync:
+		// Another instance just started, tell it about every meeting we have
+		hubPoolLock.RLock()
+		hubs := make([]*Hub, 0, len(HubPool))
+		for _, hub := range HubPool {
+			hubs = append(hubs, hub)
+		}
+		hubPoolLock.RUnlock()
+		for _, hub := range hubs {
+			stackUsers, err := db.ShowCurrentStack(ctx, hub.hubId)
+			if err != nil {
+				continue
+			}
+			hub.publishLifecycle(ctx, lifecycleState, stackUsers)
+		}
+	}
+}
+
+// adoptHub registers and starts a hub for a meeting created on another instance.
+func adoptHub(ctx context.Context, message replicationMessage) {
+	logger := contextLogger(ctx).WithField("function", "adoptHub")
+
+	policy := DefaultPrunePolicy
+	if message.Policy != nil {
+		policy = *message.Policy
+	}
+
+	hubPoolLock.Lock()
+	if _, ok := HubPool[message.MeetingId]; ok {
+		hubPoolLock.Unlock()
+		return
+	}
+	hub := allocateHub(message.MeetingId, message.Code, message.Slug, policy, message.CreatedAt)
+	hub.moderatorToken = message.Moderator
+	hub.webhooks = message.Webhooks
+	hub.webhookSecret = message.Secret
+	for _, alias := range []string{message.Code, message.Slug} {
+		if alias == "" {
+			continue
+		}
+		if _, taken := hubAliases[normalizeAlias(alias)]; taken {
+			logger.WithField("alias", alias).Warning("Meeting code or slug already used locally, not claiming it.")
+			continue
+		}
+		hubAliases[normalizeAlias(alias)] = hub.hubId
+	}
+	HubPool[hub.hubId] = hub
+	metrics.ActiveMeetings.Set(float64(len(HubPool)))
+	hubPoolLock.Unlock()
+
+	err := db.CreateTable(ctx, hub.hubId)
+	if err == nil && len(message.Stack) > 0 {
+		err = db.RestoreStack(ctx, hub.hubId, message.Stack)
+	}
+	if err == nil {
+		err = hub.subscribe()
+	}
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Error adopting meeting from another instance.")
+		removeHub(hub.hubId)
+		return
+	}
+	go hub.run()
+	hub.registerWebhooks()
+	events.Publish(events.Event{Type: events.MeetingCreated, MeetingId: hub.hubId, Time: hub.createdAt, Remote: true})
+	logger.Debug("Adopted meeting from another instance.")
+}
+
+// subscribe starts listening for mutations and presence on the meeting's topic.
+func (h *Hub) subscribe() (err error) {
+	h.subscription, err = bus.Subscribe(meetingTopic(h.hubId), h.handleReplication)
+	return err
+}
+
+// publishLifecycle announces the meeting to the other instances.
+func (h *Hub) publishLifecycle(ctx context.Context, kind string, stackUsers []db.User) {
+	policy := h.policy
+	err := publishReplication(ctx, meetingsTopic, replicationMessage{
+		Type:      kind,
+		MeetingId: h.hubId,
+		Code:      h.code,
+		Slug:      h.slug,
+		Moderator: h.moderatorToken,
+		Webhooks:  h.webhooks,
+		Secret:    h.webhookSecret,
+		Policy:    &policy,
+		CreatedAt: h.createdAt,
+		Stack:     stackUsers,
+	})
+	if err != nil {
+		h.logger.WithField("error", err.Error()).Error("Error publishing meeting to the backplane.")
+	}
+}
+
+// publishPresence tells the other instances how many clients we have in the meeting
+// so that none of them prunes it while people are still connected here.
+func (h *Hub) publishPresence() {
+	h.mu.Lock()
+	clients := len(h.clients)
+	h.mu.Unlock()
+
+	err := publishReplication(context.Background(), meetingTopic(h.hubId), replicationMessage{
+		Type:      meetingPresence,
+		MeetingId: h.hubId,
+		Clients:   clients,
+	})
+	if err != nil {
+		h.logger.WithField("error", err.Error()).Warning("Error publishing meeting presence to the backplane.")
+	}
+}
+
+// publishMutation sends a stack action to every instance serving the meeting,
+// including this one, which then update their copy of the stack and broadcast it.
+func (h *Hub) publishMutation(ctx context.Context, action string, speakerId string, name string) error {
+	return publishReplication(ctx, meetingTopic(h.hubId), replicationMessage{
+		Type:      meetingMutation,
+		MeetingId: h.hubId,
+		Action:    action,
+		SpeakerId: speakerId,
+		Name:      name,
+	})
+}
+
+// handleReplication applies messages published to the meeting's topic.
+func (h *Hub) handleReplication(payload []byte) {
+	ctx, message, err := decodeReplication(payload)
+	if err != nil {
+		h.logger.WithField("error", err.Error()).Warning("Ignoring malformed meeting message.")
+		return
+	}
+
+	switch message.Type {
+	case meetingMutation:
+		h.applyMutation(ctx, message)
+	case meetingActivity:
+		h.applyActivity(message)
+	case meetingPresence:
+		if message.Instance == instanceId {
+			return
+		}
+		h.mu.Lock()
+		if message.Clients > 0 {
+			h.remoteClients[message.Instance] = message.Clients
+		} else {
+			delete(h.remoteClients, message.Instance)
+		}
+		if len(h.clients) == 0 && h.remoteClientCount() == 0 {
+			h.lastActive = h.clock.Now()
+		}
+		h.mu.Unlock()
+	}
+}
+
+// applyMutation puts the speaker on or off the stack in our copy of the meeting, or
+// applies a moderator action, publishes the resulting events and has the hub broadcast
+// the resulting stack to our clients. Any other action just rebroadcasts the current
+// stack.
+func (h *Hub) applyMutation(ctx context.Context, message replicationMessage) {
+	logger := h.logger.WithFields(log.Fields{
+		"function": "applyMutation",
+		"clientId": message.SpeakerId,
+		"action":   message.Action,
+	})
+	ctx = logging.WithLogger(ctx, logger)
+	h.applyMu.Lock()
+	defer h.applyMu.Unlock()
+
+	// Remember the stack before the change so we can tell what happened
+	before, err := db.ShowCurrentStack(ctx, h.hubId)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Error getting meeting stack before change.")
+	}
+
+	// Put user on/off stack based on action in request
+	switch message.Action {
+	case protocol.ActionOn:
+		err = db.GetOnStack(ctx, h.hubId, message.SpeakerId, message.Name)
+		if err != nil {
+			logger.Error("Error getting user on stack")
+		}
+	case protocol.ActionOff, protocol.ActionRemove:
+		err = db.GetOffStack(ctx, h.hubId, message.SpeakerId)
+		if err != nil {
+			logger.Error("Error getting user off stack")
+		}
+	case protocol.ActionNext:
+		if len(before) > 0 {
+			err = db.GetOffStack(ctx, h.hubId, before[0].SpeakerId)
+			if err != nil {
+				logger.Error("Error getting current speaker off stack")
+			}
+		}
+	}
+
+	// Record what changed in the meeting's event log
+	after, err := db.ShowCurrentStack(ctx, h.hubId)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Error getting meeting stack after change.")
+	} else {
+		h.publishStackEvents(message, before, after)
+	}
+
+	// Let the hub broadcast the new stack, along with any other changes made shortly after
+	logger.Debug("Notifying hub of stack change.")
+	h.notifyChanged(ctx)
+}
@@ -0,0 +1,154 @@
+package wshandler
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"stack-web-app/backplane"
+	"stack-web-app/db"
+	"stack-web-app/protocol"
+
+	"github.com/google/uuid"
+)
+
+// peerInstance is the instance ID of the other server the tests pretend to be.
+const peerInstance = "peer-instance"
+
+// useBackplane replicates over a fresh in-memory backplane until the test ends, with
+// the test publishing as a second instance sharing it.
+func useBackplane(t *testing.T) backplane.Backplane {
+	memory := backplane.NewMemory()
+	previous := bus
+	if err := StartReplication(memory); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bus = previous })
+	return memory
+}
+
+// publishAsPeer publishes a replication message from the other instance.
+func publishAsPeer(t *testing.T, b backplane.Backplane, topic string, message replicationMessage) {
+	t.Helper()
+	message.Instance = peerInstance
+	payload, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(context.Background(), topic, payload); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stackOf returns the speaker IDs on a meeting's stack in this instance's database.
+func stackOf(t *testing.T, hubId string) []string {
+	t.Helper()
+	users, err := db.ShowCurrentStack(context.Background(), hubId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, user := range users {
+		ids = append(ids, user.SpeakerId)
+	}
+	return ids
+}
+
+func TestMeetingsCreatedHereAreAnnounced(t *testing.T) {
+	b := useBackplane(t)
+	announced := make(chan replicationMessage, 10)
+	subscription, err := b.Subscribe(meetingsTopic, func(payload []byte) {
+		var message replicationMessage
+		if json.Unmarshal(payload, &message) == nil {
+			announced <- message
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Unsubscribe()
+
+	hub, err := newHub(context.Background(), "", DefaultPrunePolicy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeHub(hub.hubId)
+	defer hub.stop()
+
+	select {
+	case message := <-announced:
+		if message.Type != lifecycleCreated || message.MeetingId != hub.hubId || message.Instance != instanceId {
+			t.Errorf("announcement = %+v, want %s of %s from this instance", message, lifecycleCreated, hub.hubId)
+		}
+		if message.Code != hub.code || message.Moderator != hub.moderatorToken || message.Policy == nil {
+			t.Errorf("announcement = %+v, missing what the other instance needs to serve the meeting", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("meeting wasn't announced on the backplane")
+	}
+}
+
+func TestMeetingsReplicateBetweenInstances(t *testing.T) {
+	b := useBackplane(t)
+
+	// The other instance creates a meeting that already has someone on its stack
+	createdAt := time.Now().Add(-time.Hour)
+	meetingId := uuid.New().String()
+	t.Cleanup(func() {
+		if err := db.DeleteTable(context.Background(), meetingId); err != nil {
+			t.Error(err)
+		}
+	})
+	publishAsPeer(t, b, meetingsTopic, replicationMessage{
+		Type:      lifecycleCreated,
+		MeetingId: meetingId,
+		Code:      "RPL-123",
+		Moderator: "moderator-token",
+		Policy:    &PrunePolicy{GracePeriod: time.Minute, IdleTimeout: time.Minute},
+		CreatedAt: createdAt,
+		Stack:     []db.User{{SpeakerPostition: 1, SpeakerId: "first", Name: "First"}},
+	})
+	hub, ok := lookupHub(meetingId)
+	if !ok {
+		t.Fatal("meeting created on the other instance wasn't adopted")
+	}
+	defer removeHub(meetingId)
+	defer hub.stop()
+	if byCode, ok := lookupHub("rpl-123"); !ok || byCode != hub {
+		t.Error("adopted meeting can't be found by its code")
+	}
+	if !hub.isModerator("moderator-token") {
+		t.Error("adopted meeting doesn't accept the moderator token")
+	}
+	if got := stackOf(t, meetingId); len(got) != 1 || got[0] != "first" {
+		t.Fatalf("adopted stack = %v, want [first]", got)
+	}
+
+	// Stack mutations made on the other instance are applied to our copy, in order
+	topic := meetingTopic(meetingId)
+	publishAsPeer(t, b, topic, replicationMessage{Type: meetingMutation, MeetingId: meetingId, Action: protocol.ActionOn, SpeakerId: "second", Name: "Second"})
+	publishAsPeer(t, b, topic, replicationMessage{Type: meetingMutation, MeetingId: meetingId, Action: protocol.ActionOn, SpeakerId: "third", Name: "Third"})
+	publishAsPeer(t, b, topic, replicationMessage{Type: meetingMutation, MeetingId: meetingId, Action: protocol.ActionNext})
+	publishAsPeer(t, b, topic, replicationMessage{Type: meetingMutation, MeetingId: meetingId, Action: protocol.ActionOff, SpeakerId: "third"})
+	if got := stackOf(t, meetingId); len(got) != 1 || got[0] != "second" {
+		t.Errorf("stack after the other instance's changes = %v, want [second]", got)
+	}
+
+	// People connected to the other instance keep the meeting from being pruned here
+	now := createdAt.Add(2 * time.Hour)
+	publishAsPeer(t, b, topic, replicationMessage{Type: meetingPresence, MeetingId: meetingId, Clients: 2})
+	if reason := hub.pruneReason(now); reason != "" {
+		t.Errorf("meeting with clients on the other instance would be pruned: %s", reason)
+	}
+	publishAsPeer(t, b, topic, replicationMessage{Type: meetingPresence, MeetingId: meetingId, Clients: 0})
+	if reason := hub.pruneReason(hub.clock.Now().Add(2 * time.Minute)); reason != pruneReasonIdle {
+		t.Errorf("meeting everyone left would be pruned for %q, want %q", reason, pruneReasonIdle)
+	}
+
+	// Announcing the same meeting again doesn't replace our copy
+	publishAsPeer(t, b, meetingsTopic, replicationMessage{Type: lifecycleState, MeetingId: meetingId, CreatedAt: createdAt})
+	if again, _ := lookupHub(meetingId); again != hub {
+		t.Error("meeting was adopted a second time")
+	}
+}
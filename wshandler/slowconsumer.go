@@ -0,0 +1,167 @@
+package wshandler
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"stack-web-app/clock"
+	"stack-web-app/metrics"
+	"stack-web-app/protocol"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SlowConsumerPolicy decides what happens to clients that can't keep up with the
+// meeting's broadcasts and fill their send buffer.
+type SlowConsumerPolicy struct {
+	// Strikes is how many times a client's buffer may fill up before it is
+	// disconnected. Each time, the stale messages in its buffer are thrown away in
+	// favour of the latest stack and the client is warned.
+	Strikes int
+
+	// RejoinGrace is how long a disconnected slow client has to reconnect with its
+	// resume token before it is taken off the stack.
+	RejoinGrace time.Duration
+}
+
+// DefaultSlowConsumerPolicy is the policy used unless configured otherwise.
+var DefaultSlowConsumerPolicy = SlowConsumerPolicy{
+	Strikes:     3,
+	RejoinGrace: 30 * time.Second,
+}
+
+// errSlowConsumer is sent to clients whose buffer filled up.
+var errSlowConsumer = errors.New("your connection is too slow to keep up with the meeting, some updates were skipped")
+
+// resumable is a slow client that was disconnected but can still resume.
+type resumable struct {
+	clientId string
+	timer    clock.Timer
+}
+
+// ConfigureSlowConsumers reads the slow consumer policy from the SLOW_CONSUMER_STRIKES
+// and SLOW_CONSUMER_REJOIN_GRACE environment variables.
+func ConfigureSlowConsumers() error {
+	if err := intFromEnv("SLOW_CONSUMER_STRIKES", &DefaultSlowConsumerPolicy.Strikes); err != nil {
+		return err
+	}
+	return durationFromEnv("SLOW_CONSUMER_REJOIN_GRACE", &DefaultSlowConsumerPolicy.RejoinGrace)
+}
+
+// sendWelcome queues the welcome message for a stack.v2 client that just joined. It
+// must only be called from the run goroutine.
+func (h *Hub) sendWelcome(client *Client) {
+	if !patches(client.protocol) {
+		return
+	}
+	message, err := client.codec.marshal(protocol.Welcome{
+		Type:        protocol.MessageWelcome,
+		ClientId:    client.clientId,
+		ResumeToken: client.resumeToken,
+	})
+	if err != nil {
+		h.logger.WithField("error", err.Error()).Error("Error encoding welcome message.")
+		return
+	}
+	select {
+	case client.send <- message:
+	default:
+	}
+}
+
+// deliver queues a broadcast message for a client, applying the slow consumer policy
+// if its buffer is full. It returns false if the client was disconnected. It must only
+// be called from the run goroutine.
+func (h *Hub) deliver(client *Client, message []byte) bool {
+	select {
+	case client.send <- message:
+		if len(client.send) == 1 {
+			// The client has caught up since its last strike
+			client.strikes = 0
+		}
+		return true
+	default:
+	}
+
+	logger := h.logger.WithFields(log.Fields{
+		"function": "deliver",
+		"clientId": client.clientId,
+	})
+	client.strikes++
+	if client.strikes > DefaultSlowConsumerPolicy.Strikes {
+		logger.Info("Disconnecting slow client.")
+		h.evict(client)
+		return false
+	}
+
+	// Throw away the stale messages and queue the latest stack with a warning instead
+	logger.WithField("strikes", client.strikes).Debug("Client buffer full, skipping stale messages.")
+	metrics.SlowConsumerWarnings.Inc()
+	for len(client.send) > 0 {
+		select {
+		case <-client.send:
+		default:
+		}
+	}
+	warning, err := client.codec.marshal(protocol.Warning{Warning: errSlowConsumer.Error()})
+	if err == nil {
+		client.send <- warning
+	}
+	h.sendSnapshot(client)
+	return true
+}
+
+// evict disconnects a slow client without taking it off the stack, giving it the
+// rejoin grace period to resume. It must only be called from the run goroutine.
+func (h *Hub) evict(client *Client) {
+	client.evicted = true
+	close(client.send)
+	h.removeClient(client)
+	h.publishActivity(activityLeave, client.clientId)
+	metrics.DroppedClients.Inc()
+
+	h.mu.Lock()
+	h.resumable[client.resumeToken] = resumable{
+		clientId: client.clientId,
+		timer: h.clock.AfterFunc(DefaultSlowConsumerPolicy.RejoinGrace, func() {
+			h.expireResume(client.resumeToken)
+		}),
+	}
+	h.mu.Unlock()
+}
+
+// resume reclaims the place of a disconnected slow client, returning its client ID if
+// the token is valid and its grace period hasn't run out.
+func (h *Hub) resume(token string) (clientId string, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entry, ok := h.resumable[token]
+	if !ok || !entry.timer.Stop() {
+		return "", false
+	}
+	delete(h.resumable, token)
+	return entry.clientId, true
+}
+
+// expireResume takes a slow client that didn't come back in time off the stack.
+func (h *Hub) expireResume(token string) {
+	h.mu.Lock()
+	entry, ok := h.resumable[token]
+	delete(h.resumable, token)
+	h.mu.Unlock()
+	if !ok || h.stopped() {
+		return
+	}
+
+	logger := h.logger.WithFields(log.Fields{
+		"function": "expireResume",
+		"clientId": entry.clientId,
+	})
+	logger.Debug("Slow client didn't resume in time, taking it off the stack.")
+	err := h.publishMutation(context.Background(), protocol.ActionOff, entry.clientId, "")
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Error getting slow client off stack.")
+	}
+}
@@ -0,0 +1,67 @@
+package wshandler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"stack-web-app/db"
+	"stack-web-app/protocol"
+)
+
+// onStack reports whether the client is on the hub's stack.
+func onStack(t *testing.T, hub *Hub, clientId string) bool {
+	t.Helper()
+	stack, err := db.ShowCurrentStack(context.Background(), hub.hubId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range stack {
+		if user.SpeakerId == clientId {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEvictedClientsKeepTheirPlace(t *testing.T) {
+	fake := useFakeClock(t)
+	hub, err := newHub(context.Background(), "", DefaultPrunePolicy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hub.run()
+	defer func() {
+		removeHub(hub.hubId)
+		hub.stop()
+	}()
+
+	// Neither client is registered, so the run goroutine never touches them
+	legacy := &Client{hub: hub, send: make(chan []byte, 1), clientId: "legacy", resumeToken: "legacy-token"}
+	modern := &Client{hub: hub, send: make(chan []byte, 1), clientId: "modern", resumeToken: "modern-token",
+		protocol: protocol.ProtocolV2}
+	for _, client := range []*Client{legacy, modern} {
+		if err := db.GetOnStack(context.Background(), hub.hubId, client.clientId, client.clientId); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hub.evict(legacy)
+	hub.evict(modern)
+	fake.Advance(DefaultSlowConsumerPolicy.RejoinGrace - time.Second)
+	for _, client := range []*Client{legacy, modern} {
+		if !onStack(t, hub, client.clientId) {
+			t.Fatalf("%s client was taken off the stack before its grace period ran out", client.clientId)
+		}
+	}
+
+	// The legacy client comes back with the token from the close reason
+	if clientId, ok := hub.resume(legacy.resumeToken); !ok || clientId != legacy.clientId {
+		t.Errorf("resume(%q) = %q, %v, want the legacy client back", legacy.resumeToken, clientId, ok)
+	}
+	fake.Advance(time.Second)
+	waitFor(t, "the stack.v2 client's grace period to run out", func() bool { return !onStack(t, hub, "modern") })
+	if !onStack(t, hub, "legacy") {
+		t.Error("legacy client that resumed was taken off the stack")
+	}
+}
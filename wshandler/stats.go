@@ -0,0 +1,28 @@
+package wshandler
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// prunerLastRun holds the time the pruner last finished checking meetings.
+var prunerLastRun atomic.Value
+
+// Stats returns the number of active meeting hubs and connected clients.
+func Stats() (hubs int, clients int) {
+	hubPoolLock.RLock()
+	defer hubPoolLock.RUnlock()
+
+	for _, hub := range HubPool {
+		hub.mu.Lock()
+		clients += len(hub.clients)
+		hub.mu.Unlock()
+	}
+	return len(HubPool), clients
+}
+
+// PrunerLastRun returns when the pruner last ran, or the zero time if it hasn't yet.
+func PrunerLastRun() time.Time {
+	lastRun, _ := prunerLastRun.Load().(time.Time)
+	return lastRun
+}
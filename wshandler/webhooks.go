@@ -0,0 +1,98 @@
+package wshandler
+
+import (
+	"fmt"
+	"net/http"
+
+	"stack-web-app/protocol"
+	"stack-web-app/webhook"
+
+	"github.com/gorilla/mux"
+)
+
+// maxMeetingWebhooks is the most webhook URLs a single meeting may register.
+const maxMeetingWebhooks = 5
+
+// webhooks delivers meeting events to webhook endpoints, nil when webhooks are off.
+var webhooks *webhook.Dispatcher
+
+// meetingWebhooksReturn is the JSON body returned by GetMeetingWebhooks.
+type meetingWebhooksReturn struct {
+	MeetingId  string             `json:"meetingId"`
+	Webhooks   []string           `json:"webhooks"`
+	Deliveries []webhook.Delivery `json:"deliveries"`
+}
+
+// UseWebhooks has meetings register their webhook URLs with the dispatcher. Meetings
+// created before it is called, or without it being called at all, have none.
+func UseWebhooks(d *webhook.Dispatcher) {
+	webhooks = d
+}
+
+// validateWebhooks checks the webhook URLs given when creating a meeting.
+func validateWebhooks(urls []string) error {
+	if len(urls) > maxMeetingWebhooks {
+		return fmt.Errorf("a meeting may have at most %d webhooks", maxMeetingWebhooks)
+	}
+	if len(urls) > 0 && webhooks == nil {
+		return webhook.ErrMeetingWebhooksDisabled
+	}
+	for _, target := range urls {
+		if err := webhooks.ValidateMeetingURL(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerWebhooks tells the dispatcher where to deliver the meeting's events. Every
+// instance registers them, since events are delivered by the instance they happen on.
+func (h *Hub) registerWebhooks() {
+	if webhooks == nil || len(h.webhooks) == 0 {
+		return
+	}
+	endpoints := make([]webhook.Endpoint, 0, len(h.webhooks))
+	for _, target := range h.webhooks {
+		endpoints = append(endpoints, webhook.Endpoint{URL: target, Secret: h.webhookSecret})
+	}
+	webhooks.SetMeetingEndpoints(h.hubId, endpoints)
+}
+
+// GetMeetingWebhooks returns a meeting's webhook URLs and the deliveries made to them
+// by this instance. Requests must carry the meeting's moderator token as a bearer
+// token. Only whether each delivery succeeded is shown, not the status or error it
+// failed with, so that webhooks can't be used to probe what the server can reach.
+func GetMeetingWebhooks(w http.ResponseWriter, r *http.Request) {
+	hub, ok := lookupHub(mux.Vars(r)["meetingId"])
+	if !ok {
+		writeJSON(w, r, http.StatusNotFound, protocol.Error{Error: "meeting not found"})
+		return
+	}
+	token := r.Header.Get("Authorization")
+	if len(token) < len("Bearer ") || !hub.isModerator(token[len("Bearer "):]) {
+		writeJSON(w, r, http.StatusUnauthorized, protocol.Error{Error: ErrNotModerator.Error()})
+		return
+	}
+
+	response := meetingWebhooksReturn{
+		MeetingId:  hub.hubId,
+		Webhooks:   hub.webhooks,
+		Deliveries: []webhook.Delivery{},
+	}
+	if response.Webhooks == nil {
+		response.Webhooks = []string{}
+	}
+	if webhooks != nil {
+		for _, delivery := range webhooks.Deliveries(hub.hubId) {
+			// Deliveries to server wide endpoints are only for the server's operators
+			for _, target := range hub.webhooks {
+				if delivery.URL == target {
+					delivery.Status, delivery.Error = 0, ""
+					response.Deliveries = append(response.Deliveries, delivery)
+					break
+				}
+			}
+		}
+	}
+	writeJSON(w, r, http.StatusOK, response)
+}